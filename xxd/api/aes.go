@@ -13,9 +13,36 @@ import (
     "bytes"
     "crypto/aes"
     "crypto/cipher"
+    "crypto/rand"
+    "crypto/subtle"
+    "io"
     "xxd/util"
 )
 
+//根据协议版本加密
+func Encrypt(origData, key []byte, crypto string) ([]byte, error) {
+    switch crypto {
+    case util.CryptoGCM:
+        return aesGCMEncrypt(origData, key)
+    case util.CryptoCBC, "":
+        return aesEncrypt(origData, key)
+    }
+
+    return nil, util.Errorf("unsupported crypto %s", crypto)
+}
+
+//根据协议版本解密
+func Decrypt(crypted, key []byte, crypto string) ([]byte, error) {
+    switch crypto {
+    case util.CryptoGCM:
+        return aesGCMDecrypt(crypted, key)
+    case util.CryptoCBC, "":
+        return aesDecrypt(crypted, key)
+    }
+
+    return nil, util.Errorf("unsupported crypto %s", crypto)
+}
+
 //ase加密
 func aesEncrypt(origData, key []byte) ([]byte, error) {
     block, err := aes.NewCipher(key)
@@ -49,7 +76,7 @@ func aesDecrypt(crypted, key []byte) ([]byte, error) {
     origData := make([]byte, cryptedSize)
     // origData := crypted
     blockMode.CryptBlocks(origData, crypted)
-    origData = pkcs5UnPadding(origData)
+    origData = pkcs5UnPadding(origData, blockSize)
     if origData == nil {
         return nil, util.Errorf("%s\n", "pkcs5 UnPadding error")
     }
@@ -57,18 +84,73 @@ func aesDecrypt(crypted, key []byte) ([]byte, error) {
     return origData, nil
 }
 
+//aes-gcm加密，输出格式为 nonce + 密文 + tag，每条消息使用随机的nonce
+func aesGCMEncrypt(origData, key []byte) ([]byte, error) {
+    aead, err := newGCM(key)
+    if err != nil {
+        return nil, err
+    }
+
+    nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(origData)+aead.Overhead())
+    if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+        return nil, err
+    }
+
+    return aead.Seal(nonce, nonce, origData, nil), nil
+}
+
+//aes-gcm解密，被篡改的数据无法通过tag校验
+func aesGCMDecrypt(crypted, key []byte) ([]byte, error) {
+    aead, err := newGCM(key)
+    if err != nil {
+        return nil, err
+    }
+
+    nonceSize := aead.NonceSize()
+    if len(crypted) < nonceSize+aead.Overhead() {
+        return nil, util.Errorf("%s\n", "input too short")
+    }
+
+    origData, err := aead.Open(nil, crypted[:nonceSize], crypted[nonceSize:], nil)
+    if err != nil {
+        return nil, util.Errorf("%s\n", "message authentication failed")
+    }
+
+    return origData, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+
+    return cipher.NewGCM(block)
+}
+
 func pkcs5Padding(ciphertext []byte, blockSize int) []byte {
     padding := blockSize - len(ciphertext)%blockSize
     padtext := bytes.Repeat([]byte{byte(padding)}, padding)
     return append(ciphertext, padtext...)
 }
 
-func pkcs5UnPadding(origData []byte) []byte {
+func pkcs5UnPadding(origData []byte, blockSize int) []byte {
     length := len(origData)
+    if length == 0 {
+        return nil
+    }
+
     // 去掉最后一个字节 unpadding 次
     unpadding := int(origData[length-1])
-    if unpadding > length {
-        util.LogError().Println("aes unpadding len > data length")
+    if unpadding == 0 || unpadding > blockSize || unpadding > length {
+        util.LogError().Println("aes unpadding length error")
+        return nil
+    }
+
+    // 每个填充字节都必须等于填充长度
+    padding := bytes.Repeat([]byte{byte(unpadding)}, unpadding)
+    if subtle.ConstantTimeCompare(origData[length-unpadding:], padding) != 1 {
+        util.LogError().Println("aes unpadding bytes error")
         return nil
     }
 
@@ -0,0 +1,87 @@
+package api
+
+import (
+    "bytes"
+    "testing"
+    "xxd/util"
+)
+
+// go test -v xxd/api
+
+var testKey = []byte("88888888888888888888888888888888")
+
+func TestEncryptRoundTrip(t *testing.T) {
+    origData := []byte(`{"module":"chat","method":"login","params":[""]}`)
+
+    for _, crypto := range []string{util.CryptoCBC, util.CryptoGCM} {
+        crypted, err := Encrypt(origData, testKey, crypto)
+        if err != nil {
+            t.Fatalf("%s encrypt error: %v", crypto, err)
+        }
+
+        decrypted, err := Decrypt(crypted, testKey, crypto)
+        if err != nil {
+            t.Fatalf("%s decrypt error: %v", crypto, err)
+        }
+
+        if !bytes.Equal(decrypted, origData) {
+            t.Errorf("%s round trip got %q, want %q", crypto, decrypted, origData)
+        }
+    }
+}
+
+func TestGCMRandomNonce(t *testing.T) {
+    origData := []byte(`{"module":"chat","method":"ping"}`)
+
+    first, _ := Encrypt(origData, testKey, util.CryptoGCM)
+    second, _ := Encrypt(origData, testKey, util.CryptoGCM)
+    if bytes.Equal(first, second) {
+        t.Error("gcm encrypted the same message to the same bytes twice")
+    }
+}
+
+func TestGCMRejectsTampering(t *testing.T) {
+    crypted, err := Encrypt([]byte(`{"module":"chat","method":"message"}`), testKey, util.CryptoGCM)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for i := range crypted {
+        tampered := append([]byte{}, crypted...)
+        tampered[i] ^= 0x01
+        if _, err := Decrypt(tampered, testKey, util.CryptoGCM); err == nil {
+            t.Fatalf("tampered byte %d was accepted", i)
+        }
+    }
+
+    if _, err := Decrypt(crypted[:10], testKey, util.CryptoGCM); err == nil {
+        t.Error("truncated frame was accepted")
+    }
+}
+
+func TestCBCRejectsBadPadding(t *testing.T) {
+    cases := [][]byte{
+        append(bytes.Repeat([]byte{'a'}, 15), 0),                             // zero padding
+        append(bytes.Repeat([]byte{'a'}, 15), 17),                            // longer than block
+        append(bytes.Repeat([]byte{'a'}, 13), 1, 3, 3),                       // inconsistent bytes
+        append(bytes.Repeat([]byte{'a'}, 12), 4, 4, 4, 4),                    // valid
+        append(bytes.Repeat([]byte{'a'}, 16), bytes.Repeat([]byte{16}, 16)...), // full block
+    }
+    valid := []bool{false, false, false, true, true}
+
+    for i, origData := range cases {
+        if got := pkcs5UnPadding(origData, 16) != nil; got != valid[i] {
+            t.Errorf("case %d: padding accepted = %t, want %t", i, got, valid[i])
+        }
+    }
+}
+
+func TestUnsupportedCrypto(t *testing.T) {
+    if _, err := Encrypt([]byte("{}"), testKey, "rot13"); err == nil {
+        t.Error("unknown crypto was accepted by Encrypt")
+    }
+
+    if _, err := Decrypt([]byte("{}"), testKey, "rot13"); err == nil {
+        t.Error("unknown crypto was accepted by Decrypt")
+    }
+}
@@ -0,0 +1,42 @@
+/**
+ * The backend file of apitest current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     apitest
+ * @link        http://www.zentao.net
+ */
+package apitest
+
+import (
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "xxd/api"
+    "xxd/util"
+)
+
+//启动模拟的后端服务器，测试结束时关闭。请求使用token和gcm解密后交给respond，
+//返回respond的结果；解密失败或respond返回nil时返回400
+func NewBackend(t testing.TB, token string, respond func(request api.ParseData) api.ParseData) *httptest.Server {
+    xxb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := ioutil.ReadAll(r.Body)
+        request, err := api.ApiParse(body, []byte(token), util.CryptoGCM)
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            return
+        }
+
+        response := respond(request)
+        if response == nil {
+            w.WriteHeader(http.StatusBadRequest)
+            return
+        }
+        w.Write(api.ApiUnparse(response, []byte(token), util.CryptoGCM))
+    }))
+    t.Cleanup(xxb.Close)
+
+    return xxb
+}
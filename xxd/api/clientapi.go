@@ -25,22 +25,22 @@ func ChatLogin(clientData ParseData) ([]byte, int64, bool) {
     }
 
     // 到http服务器请求，返回加密的结果
-    retMessage, err := hyperttp.RequestInfo(ranzhiServer.RanzhiAddr, ApiUnparse(clientData, ranzhiServer.RanzhiToken))
+    retMessage, err := hyperttp.RequestInfo(ranzhiServer.RanzhiAddr, ApiUnparse(clientData, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto))
     if err != nil {
         util.LogError().Println("hyperttp request info error:", err)
         return nil, -1, false
     }
 
-    // 解析http服务器的数据,返回 ParseData 类型的数据
-    retData, err := ApiParse(retMessage, ranzhiServer.RanzhiToken)
+    retMessage, err = BackendDecrypt(retMessage, ranzhiServer)
     if err != nil {
-        util.LogError().Println("api parse error:", err)
+        util.LogError().Println("chat login decrypt error:", err)
         return nil, -1, false
     }
 
-    retMessage, err = SwapToken(retMessage, ranzhiServer.RanzhiToken, util.Token)
+    // 解析http服务器的数据,返回 ParseData 类型的数据
+    retData, err := JsonParse(retMessage)
     if err != nil {
-        util.LogError().Println("chat login swap token error:", err)
+        util.LogError().Println("api parse error:", err)
         return nil, -1, false
     }
 
@@ -50,7 +50,7 @@ func ChatLogin(clientData ParseData) ([]byte, int64, bool) {
     }
 
     // 返回值：
-    // 1、返回给客户端加密后的数据
+    // 1、返回给客户端的数据
     // 2、返回用户的ID
     // 3、返回登录的结果
     return retMessage, retData.loginUserID(), result
@@ -65,9 +65,8 @@ func ChatLogout(serverName string, userID int64, lang string) ([]byte, []int64,
     }
 
     request := []byte(`{"module":"chat","method":"logout","lang":"` + lang + `","userID":` + util.Int642String(userID) + `}`)
-    message, err := aesEncrypt(request, ranzhiServer.RanzhiToken)
+    message, err := BackendEncrypt(request, ranzhiServer)
     if err != nil {
-        util.LogError().Println("aes encrypt error:", err)
         return nil, nil, err
     }
 
@@ -79,7 +78,7 @@ func ChatLogout(serverName string, userID int64, lang string) ([]byte, []int64,
     }
 
     // 解析http服务器的数据,返回 ParseData 类型的数据
-    parseData, err := ApiParse(r2xMessage, ranzhiServer.RanzhiToken)
+    parseData, err := ApiParse(r2xMessage, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto)
     if err != nil {
         util.LogError().Println("api parse error", err)
         return nil, nil, err
@@ -87,7 +86,7 @@ func ChatLogout(serverName string, userID int64, lang string) ([]byte, []int64,
 
     sendUsers := parseData.SendUsers()
 
-    x2cMessage := ApiUnparse(parseData, util.Token)
+    x2cMessage := JsonUnparse(parseData)
     if x2cMessage == nil {
         return nil, nil, err
     }
@@ -101,27 +100,49 @@ func RepeatLogin() []byte {
     repeatLogin := []byte(`{"module":"chat","method":"kickoff","message":"当前账号已在其他地方登录，如果不是本人操作，请及时修改密码"}`)
     //repeatLogin := []byte(`{"module":"chat","method:"kickoff","message":"This account logined in another place."}`)
 
-    message, err := aesEncrypt(repeatLogin, util.Token)
-    if err != nil {
-        util.LogError().Println("aes encrypt error:", err)
-        return nil
+    return repeatLogin
+}
+
+
+//后端服务器已从配置中移除
+func BackendRemoved() []byte {
+    backendRemoved := []byte(`{"module":"chat","method":"kickoff","message":"当前服务器已被管理员移除，请联系管理员"}`)
+
+    return backendRemoved
+}
+
+//管理员强制下线，reason为空时使用默认提示
+func AdminKickoff(reason string) []byte {
+    if reason == "" {
+        reason = "当前账号已被管理员强制下线，请联系管理员"
     }
 
-    return message
+    kickoff := ParseData{"module": "chat", "method": "kickoff", "message": reason}
+    return JsonUnparse(kickoff)
+}
+
+//启用消息确认的客户端注册后收到的队列信息，acked为已确认的最大序号，之后重发未确认的消息
+func AckStream(stream string, acked uint64) []byte {
+    ackStream := ParseData{"module": "chat", "method": "ack", "data": map[string]interface{}{"stream": stream, "acked": acked}}
+    return JsonUnparse(ackStream)
 }
 
+//管理员发送的系统通知
+func SystemNotice(message string) []byte {
+    notice := make(map[string]interface{})
+    notice["title"] = "系统通知"
+    notice["content"] = message
+    notice["type"] = "system"
+
+    notify := ParseData{"module": "chat", "method": "notify", "data": []interface{}{notice}}
+    return JsonUnparse(notify)
+}
 
 //重新登录
 func BlockLogin() []byte {
     blockLogin := []byte(`{"module":"chat","method":"blockLogin","message":"同时在线超出系统限制"}`)
 
-    message, err := aesEncrypt(blockLogin, util.Token)
-    if err != nil {
-        util.LogError().Println("aes encrypt error:", err)
-        return nil
-    }
-
-    return message
+    return blockLogin
 }
 
 //测试登录
@@ -129,28 +150,21 @@ func TestLogin() []byte {
     loginData := []byte(`{"result":"success","data":{"id":12,"account":"demo8","realname":"\u6210\u7a0b\u7a0b","avatar":"","role":"hr","dept":0,"status":"online","admin":"no","gender":"f","email":"ccc@demo.com","mobile":"","site":"","phone":""},"sid":"18025976a786ec78194e491e7b790731","module":"chat","method":"login"}`)
 
     //loginData = append(loginData, newline...)
-    message, err := aesEncrypt(loginData, util.Token)
-    if err != nil {
-        util.LogError().Println("aes encrypt error:", err)
-        return nil
-    }
-
-    return message
+    return loginData
 }
 
 // 除登录和退出的数据中转.
-func TransitData(clientData []byte, serverName string) ([]byte, []int64, error) {
+func TransitData(clientData ParseData, serverName string) ([]byte, []int64, error) {
     ranzhiServer, ok := RanzhiServer(serverName)
     if !ok {
         util.LogError().Println("no ranzhi server name")
         return nil, nil, util.Errorf("%s\n", "no ranzhi server name")
     }
 
-    //交换token
-    message, err := SwapToken(clientData, util.Token, ranzhiServer.RanzhiToken)
-    if err != nil {
-        util.LogError().Println("transit data swap token error:", err)
-        return nil, nil, err
+    //按后端服务器的协议重新加密
+    message := ApiUnparse(clientData, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto)
+    if message == nil {
+        return nil, nil, util.Errorf("%s\n", "transit data encrypt error")
     }
 
     // ranzhi to xxd message
@@ -160,7 +174,7 @@ func TransitData(clientData []byte, serverName string) ([]byte, []int64, error)
         return nil, nil, err
     }
 
-    parseData, err := ApiParse(r2xMessage, ranzhiServer.RanzhiToken)
+    parseData, err := ApiParse(r2xMessage, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto)
     if err != nil {
         util.LogError().Println("api parse error:", err)
         return nil, nil, err
@@ -169,7 +183,7 @@ func TransitData(clientData []byte, serverName string) ([]byte, []int64, error)
     sendUsers := parseData.SendUsers()
 
     // xxd to client message
-    x2cMessage := ApiUnparse(parseData, util.Token)
+    x2cMessage := JsonUnparse(parseData)
     if x2cMessage == nil {
         return nil, nil, err
     }
@@ -188,9 +202,8 @@ func UserGetlist(serverName string, userID int64, lang string) ([]byte, error) {
     // 固定的json格式
     request := []byte(`{"module":"chat","method":"userGetlist", "lang":"` + lang + `", "params":[""],"userID":` + util.Int642String(userID) + `}`)
 
-    message, err := aesEncrypt(request, ranzhiServer.RanzhiToken)
+    message, err := BackendEncrypt(request, ranzhiServer)
     if err != nil {
-        util.LogError().Println("aes encrypt error:", err)
         return nil, err
     }
 
@@ -201,31 +214,58 @@ func UserGetlist(serverName string, userID int64, lang string) ([]byte, error) {
         return nil, err
     }
 
-    //由于http服务器和客户端的token不一致，所以需要进行交换
-    retData, err := SwapToken(retMessage, ranzhiServer.RanzhiToken, util.Token)
+    //解密后返回，发送给客户端时再按客户端的协议加密
+    retData, err := BackendDecrypt(retMessage, ranzhiServer)
     if err != nil {
-        util.LogError().Println("user get list swap token error:", err)
+        util.LogError().Println("user get list decrypt error:", err)
         return nil, err
     }
 
     return retData, nil
 }
 
-//用户文件SessionID 作用于文件下载 为适配web版客户端
-func UserFileSessionID(serverName string, userID int64, lang string) ([]byte, error) {
-    sessionID := util.GetMD5(serverName + util.Int642String(userID) + util.Int642String(util.GetUnixTime()))
+//用户文件SessionID 作用于文件下载 为适配web版客户端，每次登录生成随机的SessionID
+func UserFileSessionID(serverName string, userID int64, lang string) ([]byte, string, error) {
+    sessionID, err := randomHex(16)
+    if err != nil {
+        return nil, "", err
+    }
     sessionData := []byte(`{"module":"chat","method":"SessionID", "lang":"` + lang + `", "sessionID":"` + sessionID + `"}`)
 
     //将sessionID 存入公共空间
-    util.CreateUid(serverName, userID, sessionID)
+    if err := util.CreateUid(serverName, userID, sessionID); err != nil {
+        return nil, "", err
+    }
+
+    return sessionData, sessionID, nil
+}
+
+//签发文件下载链接，params为[gid, 文件ID, 文件名, 上传时间]，后端服务器确认用户可以访问文件后才返回链接
+func DownloadURL(clientData ParseData, serverName string, userID int64) []byte {
+    gid, fileID := clientData.Param(0), clientData.Param(1)
+    link := util.DownloadLink{Server: serverName, FileID: fileID, FileName: clientData.Param(2), Time: clientData.Param(3), UserID: userID}
+    retData := ParseData{"module": "chat", "method": "downloadUrl", "result": "fail", "data": map[string]interface{}{"gid": gid, "id": fileID}}
 
-    sessionData, err := aesEncrypt(sessionData, util.Token)
+    if _, err := util.String2Int64(link.Time); err != nil || gid == "" || fileID == "" || link.FileName == "" {
+        retData["message"] = "invalid params"
+        return JsonUnparse(retData)
+    }
+
+    ok, err := CheckFileAccess(serverName, userID, gid, fileID)
     if err != nil {
-        util.LogError().Println("aes encrypt error:", err)
-        return nil, err
+        util.LogError().Println("check file access error:", err)
+        retData["message"] = "check file access error"
+        return JsonUnparse(retData)
+    }
+    if !ok {
+        retData["message"] = "permission denied"
+        return JsonUnparse(retData)
     }
 
-    return sessionData, nil
+    link.Expires = util.GetUnixTime() + util.Config.DownloadTTL
+    retData["result"] = "success"
+    retData["data"] = map[string]interface{}{"gid": gid, "id": fileID, "url": link.URL(), "expires": link.Expires}
+    return JsonUnparse(retData)
 }
 
 //获取用户的会话列表
@@ -238,9 +278,8 @@ func Getlist(serverName string, userID int64, lang string) ([]byte, error) {
 
     // 固定的json格式
     request := []byte(`{"module":"chat","method":"getlist", "lang":"` + lang + `", "userID":` + util.Int642String(userID) + `}`)
-    message, err := aesEncrypt(request, ranzhiServer.RanzhiToken)
+    message, err := BackendEncrypt(request, ranzhiServer)
     if err != nil {
-        util.LogError().Println("aes encrypt error:", err)
         return nil, err
     }
 
@@ -251,10 +290,10 @@ func Getlist(serverName string, userID int64, lang string) ([]byte, error) {
         return nil, err
     }
 
-    //由于http服务器和客户端的token不一致，所以需要进行交换
-    retData, err := SwapToken(retMessage, ranzhiServer.RanzhiToken, util.Token)
+    //解密后返回，发送给客户端时再按客户端的协议加密
+    retData, err := BackendDecrypt(retMessage, ranzhiServer)
     if err != nil {
-        util.LogError().Println("get list swap token error:", err)
+        util.LogError().Println("get list decrypt error:", err)
         return nil, err
     }
 
@@ -272,9 +311,8 @@ func GetofflineMessages(serverName string, userID int64, lang string) ([]byte, e
 
     // 固定的json格式
     request := []byte(`{"module":"chat","method":"getOfflineMessages", "lang":"` + lang + `", "userID":` + util.Int642String(userID) + `}`)
-    message, err := aesEncrypt(request, ranzhiServer.RanzhiToken)
+    message, err := BackendEncrypt(request, ranzhiServer)
     if err != nil {
-        util.LogError().Println("aes encrypt error:", err)
         return nil, err
     }
 
@@ -285,10 +323,10 @@ func GetofflineMessages(serverName string, userID int64, lang string) ([]byte, e
         return nil, err
     }
 
-    //由于http服务器和客户端的token不一致，所以需要进行交换
-    retData, err := SwapToken(retMessage, ranzhiServer.RanzhiToken, util.Token)
+    //解密后返回，发送给客户端时再按客户端的协议加密
+    retData, err := BackendDecrypt(retMessage, ranzhiServer)
     if err != nil {
-        util.LogError().Println("get off line message swap token error:", err)
+        util.LogError().Println("get off line message decrypt error:", err)
         return nil, err
     }
 
@@ -305,9 +343,8 @@ func GetOfflineNotify(serverName string, userID int64, lang string) ([]byte, err
 
     // 固定的json格式
     request := []byte(`{"module":"chat","method":"getOfflineNotify", "lang":"` + lang + `", "userID":` + util.Int642String(userID) + `}`)
-    message, err := aesEncrypt(request, ranzhiServer.RanzhiToken)
+    message, err := BackendEncrypt(request, ranzhiServer)
     if err != nil {
-        util.LogError().Println("aes encrypt error:", err)
         return nil, err
     }
 
@@ -318,10 +355,10 @@ func GetOfflineNotify(serverName string, userID int64, lang string) ([]byte, err
         return nil, err
     }
 
-    //由于http服务器和客户端的token不一致，所以需要进行交换
-    retData, err := SwapToken(retMessage, ranzhiServer.RanzhiToken, util.Token)
+    //解密后返回，发送给客户端时再按客户端的协议加密
+    retData, err := BackendDecrypt(retMessage, ranzhiServer)
     if err != nil {
-        util.LogError().Println("get off line message swap token error:", err)
+        util.LogError().Println("get off line message decrypt error:", err)
         return nil, err
     }
 
@@ -351,36 +388,44 @@ func ReportAndGetNotify(server string, lang string) (map[int64][]byte, error) {
     trunk["params"] = params
 
     //send message to xxb and get notify data
-    retMessage, err := hyperttp.RequestInfo(ranzhiServer.RanzhiAddr, ApiUnparse(trunk, ranzhiServer.RanzhiToken))
+    retMessage, err := hyperttp.RequestInfo(ranzhiServer.RanzhiAddr, ApiUnparse(trunk, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto))
     if err != nil {
         util.LogError().Println("hyperttp request info error:", err)
         return nil, err
     }
 
-    decodeData, _ := ApiParse(retMessage, ranzhiServer.RanzhiToken)
+    decodeData, _ := ApiParse(retMessage, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto)
     if decodeData.Result() != "success" {
         return nil, err
     }
 
-    messageList := make(map[int64][]byte)
-    switch decodeData["data"].(type) {
-      case map[string]interface{} :
-          data := decodeData["data"].(map[string]interface{})
-          for userID, messages := range data {
-              userNotify := make(map[string]interface{})
-              userNotify["module"] = "chat"
-              userNotify["method"] = "notify"
-              userNotify["data"] = messages
-              uid, _ := util.String2Int64(userID)
-              messageList[uid] = ApiUnparse(userNotify, util.Token)
-          }
-    }
+    messageList := NotifyMessages(decodeData["data"])
 
     go util.DBDeleteOffline(server, offline)
     go util.DBDeleteSendfail(server, sendfail)
     return messageList, nil
 }
 
+//把后端服务器返回的通知按用户转换为chat.notify消息，data格式为 {userID: messages}
+func NotifyMessages(data interface{}) map[int64][]byte {
+    messageList := make(map[int64][]byte)
+    users, ok := data.(map[string]interface{})
+    if !ok {
+        return messageList
+    }
+
+    for userID, messages := range users {
+        userNotify := make(map[string]interface{})
+        userNotify["module"] = "chat"
+        userNotify["method"] = "notify"
+        userNotify["data"] = messages
+        uid, _ := util.String2Int64(userID)
+        messageList[uid] = JsonUnparse(userNotify)
+    }
+
+    return messageList
+}
+
 func CheckUserChange(serverName string, lang string) ([]byte, error) {
     ranzhiServer, ok := RanzhiServer(serverName)
     if !ok {
@@ -391,9 +436,8 @@ func CheckUserChange(serverName string, lang string) ([]byte, error) {
     // 固定的json格式
     request := []byte(`{"module":"chat","method":"checkUserChange","lang":"`+ lang +`","params":[""]}`)
 
-    message, err := aesEncrypt(request, ranzhiServer.RanzhiToken)
+    message, err := BackendEncrypt(request, ranzhiServer)
     if err != nil {
-        util.LogError().Println("aes encrypt error:", err)
         return nil, err
     }
 
@@ -403,7 +447,7 @@ func CheckUserChange(serverName string, lang string) ([]byte, error) {
         util.LogError().Println("hyperttp request info error:", err)
         return nil, err
     }
-    decodeData, _ := ApiParse(retMessage, ranzhiServer.RanzhiToken)
+    decodeData, _ := ApiParse(retMessage, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto)
     if decodeData.Result() != "success" {
         util.LogError().Println("request info status:", decodeData.Result())
         return nil, err
@@ -419,24 +463,12 @@ func CheckUserChange(serverName string, lang string) ([]byte, error) {
 // 与客户端间的错误通知
 func RetErrorMsg(errCode, errMsg string) ([]byte, error) {
     errApi := `{"module":"chat","method":"error","code":` + errCode + `,"message":"` + errMsg + `"}`
-    message, err := aesEncrypt([]byte(errApi), util.Token)
-    if err != nil {
-        util.LogError().Println("aes encrypt error:", err)
-        return nil, err
-    }
-
-    return message, nil
+    return []byte(errApi), nil
 }
 
 // 获取然之服务器名称
 func RanzhiServer(serverName string) (util.RanzhiServer, bool) {
-    if serverName == "" {
-        info, ok := util.Config.RanzhiServer[util.Config.DefaultServer]
-        return info, ok
-    }
-
-    info, ok := util.Config.RanzhiServer[serverName]
-    return info, ok
+    return util.GetRanzhiServer(serverName)
 }
 
 //服务器名称
@@ -11,21 +11,43 @@ package api
 
 import (
     "encoding/json"
+    "strconv"
     "xxd/util"
 )
 
 type ParseData map[string]interface{}
 
 // 对通讯的api进行解析
-func ApiParse(message, token []byte) (ParseData, error) {
-    jsonData, err := aesDecrypt(message, token)
+func ApiParse(message, token []byte, crypto string) (ParseData, error) {
+    jsonData, err := Decrypt(message, token, crypto)
     if err != nil {
         util.LogError().Println("Warning: message data decrypt error:", err)
         return nil, err
     }
 
+    return JsonParse(jsonData)
+}
+
+// 对通讯的api进行加密
+func ApiUnparse(parseData ParseData, token []byte, crypto string) []byte {
+    jsonData := JsonUnparse(parseData)
+    if jsonData == nil {
+        return nil
+    }
+
+    message, err := Encrypt(jsonData, token, crypto)
+    if err != nil {
+        util.LogError().Println("Warning: message data encrypt error:", err)
+        return nil
+    }
+
+    return message
+}
+
+// 解析未加密的json数据，发送给客户端的消息在写入连接时才加密
+func JsonParse(jsonData []byte) (ParseData, error) {
     parseData := make(ParseData)
-    if err := json.Unmarshal([]byte(jsonData), &parseData); err != nil {
+    if err := json.Unmarshal(jsonData, &parseData); err != nil {
         util.LogError().Println("Warning: JSON unmarshal error:", err)
         return nil, err
     }
@@ -33,32 +55,31 @@ func ApiParse(message, token []byte) (ParseData, error) {
     return parseData, nil
 }
 
-// 对通讯的api进行加密
-func ApiUnparse(parseData ParseData, token []byte) []byte {
+// 转换为未加密的json数据
+func JsonUnparse(parseData ParseData) []byte {
     jsonData, err := json.Marshal(parseData)
     if err != nil {
         util.LogError().Println("json unmarshal error:", err)
         return nil
     }
 
-    message, err := aesEncrypt(jsonData, token)
-    if err != nil {
-        util.LogError().Println("Warning: message data encrypt error:", err)
-        return nil
-    }
-
-    return message
+    return jsonData
 }
 
-//交换token加密
-func SwapToken(message, fromToken, toToken []byte) ([]byte, error) {
-    jsonData, err := aesDecrypt(message, fromToken)
+// 解密后端服务器返回的数据，发送给客户端时再按客户端的协议加密
+func BackendDecrypt(message []byte, ranzhiServer util.RanzhiServer) ([]byte, error) {
+    jsonData, err := Decrypt(message, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto)
     if err != nil {
         util.LogError().Println("aes decrypt error:", err)
         return nil, err
     }
 
-    message, err = aesEncrypt(jsonData, toToken)
+    return jsonData, nil
+}
+
+// 按后端服务器的协议加密
+func BackendEncrypt(jsonData []byte, ranzhiServer util.RanzhiServer) ([]byte, error) {
+    message, err := Encrypt(jsonData, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto)
     if err != nil {
         util.LogError().Println("aes encrypt error:", err)
         return nil, err
@@ -87,6 +108,23 @@ func (pd ParseData) Method() string {
     return ret.(string)
 }
 
+//params中第i个参数，数字转换为字符串，不存在时返回空字符串
+func (pd ParseData) Param(i int) string {
+    params, ok := pd["params"].([]interface{})
+    if !ok || i >= len(params) {
+        return ""
+    }
+
+    switch value := params[i].(type) {
+    case string:
+        return value
+    case float64:
+        return strconv.FormatFloat(value, 'f', -1, 64)
+    }
+
+    return ""
+}
+
 //获取userID
 func (pd ParseData) UserID() int64 {
     ret, ok := pd["userID"]
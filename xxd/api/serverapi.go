@@ -10,7 +10,10 @@
 package api
 
 import (
+    "crypto/sha256"
+    "encoding/hex"
     "encoding/json"
+    "sync"
     "xxd/hyperttp"
     "xxd/util"
 )
@@ -23,20 +26,37 @@ func StartXXD() error {
         return nil
     }
 
-    startXXD := []byte(`{"module":"chat","method":"serverStart"}`)
-
-    for serverName, serverInfo := range util.Config.RanzhiServer {
-        message, err := aesEncrypt(startXXD, serverInfo.RanzhiToken)
-        if err != nil {
-            util.LogError().Printf("Warning: AES encrypt error:%s, ranzhi %s server login err", err, serverName)
+    for _, serverName := range util.GetRanzhiServerNames() {
+        if err := StartServer(serverName); err != nil {
             return err
         }
+    }
 
-        _, err = hyperttp.RequestInfo(serverInfo.RanzhiAddr, message)
-        if err != nil {
-            util.LogError().Printf("Warning: Start xxd to server [%s], login error: [%s]", serverName, err)
-            return err
-        }
+    return nil
+}
+
+// 通知单个后端服务器xxd已启动，重新加载配置后新增的服务器也通过该函数登录
+func StartServer(serverName string) error {
+    if util.IsTest {
+        return nil
+    }
+
+    serverInfo, ok := RanzhiServer(serverName)
+    if !ok {
+        return util.Errorf("Warning: The server %s node was not found. ", serverName)
+    }
+
+    startXXD := []byte(`{"module":"chat","method":"serverStart"}`)
+    message, err := BackendEncrypt(startXXD, serverInfo)
+    if err != nil {
+        util.LogError().Printf("Warning: AES encrypt error:%s, ranzhi %s server login err", err, serverName)
+        return err
+    }
+
+    _, err = hyperttp.RequestInfo(serverInfo.RanzhiAddr, message)
+    if err != nil {
+        util.LogError().Printf("Warning: Start xxd to server [%s], login error: [%s]", serverName, err)
+        return err
     }
 
     return nil
@@ -56,12 +76,12 @@ func VerifyLogin(body []byte) (bool, error) {
     }
 
     //util.Println(ranzhiServer)
-    r2xMessage, err := hyperttp.RequestInfo(ranzhiServer.RanzhiAddr, ApiUnparse(parseData, ranzhiServer.RanzhiToken))
+    r2xMessage, err := hyperttp.RequestInfo(ranzhiServer.RanzhiAddr, ApiUnparse(parseData, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto))
     if err != nil {
         return false, err
     }
 
-    parseData, err = ApiParse(r2xMessage, ranzhiServer.RanzhiToken)
+    parseData, err = ApiParse(r2xMessage, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto)
     if err != nil {
         return false, err
     }
@@ -69,6 +89,62 @@ func VerifyLogin(body []byte) (bool, error) {
     return parseData.Result() == "success", nil
 }
 
+// 推送消息中的时间与xxd的时间相差超过该秒数时拒绝，该时间内同样的请求体只能使用一次
+const pushMaxSkew = 300
+
+// 已处理过的推送请求体的sha256，防止重放
+var (
+    pushSeen   = make(map[string]int64)
+    pushSeenMu sync.Mutex
+)
+
+// 解析后端服务器推送的消息，消息使用该服务器的密钥和加密协议加密，
+// time 为推送时的unix时间戳
+func ParsePush(serverName string, message []byte) (ParseData, error) {
+    ranzhiServer, ok := RanzhiServer(serverName)
+    if !ok {
+        return nil, util.Errorf("backend server %s not found", serverName)
+    }
+
+    parseData, err := ApiParse(message, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto)
+    if err != nil {
+        return nil, err
+    }
+
+    pushTime, ok := parseData["time"].(float64)
+    if skew := util.GetUnixTime() - int64(pushTime); !ok || skew > pushMaxSkew || skew < -pushMaxSkew {
+        return nil, util.Errorf("push from %s rejected, time %v is out of range", serverName, parseData["time"])
+    }
+
+    if !firstPush(serverName, message) {
+        return nil, util.Errorf("push from %s rejected, the message was already received", serverName)
+    }
+
+    return parseData, nil
+}
+
+//记录推送的请求体，同一服务器的请求体在2*pushMaxSkew秒内出现过时返回false
+func firstPush(serverName string, message []byte) bool {
+    hash := sha256.Sum256(message)
+    key := serverName + "/" + hex.EncodeToString(hash[:])
+    now := util.GetUnixTime()
+
+    pushSeenMu.Lock()
+    defer pushSeenMu.Unlock()
+
+    for seen, at := range pushSeen {
+        if now-at > 2*pushMaxSkew {
+            delete(pushSeen, seen)
+        }
+    }
+
+    if _, ok := pushSeen[key]; ok {
+        return false
+    }
+    pushSeen[key] = now
+    return true
+}
+
 // 喧喧客户端上传文件时，与然之服务器进行数据交互
 func UploadFileInfo(serverName string, jsonData []byte) (string, error) {
     ranzhiServer, ok := RanzhiServer(serverName)
@@ -76,9 +152,8 @@ func UploadFileInfo(serverName string, jsonData []byte) (string, error) {
         return "", util.Errorf("Warning: server name not found")
     }
 
-    message, err := aesEncrypt(jsonData, ranzhiServer.RanzhiToken)
+    message, err := BackendEncrypt(jsonData, ranzhiServer)
     if err != nil {
-        util.LogError().Println("Warning: AES encrypt error:", err)
         return "", err
     }
 
@@ -87,7 +162,7 @@ func UploadFileInfo(serverName string, jsonData []byte) (string, error) {
         return "", err
     }
 
-    parseData, err := ApiParse(r2xMessage, ranzhiServer.RanzhiToken)
+    parseData, err := ApiParse(r2xMessage, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto)
     if err != nil {
         return "", err
     }
@@ -96,6 +171,79 @@ func UploadFileInfo(serverName string, jsonData []byte) (string, error) {
     return parseData.FileID(), nil
 }
 
+//通知后端服务器上传文件已被保留策略删除，后端服务器返回success后才能删除文件
+func PurgeFiles(serverName string, fileIDs, keys []string) error {
+    ranzhiServer, ok := RanzhiServer(serverName)
+    if !ok {
+        return util.Errorf("Warning: server name not found")
+    }
+
+    jsonData, err := json.Marshal(map[string]interface{}{
+        "module": "chat",
+        "method": "purgeFiles",
+        "params": []interface{}{fileIDs, keys},
+    })
+    if err != nil {
+        return err
+    }
+
+    message, err := BackendEncrypt(jsonData, ranzhiServer)
+    if err != nil {
+        return err
+    }
+
+    r2xMessage, err := hyperttp.RequestInfo(ranzhiServer.RanzhiAddr, message)
+    if err != nil {
+        return err
+    }
+
+    parseData, err := ApiParse(r2xMessage, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto)
+    if err != nil {
+        return err
+    }
+
+    if parseData.Result() != "success" {
+        return util.Errorf("server %s purge files result %s", serverName, parseData.Result())
+    }
+
+    return nil
+}
+
+//向后端服务器确认用户是会话gid的成员，并且文件fileID属于该会话
+func CheckFileAccess(serverName string, userID int64, gid, fileID string) (bool, error) {
+    ranzhiServer, ok := RanzhiServer(serverName)
+    if !ok {
+        return false, util.Errorf("Warning: server name not found")
+    }
+
+    jsonData, err := json.Marshal(map[string]interface{}{
+        "userID": userID,
+        "module": "chat",
+        "method": "checkFileAccess",
+        "params": []interface{}{gid, fileID},
+    })
+    if err != nil {
+        return false, err
+    }
+
+    message, err := BackendEncrypt(jsonData, ranzhiServer)
+    if err != nil {
+        return false, err
+    }
+
+    r2xMessage, err := hyperttp.RequestInfo(ranzhiServer.RanzhiAddr, message)
+    if err != nil {
+        return false, err
+    }
+
+    parseData, err := ApiParse(r2xMessage, ranzhiServer.RanzhiToken, ranzhiServer.RanzhiCrypto)
+    if err != nil {
+        return false, err
+    }
+
+    return parseData.Result() == "success", nil
+}
+
 //用户ID
 func (pd ParseData) loginUserID() int64 {
     data, ok := pd["data"]
@@ -0,0 +1,163 @@
+/**
+ * The sessionkey file of api current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     api
+ * @link        http://www.zentao.net
+ */
+package api
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "sync"
+    "time"
+    "xxd/util"
+)
+
+// 每个登录会话使用独立的密钥，serverInfo 签发，websocket 连接时通过 xxd-key-id 领取
+type sessionKey struct {
+    key      []byte
+    previous []byte    // 轮换前的密钥，上传文件时在下次轮换前仍然有效
+    expire   time.Time // 未领取的密钥过期时间
+    claimed  bool
+    server   string // 登录后绑定的后端服务器和用户，上传文件时只能以该用户的身份上传
+    userID   int64
+}
+
+var sessionKeyMu sync.Mutex
+var sessionKeys = make(map[string]*sessionKey)
+
+//签发新的会话密钥，需要在 SessionKeyTTL 秒内建立 websocket 连接
+func IssueSessionKey() (string, []byte, error) {
+    keyID, err := randomHex(16)
+    if err != nil {
+        return "", nil, err
+    }
+
+    key, err := newKey()
+    if err != nil {
+        return "", nil, err
+    }
+
+    sessionKeyMu.Lock()
+    defer sessionKeyMu.Unlock()
+
+    now := time.Now()
+    for id, entry := range sessionKeys {
+        if !entry.claimed && now.After(entry.expire) {
+            delete(sessionKeys, id)
+        }
+    }
+
+    sessionKeys[keyID] = &sessionKey{key: key, expire: now.Add(time.Duration(util.Config.SessionKeyTTL) * time.Second)}
+    return keyID, key, nil
+}
+
+//websocket 连接时领取会话密钥，每个密钥只能领取一次
+func ClaimSessionKey(keyID string) ([]byte, bool) {
+    sessionKeyMu.Lock()
+    defer sessionKeyMu.Unlock()
+
+    entry, ok := sessionKeys[keyID]
+    if !ok || entry.claimed {
+        return nil, false
+    }
+
+    if time.Now().After(entry.expire) {
+        delete(sessionKeys, keyID)
+        return nil, false
+    }
+
+    entry.claimed = true
+    return entry.key, true
+}
+
+//客户端登录成功后把会话密钥绑定到该用户
+func BindSessionKey(keyID, serverName string, userID int64) {
+    sessionKeyMu.Lock()
+    defer sessionKeyMu.Unlock()
+
+    if entry, ok := sessionKeys[keyID]; ok && entry.claimed {
+        entry.server = serverName
+        entry.userID = userID
+    }
+}
+
+//轮换会话密钥，返回新的密钥
+func RotateSessionKey(keyID string) ([]byte, error) {
+    key, err := newKey()
+    if err != nil {
+        return nil, err
+    }
+
+    sessionKeyMu.Lock()
+    defer sessionKeyMu.Unlock()
+
+    entry, ok := sessionKeys[keyID]
+    if !ok || !entry.claimed {
+        return nil, util.Errorf("session key %s not found", keyID)
+    }
+
+    entry.previous = entry.key
+    entry.key = key
+    return key, nil
+}
+
+//连接断开后释放会话密钥
+func ReleaseSessionKey(keyID string) {
+    sessionKeyMu.Lock()
+    defer sessionKeyMu.Unlock()
+
+    delete(sessionKeys, keyID)
+}
+
+//验证上传文件时使用的token，可以是已登录会话的密钥，只能用于该会话登录的用户；
+//或者允许时使用的全局token，全局token无法区分用户
+func VerifyToken(token []byte, serverName string, userID int64) bool {
+    if len(token) == 0 || userID <= 0 {
+        return false
+    }
+
+    if util.Config.LegacyToken && subtle.ConstantTimeCompare(token, util.Token) == 1 {
+        return true
+    }
+
+    sessionKeyMu.Lock()
+    defer sessionKeyMu.Unlock()
+
+    for _, entry := range sessionKeys {
+        if !entry.claimed || entry.server != serverName || entry.userID != userID {
+            continue
+        }
+
+        if subtle.ConstantTimeCompare(token, entry.key) == 1 || subtle.ConstantTimeCompare(token, entry.previous) == 1 {
+            return true
+        }
+    }
+
+    return false
+}
+
+//通知客户端使用新的会话密钥，用旧密钥加密发送
+func SessionKeyMessage(keyID string, key []byte) []byte {
+    return []byte(`{"module":"chat","method":"sessionKey","keyID":"` + keyID + `","key":"` + string(key) + `"}`)
+}
+
+//与 util.Token 格式相同，32 位十六进制字符串直接作为 AES-256 的密钥
+func newKey() ([]byte, error) {
+    key, err := randomHex(16)
+    return []byte(key), err
+}
+
+func randomHex(size int) (string, error) {
+    buf := make([]byte, size)
+    if _, err := rand.Read(buf); err != nil {
+        return "", err
+    }
+
+    return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+    "bytes"
+    "testing"
+    "xxd/util"
+)
+
+func TestSessionKeyLifecycle(t *testing.T) {
+    keyID, key, err := IssueSessionKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(key) != 32 || bytes.Equal(key, util.Token) {
+        t.Fatalf("bad session key %q", key)
+    }
+
+    if VerifyToken(key, "xuanxuan", 1) {
+        t.Error("unclaimed session key was accepted for upload")
+    }
+
+    claimed, ok := ClaimSessionKey(keyID)
+    if !ok || !bytes.Equal(claimed, key) {
+        t.Fatal("session key claim failed")
+    }
+
+    if _, ok := ClaimSessionKey(keyID); ok {
+        t.Error("session key was claimed twice")
+    }
+
+    if VerifyToken(key, "xuanxuan", 1) {
+        t.Error("session key was accepted before login")
+    }
+
+    // 登录后只能以该用户的身份上传
+    BindSessionKey(keyID, "xuanxuan", 1)
+    if !VerifyToken(key, "xuanxuan", 1) {
+        t.Error("claimed session key was rejected")
+    }
+    if VerifyToken(key, "xuanxuan", 2) || VerifyToken(key, "other", 1) {
+        t.Error("session key was accepted for another user")
+    }
+
+    rotated, err := RotateSessionKey(keyID)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if bytes.Equal(rotated, key) || !VerifyToken(rotated, "xuanxuan", 1) || !VerifyToken(key, "xuanxuan", 1) {
+        t.Error("rotated session key or previous key not accepted")
+    }
+
+    ReleaseSessionKey(keyID)
+    if VerifyToken(rotated, "xuanxuan", 1) {
+        t.Error("released session key was accepted")
+    }
+}
+
+func TestSessionKeyUnique(t *testing.T) {
+    _, first, _ := IssueSessionKey()
+    _, second, _ := IssueSessionKey()
+    if bytes.Equal(first, second) {
+        t.Error("two sessions got the same key")
+    }
+}
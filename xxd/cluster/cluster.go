@@ -0,0 +1,62 @@
+/**
+ * The cluster file of cluster current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     cluster
+ * @link        http://www.zentao.net
+ */
+package cluster
+
+import (
+    "net"
+    "xxd/util"
+)
+
+// 节点之间转发的消息类型
+const (
+    TypeBroadcast = "broadcast" // 发送给Server的所有在线用户
+    TypeMulticast = "multicast" // 发送给Users中在本节点在线的用户
+    TypeLogin     = "login"     // 用户在Node上用Device登录，其他节点上按登录策略挤掉同一用户的客户端
+    TypeLogout    = "logout"    // 用户在Node上的所有客户端都已断开
+    TypeKickoff   = "kickoff"   // 管理员强制下线，Payload为通知内容
+    TypePresence  = "presence"  // Node上的所有在线用户，Sync为true时收到的节点需要回复自己的在线用户
+    TypeJoin      = "join"      // 与Node建立了连接，由Bus生成
+    TypeLeave     = "leave"     // 与Node的连接全部断开，由Bus生成
+)
+
+type Message struct {
+    Type     string             `json:"type"`
+    Node     string             `json:"node"`
+    Server   string             `json:"server,omitempty"`
+    Users    []int64            `json:"users,omitempty"`
+    Time     int64              `json:"time,omitempty"`   // 登录时间，同时登录时保留较晚的一个
+    Device   string             `json:"device,omitempty"` // 登录的设备类型
+    Payload  []byte             `json:"payload,omitempty"`
+    Presence map[string][]int64 `json:"presence,omitempty"`
+    Sync     bool               `json:"sync,omitempty"`
+}
+
+// 节点之间的消息总线。Publish 发送给所有其他节点，不能阻塞；
+// 收到的消息和 join、leave 事件都交给 Start 传入的 handler，handler 可以阻塞。
+type Bus interface {
+    Node() string
+    Start(handler func(*Message)) error
+    Publish(msg *Message) error
+    Close() error
+}
+
+//根据配置创建消息总线，没有开启集群模式时返回nil
+func New() (Bus, error) {
+    if util.Config.ClusterListen == "" {
+        return nil, nil
+    }
+
+    listener, err := net.Listen("tcp", util.Config.ClusterListen)
+    if err != nil {
+        return nil, err
+    }
+
+    return NewTCPBus(util.Config.ClusterNode, util.Config.ClusterToken, listener, util.Config.ClusterPeers), nil
+}
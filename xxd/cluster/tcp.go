@@ -0,0 +1,407 @@
+/**
+ * The tcp file of cluster current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     cluster
+ * @link        http://www.zentao.net
+ */
+package cluster
+
+import (
+    "bufio"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/json"
+    "io"
+    "net"
+    "sync"
+    "time"
+    "xxd/metrics"
+    "xxd/util"
+)
+
+// 节点之间的 TCP 全连接。每个节点主动连接所有 peers 发送消息，接受其他节点的连接读取消息。
+// 接受连接的一方先发送随机的 challenge，之后每一帧都用 token 派生的密钥以 AES-GCM 加密，
+// challenge 和帧序号作为附加数据，防止重放。帧格式为 4 字节长度 + nonce + 密文。
+const (
+    typeHello = "hello"
+    typePing  = "ping"
+
+    peerPingPeriod = 10 * time.Second
+    peerReadWait   = 30 * time.Second
+    peerWriteWait  = 10 * time.Second
+    peerDialWait   = 5 * time.Second
+    peerRetryWait  = time.Second
+    peerRetryMax   = 30 * time.Second
+    peerQueueSize  = 1024
+
+    challengeSize = 16
+    maxFrameSize  = 16 << 20
+)
+
+var (
+    sentTotal     = metrics.NewCounter("xxd_cluster_sent_total", "Messages published to peer nodes.", "type")
+    receivedTotal = metrics.NewCounter("xxd_cluster_received_total", "Messages received from peer nodes.", "type")
+    droppedTotal  = metrics.NewCounter("xxd_cluster_dropped_total", "Messages dropped because the peer queue was full.", "peer")
+)
+
+type tcpBus struct {
+    node     string
+    aead     cipher.AEAD
+    listener net.Listener
+    peers    []*tcpPeer
+    handler  func(*Message)
+
+    mu      sync.Mutex
+    conns   map[net.Conn]bool // 所有连接，关闭时断开
+    nodes   map[string]int    // 每个节点接受的连接数
+
+    closed    chan struct{}
+    closeOnce sync.Once
+    wg        sync.WaitGroup
+}
+
+type tcpPeer struct {
+    addr  string
+    queue chan []byte // 未加密的消息
+}
+
+//创建TCP消息总线，listener接受其他节点的连接，peers为其他节点的地址
+func NewTCPBus(node, token string, listener net.Listener, peers []string) Bus {
+    key := sha256.Sum256([]byte(token))
+    block, _ := aes.NewCipher(key[:])
+    aead, _ := cipher.NewGCM(block)
+
+    bus := &tcpBus{
+        node:     node,
+        aead:     aead,
+        listener: listener,
+        conns:    make(map[net.Conn]bool),
+        nodes:    make(map[string]int),
+        closed:   make(chan struct{}),
+    }
+
+    for _, addr := range peers {
+        bus.peers = append(bus.peers, &tcpPeer{addr: addr, queue: make(chan []byte, peerQueueSize)})
+    }
+
+    return bus
+}
+
+func (b *tcpBus) Node() string {
+    return b.node
+}
+
+func (b *tcpBus) Start(handler func(*Message)) error {
+    b.handler = handler
+
+    b.wg.Add(1)
+    go b.accept()
+
+    for _, peer := range b.peers {
+        b.wg.Add(1)
+        go b.dial(peer)
+    }
+
+    util.LogInfo().Printf("cluster node %s listen %s, peers %d\n", b.node, b.listener.Addr(), len(b.peers))
+    return nil
+}
+
+//发送给所有节点，队列已满时丢弃
+func (b *tcpBus) Publish(msg *Message) error {
+    msg.Node = b.node
+    data, err := json.Marshal(msg)
+    if err != nil {
+        return err
+    }
+
+    sentTotal.Inc(msg.Type)
+    for _, peer := range b.peers {
+        select {
+        case peer.queue <- data:
+        default:
+            droppedTotal.Inc(peer.addr)
+        }
+    }
+
+    return nil
+}
+
+func (b *tcpBus) Close() error {
+    var err error
+    b.closeOnce.Do(func() {
+        close(b.closed)
+        err = b.listener.Close()
+
+        b.mu.Lock()
+        for conn := range b.conns {
+            conn.Close()
+        }
+        b.mu.Unlock()
+
+        b.wg.Wait()
+    })
+
+    return err
+}
+
+//记录连接，总线已关闭时断开连接并返回false
+func (b *tcpBus) track(conn net.Conn) bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.isClosed() {
+        conn.Close()
+        return false
+    }
+
+    b.conns[conn] = true
+    return true
+}
+
+func (b *tcpBus) untrack(conn net.Conn) {
+    conn.Close()
+
+    b.mu.Lock()
+    delete(b.conns, conn)
+    b.mu.Unlock()
+}
+
+func (b *tcpBus) isClosed() bool {
+    select {
+    case <-b.closed:
+        return true
+    default:
+        return false
+    }
+}
+
+//连接到其他节点并发送消息，断开后逐渐延长间隔重连
+func (b *tcpBus) dial(peer *tcpPeer) {
+    defer b.wg.Done()
+
+    retryWait := peerRetryWait
+    for {
+        conn, err := net.DialTimeout("tcp", peer.addr, peerDialWait)
+        if err == nil && b.track(conn) {
+            retryWait = peerRetryWait
+            err = b.writePeer(peer, conn)
+            b.untrack(conn)
+        }
+
+        if b.isClosed() {
+            return
+        }
+        util.LogError().Printf("cluster peer %s error: %v, retry in %s\n", peer.addr, err, retryWait)
+
+        select {
+        case <-b.closed:
+            return
+        case <-time.After(retryWait):
+        }
+
+        if retryWait *= 2; retryWait > peerRetryMax {
+            retryWait = peerRetryMax
+        }
+    }
+}
+
+func (b *tcpBus) writePeer(peer *tcpPeer, conn net.Conn) error {
+    conn.SetReadDeadline(time.Now().Add(peerDialWait))
+    challenge := make([]byte, challengeSize)
+    if _, err := io.ReadFull(conn, challenge); err != nil {
+        return err
+    }
+
+    var seq uint64
+    write := func(data []byte) error {
+        conn.SetWriteDeadline(time.Now().Add(peerWriteWait))
+        err := writeFrame(conn, b.seal(data, challenge, seq))
+        seq++
+        return err
+    }
+
+    hello, _ := json.Marshal(&Message{Type: typeHello, Node: b.node})
+    if err := write(hello); err != nil {
+        return err
+    }
+
+    ping, _ := json.Marshal(&Message{Type: typePing})
+    ticker := time.NewTicker(peerPingPeriod)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case data := <-peer.queue:
+            if err := write(data); err != nil {
+                return err
+            }
+        case <-ticker.C:
+            if err := write(ping); err != nil {
+                return err
+            }
+        case <-b.closed:
+            return nil
+        }
+    }
+}
+
+func (b *tcpBus) accept() {
+    defer b.wg.Done()
+
+    for {
+        conn, err := b.listener.Accept()
+        if err != nil {
+            if b.isClosed() {
+                return
+            }
+            util.LogError().Println("cluster accept error:", err)
+            time.Sleep(peerRetryWait)
+            continue
+        }
+
+        if !b.track(conn) {
+            return
+        }
+
+        b.wg.Add(1)
+        go b.readPeer(conn)
+    }
+}
+
+//读取其他节点发来的消息，第一帧必须是hello
+func (b *tcpBus) readPeer(conn net.Conn) {
+    defer func() {
+        b.untrack(conn)
+        b.wg.Done()
+    }()
+
+    challenge := make([]byte, challengeSize)
+    if _, err := rand.Read(challenge); err != nil {
+        return
+    }
+
+    conn.SetWriteDeadline(time.Now().Add(peerWriteWait))
+    if _, err := conn.Write(challenge); err != nil {
+        return
+    }
+
+    reader := bufio.NewReader(conn)
+    var seq uint64
+    read := func() (*Message, error) {
+        conn.SetReadDeadline(time.Now().Add(peerReadWait))
+        frame, err := readFrame(reader)
+        if err != nil {
+            return nil, err
+        }
+
+        data, err := b.open(frame, challenge, seq)
+        if err != nil {
+            return nil, err
+        }
+        seq++
+
+        msg := &Message{}
+        return msg, json.Unmarshal(data, msg)
+    }
+
+    hello, err := read()
+    if err != nil || hello.Type != typeHello || hello.Node == "" || hello.Node == b.node {
+        util.LogError().Println("cluster peer rejected:", conn.RemoteAddr(), err)
+        return
+    }
+
+    node := hello.Node
+    b.mu.Lock()
+    b.nodes[node]++
+    b.mu.Unlock()
+    b.handler(&Message{Type: TypeJoin, Node: node})
+    util.LogInfo().Println("cluster node joined:", node, conn.RemoteAddr())
+
+    defer func() {
+        b.mu.Lock()
+        b.nodes[node]--
+        last := b.nodes[node] == 0
+        if last {
+            delete(b.nodes, node)
+        }
+        b.mu.Unlock()
+
+        if last {
+            util.LogInfo().Println("cluster node left:", node)
+            b.handler(&Message{Type: TypeLeave, Node: node})
+        }
+    }()
+
+    for {
+        msg, err := read()
+        if err != nil {
+            if !b.isClosed() {
+                util.LogError().Printf("cluster node %s read error: %v\n", node, err)
+            }
+            return
+        }
+
+        if msg.Type == typePing {
+            continue
+        }
+
+        // 以连接时验证过的节点名称为准
+        msg.Node = node
+        receivedTotal.Inc(msg.Type)
+        b.handler(msg)
+    }
+}
+
+func (b *tcpBus) seal(data, challenge []byte, seq uint64) []byte {
+    nonce := make([]byte, b.aead.NonceSize())
+    rand.Read(nonce)
+
+    return b.aead.Seal(nonce, nonce, data, additionalData(challenge, seq))
+}
+
+func (b *tcpBus) open(frame, challenge []byte, seq uint64) ([]byte, error) {
+    nonceSize := b.aead.NonceSize()
+    if len(frame) < nonceSize+b.aead.Overhead() {
+        return nil, util.Errorf("cluster frame too short")
+    }
+
+    return b.aead.Open(nil, frame[:nonceSize], frame[nonceSize:], additionalData(challenge, seq))
+}
+
+func additionalData(challenge []byte, seq uint64) []byte {
+    data := make([]byte, len(challenge)+8)
+    copy(data, challenge)
+    binary.BigEndian.PutUint64(data[len(challenge):], seq)
+    return data
+}
+
+func writeFrame(w io.Writer, frame []byte) error {
+    buf := make([]byte, 4+len(frame))
+    binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+    copy(buf[4:], frame)
+
+    _, err := w.Write(buf)
+    return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+    var size [4]byte
+    if _, err := io.ReadFull(r, size[:]); err != nil {
+        return nil, err
+    }
+
+    length := binary.BigEndian.Uint32(size[:])
+    if length > maxFrameSize {
+        return nil, util.Errorf("cluster frame too large: %d", length)
+    }
+
+    frame := make([]byte, length)
+    _, err := io.ReadFull(r, frame)
+    return frame, err
+}
@@ -0,0 +1,131 @@
+package cluster
+
+import (
+    "net"
+    "testing"
+    "time"
+)
+
+// go test xxd/cluster
+
+type testNode struct {
+    bus      Bus
+    messages chan *Message
+}
+
+func startTestNodes(t *testing.T, tokens ...string) []*testNode {
+    listeners := make([]net.Listener, len(tokens))
+    for i := range listeners {
+        listener, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        listeners[i] = listener
+    }
+
+    nodes := make([]*testNode, len(tokens))
+    for i, listener := range listeners {
+        var peers []string
+        for j, peer := range listeners {
+            if j != i {
+                peers = append(peers, peer.Addr().String())
+            }
+        }
+
+        node := &testNode{bus: NewTCPBus(listener.Addr().String(), tokens[i], listener, peers), messages: make(chan *Message, 100)}
+        node.bus.Start(func(msg *Message) { node.messages <- msg })
+        nodes[i] = node
+    }
+
+    t.Cleanup(func() {
+        for _, node := range nodes {
+            node.bus.Close()
+        }
+    })
+
+    return nodes
+}
+
+//等待指定类型的消息，忽略其他消息
+func (n *testNode) wait(t *testing.T, msgType string) *Message {
+    timeout := time.After(5 * time.Second)
+    for {
+        select {
+        case msg := <-n.messages:
+            if msg.Type == msgType {
+                return msg
+            }
+        case <-timeout:
+            t.Fatalf("node %s did not receive %s", n.bus.Node(), msgType)
+            return nil
+        }
+    }
+}
+
+func TestTCPBusPublish(t *testing.T) {
+    nodes := startTestNodes(t, "secret", "secret", "secret")
+
+    for _, node := range nodes {
+        node.wait(t, TypeJoin)
+        node.wait(t, TypeJoin)
+    }
+
+    nodes[0].bus.Publish(&Message{Type: TypeMulticast, Server: "xuanxuan", Users: []int64{1, 2}, Payload: []byte(`{"module":"chat"}`)})
+
+    for _, node := range nodes[1:] {
+        msg := node.wait(t, TypeMulticast)
+        if msg.Node != nodes[0].bus.Node() || msg.Server != "xuanxuan" || len(msg.Users) != 2 || string(msg.Payload) != `{"module":"chat"}` {
+            t.Errorf("node %s got %+v", node.bus.Node(), msg)
+        }
+    }
+
+    select {
+    case msg := <-nodes[0].messages:
+        t.Errorf("publisher received its own message %+v", msg)
+    case <-time.After(100 * time.Millisecond):
+    }
+}
+
+func TestTCPBusLeave(t *testing.T) {
+    nodes := startTestNodes(t, "secret", "secret")
+    nodes[0].wait(t, TypeJoin)
+
+    nodes[1].bus.Close()
+    if msg := nodes[0].wait(t, TypeLeave); msg.Node != nodes[1].bus.Node() {
+        t.Errorf("leave from %s, want %s", msg.Node, nodes[1].bus.Node())
+    }
+}
+
+func TestTCPBusRejectsWrongToken(t *testing.T) {
+    nodes := startTestNodes(t, "secret", "wrong")
+
+    nodes[1].bus.Publish(&Message{Type: TypeBroadcast, Server: "xuanxuan"})
+
+    timeout := time.After(500 * time.Millisecond)
+    for {
+        select {
+        case msg := <-nodes[0].messages:
+            t.Fatalf("node with the right token received %+v", msg)
+        case <-timeout:
+            return
+        }
+    }
+}
+
+func TestFrameReplay(t *testing.T) {
+    bus := NewTCPBus("a", "secret", nil, nil).(*tcpBus)
+    challenge := []byte("0123456789abcdef")
+
+    frame := bus.seal([]byte(`{"type":"kickoff"}`), challenge, 0)
+    if _, err := bus.open(frame, challenge, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := bus.open(frame, challenge, 1); err == nil {
+        t.Error("frame was accepted with another sequence number")
+    }
+
+    if _, err := bus.open(frame, []byte("fedcba9876543210"), 0); err == nil {
+        t.Error("frame was accepted on another connection")
+    }
+}
@@ -11,21 +11,32 @@ package crontask
 
 import (
     "time"
+    "xxd/hyperttp/server"
     "xxd/util"
 )
 
 const (
     // check and create log 30 second
     checkLog = 30 * time.Second
+
+    // 每天执行一次上传文件保留策略
+    checkRetention = 24 * time.Hour
+
+    // 每小时删除过期的文件会话
+    checkSession = time.Hour
 )
 
 //定时任务
 func CronTask() {
     go func() {
         logTicker := time.NewTicker(checkLog)
+        retentionTicker := time.NewTicker(checkRetention)
+        sessionTicker := time.NewTicker(checkSession)
 
         defer func() {
             logTicker.Stop()
+            retentionTicker.Stop()
+            sessionTicker.Stop()
         }()
 
         for util.Run {
@@ -33,6 +44,14 @@ func CronTask() {
             case <-logTicker.C:
                 // 定时处理log日志
                 util.CheckLog()
+
+            case <-retentionTicker.C:
+                if util.Config.Retention != util.RetentionOff {
+                    server.RunRetention(util.Config.Retention == util.RetentionDryRun)
+                }
+
+            case <-sessionTicker.C:
+                util.ExpireUids()
             }
         }
     }()
@@ -0,0 +1,94 @@
+/**
+ * The breaker file of hyperttp current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     hyperttp
+ * @link        http://www.zentao.net
+ */
+package hyperttp
+
+import (
+    "sync"
+    "time"
+)
+
+// 连续失败 breakerThreshold 次后断开，breakerCooldown 后放行一个请求试探，
+// 试探成功则恢复，失败则再次断开。
+var (
+    breakerThreshold = 5
+    breakerCooldown  = 30 * time.Second
+)
+
+const (
+    breakerClosed = iota
+    breakerOpen
+    breakerHalfOpen
+)
+
+type breaker struct {
+    mu       sync.Mutex
+    state    int
+    failures int
+    openedAt time.Time
+}
+
+//是否允许发送请求，半开状态只允许一个试探请求
+func (b *breaker) allow() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    switch b.state {
+    case breakerOpen:
+        if time.Since(b.openedAt) < breakerCooldown {
+            return false
+        }
+        b.state = breakerHalfOpen
+        return true
+    case breakerHalfOpen:
+        return false
+    }
+
+    return true
+}
+
+func (b *breaker) success() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    b.state = breakerClosed
+    b.failures = 0
+}
+
+//记录一次失败，返回是否因此断开
+func (b *breaker) failure() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    b.failures++
+    if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= breakerThreshold) {
+        b.state = breakerOpen
+        b.openedAt = time.Now()
+        return true
+    }
+
+    return false
+}
+
+//试探请求被调用者取消，没有结果，下一个请求重新试探
+func (b *breaker) cancel() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.state == breakerHalfOpen {
+        b.state = breakerOpen
+    }
+}
+
+func (b *breaker) isOpen() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    return b.state != breakerClosed
+}
@@ -0,0 +1,35 @@
+package hyperttp_test
+
+import (
+    "os"
+    "testing"
+    "xxd/api"
+    "xxd/hyperttp"
+)
+
+// go test -v hyperttp*
+// 需要运行中的xxb，设置 XXD_TEST_XXB 为xxb的地址，例如 http://127.0.0.1/xxb/xuanxuan.php
+// api 包依赖 hyperttp，所以放在外部测试包中
+
+// 解密成功后，内容是{module:  'null',method:  'null',message: 'This account logined in another place.'}
+// User-Agent:[easysoft-xxdClient/0.1]
+// Content-Length:[96]
+// Content-Type:[application/x-www-form-urlencoded]
+// Accept-Encoding:[gzip]
+func TestClient(t *testing.T) {
+    addr := os.Getenv("XXD_TEST_XXB")
+    if addr == "" {
+        t.Skip("XXD_TEST_XXB is not set")
+    }
+    //postData := []byte("123456789")
+
+    postData := api.RepeatLogin()
+    body, err := hyperttp.RequestInfo(addr, postData)
+    if err != nil {
+        t.Error(err)
+    }
+
+    t.Log("----------------")
+    //t.Error(string(body), postData)
+    t.Log(string(body), postData)
+}
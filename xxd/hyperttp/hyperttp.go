@@ -11,85 +11,234 @@ package hyperttp
 
 import (
     "bytes"
+    "context"
     "crypto/tls"
+    "io"
     "io/ioutil"
+    "math/rand"
+    "net"
     "net/http"
+    "reflect"
+    "sync"
+    "time"
+    "xxd/metrics"
     "xxd/util"
 )
 
-const https = "https:"
 const requestCount = 3
 
-// http 请求
+// 重试前等待 retryBase * 2^n 以内的随机时间，最多 retryMax
+var (
+    retryBase = 100 * time.Millisecond
+    retryMax  = 2 * time.Second
+)
+
+var ErrCircuitOpen = util.Errorf("%s", "backend is unavailable, request rejected by circuit breaker")
+
+var (
+    requestDuration = metrics.NewHistogram("xxd_backend_request_duration_seconds", "Time spent on requests to the backend, retries included.", metrics.DefBuckets, "addr")
+    requestRetries  = metrics.NewCounter("xxd_backend_request_retries_total", "Requests to the backend that were retried.", "addr")
+    requestFailures = metrics.NewCounter("xxd_backend_request_failures_total", "Requests to the backend that failed after all retries.", "addr")
+    requestRejected = metrics.NewCounter("xxd_backend_request_rejected_total", "Requests to the backend rejected while its circuit breaker was open.", "addr")
+    _               = metrics.NewGaugeFunc("xxd_backend_circuit_open", "Whether the circuit breaker of the backend is open.", []string{"addr"}, circuitSamples)
+)
+
+// 每个后端服务器地址共用一个连接池和熔断器
+type backend struct {
+    client  *http.Client
+    breaker *breaker
+    tls     util.BackendTLS
+}
+
+var (
+    backends   = make(map[string]*backend)
+    backendsMu sync.Mutex
+)
+
+//获取后端服务器的连接池，证书设置重新加载后重建连接池，熔断器保持不变
+func getBackend(addr string) (*backend, error) {
+    settings := util.GetBackendTLS(addr)
+
+    backendsMu.Lock()
+    defer backendsMu.Unlock()
+
+    b, ok := backends[addr]
+    if ok && reflect.DeepEqual(b.tls, settings) {
+        return b, nil
+    }
+
+    tlsConfig, err := settings.ClientConfig()
+    if err != nil {
+        return nil, err
+    }
+
+    cb := &breaker{}
+    if ok {
+        cb = b.breaker
+        b.client.CloseIdleConnections()
+    }
+
+    b = &backend{client: &http.Client{Transport: newTransport(tlsConfig)}, breaker: cb, tls: settings}
+    backends[addr] = b
+    return b, nil
+}
+
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+    return &http.Transport{
+        Proxy: http.ProxyFromEnvironment,
+        DialContext: (&net.Dialer{
+            Timeout:   5 * time.Second,
+            KeepAlive: 30 * time.Second,
+        }).DialContext,
+        MaxIdleConnsPerHost: 32,
+        IdleConnTimeout:     90 * time.Second,
+        TLSHandshakeTimeout: 5 * time.Second,
+        TLSClientConfig:     tlsConfig,
+    }
+}
+
+func circuitSamples() []metrics.Sample {
+    backendsMu.Lock()
+    defer backendsMu.Unlock()
+
+    var samples []metrics.Sample
+    for addr, b := range backends {
+        value := 0.0
+        if b.breaker.isOpen() {
+            value = 1
+        }
+        samples = append(samples, metrics.Sample{Labels: []string{addr}, Value: value})
+    }
+
+    return samples
+}
+
+// http 请求，超时时间为配置的 backendTimeout
 func RequestInfo(addr string, postData []byte) ([]byte, error) {
+    ctx := context.Background()
+    if util.Config.BackendTimeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, time.Duration(util.Config.BackendTimeout)*time.Second)
+        defer cancel()
+    }
+
+    return Request(ctx, addr, postData)
+}
+
+// http 请求，ctx 结束时停止请求和重试
+func Request(ctx context.Context, addr string, postData []byte) ([]byte, error) {
     if postData == nil || addr == "" {
         return nil, util.Errorf("%s", "post data or addr is null")
     }
 
-    // 根据配置文件的不同创建 http 或者 https 的客户端
-    var client *http.Client
-    if addr[:6] != https {
-        client = httpRequest()
-    } else {
-        client = httpsRequest()
+    backend, err := getBackend(addr)
+    if err != nil {
+        util.LogError().Printf("backend [%s] tls config error:%v", addr, err)
+        return nil, err
     }
 
-    var i int = 0
-    var resp *http.Response
+    if !backend.breaker.allow() {
+        requestRejected.Inc(addr)
+        return nil, ErrCircuitOpen
+    }
 
-    // 请求然之失败时，再进行三次尝试。
-    for i = 0; i < requestCount; i++ {
-        req, err := http.NewRequest("POST", addr, bytes.NewReader(postData))
-        if err != nil {
-            util.LogError().Printf("http new request error, addr [%s] error:%v", addr, err)
+    start := time.Now()
+    defer func() {
+        requestDuration.Observe(time.Since(start).Seconds(), addr)
+    }()
+
+    var body []byte
+    var retry bool
+    for i := 0; i < requestCount; i++ {
+        if i > 0 {
+            requestRetries.Inc(addr)
+            if err = sleep(ctx, backoff(i)); err != nil {
+                break
+            }
         }
 
-        req.Header.Set("Content-type", "application/x-www-form-urlencoded")
-        req.Header.Set("User-Agent", "easysoft/xuan.im")
-        req.Header.Set("xxd-version", util.Version)
-        resp, err = client.Do(req)
-        if err != nil {
-            util.LogError().Printf("request addr [%s] error:%v", addr, err)
-
-            util.SleepMillisecond(200)
-            continue
+        body, retry, err = post(ctx, backend.client, addr, postData)
+        if err == nil {
+            backend.breaker.success()
+            return body, nil
         }
 
-        // StatusOK == 200
-        if resp.StatusCode == http.StatusOK {
+        util.LogError().Printf("request addr [%s] error:%v", addr, err)
+        if !retry || ctx.Err() != nil {
             break
         }
+    }
 
-        util.LogError().Printf(" request status code:%v", resp.StatusCode)
-        util.SleepMillisecond(200)
+    requestFailures.Inc(addr)
+    switch {
+    case ctx.Err() == context.Canceled:
+        // 调用者取消，与后端服务器是否正常无关
+        backend.breaker.cancel()
+    case retry || ctx.Err() == context.DeadlineExceeded:
+        if backend.breaker.failure() {
+            util.LogError().Printf("backend [%s] circuit breaker open for %v", addr, breakerCooldown)
+        }
+    default:
+        // 后端服务器有响应，只是拒绝了请求
+        backend.breaker.success()
     }
 
-    if i >= requestCount {
-        return nil, util.Errorf("%s", "http request error, request count > 3")
+    return nil, err
+}
+
+//发送一次请求，返回失败时是否可以重试
+func post(ctx context.Context, client *http.Client, addr string, postData []byte) ([]byte, bool, error) {
+    req, err := http.NewRequest("POST", addr, bytes.NewReader(postData))
+    if err != nil {
+        return nil, false, err
     }
 
+    req = req.WithContext(ctx)
+    req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+    req.Header.Set("User-Agent", "easysoft/xuan.im")
+    req.Header.Set("xxd-version", util.Version)
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, true, err
+    }
     defer resp.Body.Close()
 
+    // StatusOK == 200
+    if resp.StatusCode != http.StatusOK {
+        // 读完响应才能复用连接
+        io.Copy(ioutil.Discard, resp.Body)
+        retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+        return nil, retry, util.Errorf("request status code:%v", resp.StatusCode)
+    }
+
     body, err := ioutil.ReadAll(resp.Body)
     if err != nil {
-        util.LogError().Println("request body read error:", err)
-        return nil, err
+        return nil, true, err
     }
 
     // 返回然之服务器的数据
-    return body, nil
+    return body, false, nil
 }
 
-//http
-func httpRequest() *http.Client {
-    return &http.Client{}
+//第 n 次重试前等待的时间
+func backoff(n int) time.Duration {
+    max := retryBase << uint(n-1)
+    if max > retryMax || max <= 0 {
+        max = retryMax
+    }
+
+    return time.Duration(rand.Int63n(int64(max)) + 1)
 }
 
-//https
-func httpsRequest() *http.Client {
-    tr := &http.Transport{
-        TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-    }
+func sleep(ctx context.Context, d time.Duration) error {
+    timer := time.NewTimer(d)
+    defer timer.Stop()
 
-    return &http.Client{Transport: tr}
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
 }
@@ -1,28 +1,328 @@
 package hyperttp
 
 import (
+    "context"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/base64"
+    "encoding/pem"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
     "testing"
-    "xxd/api"
+    "time"
+    "xxd/util"
 )
 
-// go test -v hyperttp*
+func init() {
+    retryBase = time.Millisecond
+    retryMax = 10 * time.Millisecond
+}
+
+func testBreakerOpen(t *testing.T, addr string) bool {
+    backend, err := getBackend(addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return backend.breaker.isOpen()
+}
+
+// 返回前 failures 个请求以 status 失败的后端服务器
+func newTestBackend(t *testing.T, failures int32, status int) (*httptest.Server, *int32) {
+    var hits int32
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if atomic.AddInt32(&hits, 1) <= failures {
+            w.WriteHeader(status)
+            return
+        }
+        w.Write([]byte("ok"))
+    }))
+    t.Cleanup(server.Close)
+
+    return server, &hits
+}
+
+func TestRequestRetry(t *testing.T) {
+    server, hits := newTestBackend(t, 2, http.StatusBadGateway)
+
+    body, err := RequestInfo(server.URL, []byte("data"))
+    if err != nil || string(body) != "ok" {
+        t.Fatalf("request returned %q, %v", body, err)
+    }
+    if *hits != 3 {
+        t.Errorf("backend got %d requests, want 3", *hits)
+    }
+}
+
+func TestRequestNoRetryOnClientError(t *testing.T) {
+    server, hits := newTestBackend(t, 1, http.StatusNotFound)
+
+    if _, err := RequestInfo(server.URL, []byte("data")); err == nil {
+        t.Fatal("404 was not an error")
+    }
+    if *hits != 1 {
+        t.Errorf("404 was retried, backend got %d requests", *hits)
+    }
+    if testBreakerOpen(t, server.URL) {
+        t.Error("404 opened the circuit breaker")
+    }
+}
+
+func TestRequestBadAddr(t *testing.T) {
+    if _, err := RequestInfo("http://[::1", []byte("data")); err == nil {
+        t.Error("bad addr was not an error")
+    }
+}
 
-// 解密成功后，内容是{module:  'null',method:  'null',message: 'This account logined in another place.'}
-// User-Agent:[easysoft-xxdClient/0.1]
-// Content-Length:[96]
-// Content-Type:[application/x-www-form-urlencoded]
-// Accept-Encoding:[gzip]
-func TestClient(t *testing.T) {
-    addr := "http://127.0.0.1/xxb/xuanxuan.php"
-    //postData := []byte("123456789")
+func TestRequestDeadline(t *testing.T) {
+    release := make(chan struct{})
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        <-release
+    }))
+    defer server.Close()
+    defer close(release)
 
-    postData := api.RepeatLogin()
-    body, err := RequestInfo(addr, postData)
+    ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+    defer cancel()
+
+    start := time.Now()
+    if _, err := Request(ctx, server.URL, []byte("data")); err == nil {
+        t.Fatal("slow backend did not time out")
+    }
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Errorf("request took %v after the deadline", elapsed)
+    }
+}
+
+func TestRequestKeepAlive(t *testing.T) {
+    var conns int32
+    server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("ok"))
+    }))
+    server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+        if state == http.StateNew {
+            atomic.AddInt32(&conns, 1)
+        }
+    }
+    server.Start()
+    defer server.Close()
+
+    for i := 0; i < 5; i++ {
+        if _, err := RequestInfo(server.URL, []byte("data")); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    if n := atomic.LoadInt32(&conns); n != 1 {
+        t.Errorf("%d connections for 5 sequential requests, want 1", n)
+    }
+}
+
+func TestCircuitBreaker(t *testing.T) {
+    defer func(threshold int, cooldown time.Duration) {
+        breakerThreshold, breakerCooldown = threshold, cooldown
+    }(breakerThreshold, breakerCooldown)
+    breakerThreshold, breakerCooldown = 2, 200*time.Millisecond
+
+    // 前两次请求(每次重试三遍)失败，之后恢复
+    server, hits := newTestBackend(t, 2*requestCount, http.StatusServiceUnavailable)
+
+    for i := 0; i < 2; i++ {
+        if _, err := RequestInfo(server.URL, []byte("data")); err == nil || err == ErrCircuitOpen {
+            t.Fatalf("request %d returned %v", i, err)
+        }
+    }
+
+    before := atomic.LoadInt32(hits)
+    if _, err := RequestInfo(server.URL, []byte("data")); err != ErrCircuitOpen {
+        t.Fatalf("open circuit returned %v", err)
+    }
+    if atomic.LoadInt32(hits) != before {
+        t.Error("open circuit still called the backend")
+    }
+
+    time.Sleep(breakerCooldown)
+    if body, err := RequestInfo(server.URL, []byte("data")); err != nil || string(body) != "ok" {
+        t.Fatalf("trial request returned %q, %v", body, err)
+    }
+    if testBreakerOpen(t, server.URL) {
+        t.Error("circuit breaker did not close after a successful trial")
+    }
+}
+
+// 把后端服务器的证书设置写入配置
+func setTestTLS(t *testing.T, addr string, settings util.BackendTLS) {
+    old, oldDefault := util.Config.RanzhiServer, util.GetDefaultServer()
+    util.SetRanzhi(map[string]util.RanzhiServer{"test": {RanzhiAddr: addr, RanzhiTLS: settings}}, "test")
+    t.Cleanup(func() { util.SetRanzhi(old, oldDefault) })
+}
+
+func writePEM(t *testing.T, blockType string, data []byte) string {
+    file, err := ioutil.TempFile(t.TempDir(), "*.pem")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+
+    pem.Encode(file, &pem.Block{Type: blockType, Bytes: data})
+    return file.Name()
+}
+
+// 生成自签名的证书，可以用作127.0.0.1的服务器证书或客户端证书，返回证书和私钥文件
+func newTestCert(t *testing.T, commonName string) (*x509.Certificate, string, string) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    template := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: commonName},
+        IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert, _ := x509.ParseCertificate(der)
+
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return cert, writePEM(t, "CERTIFICATE", der), writePEM(t, "EC PRIVATE KEY", keyDER)
+}
+
+func TestRequestTLS(t *testing.T) {
+    server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("ok"))
+    }))
+    defer server.Close()
+
+    ca := writePEM(t, "CERTIFICATE", server.Certificate().Raw)
+    spki := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+    pin := base64.StdEncoding.EncodeToString(spki[:])
+    otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+    tests := []struct {
+        name     string
+        settings util.BackendTLS
+        ok       bool
+    }{
+        {"unknown authority", util.DefaultBackendTLS, false},
+        {"ca bundle", util.BackendTLS{Verify: true, CA: ca}, true},
+        {"verify off", util.BackendTLS{Verify: false}, true},
+        {"pin", util.BackendTLS{Verify: true, CA: ca, Pins: []string{otherPin, pin}}, true},
+        {"pin mismatch", util.BackendTLS{Verify: true, CA: ca, Pins: []string{otherPin}}, false},
+        {"pin mismatch without verify", util.BackendTLS{Verify: false, Pins: []string{otherPin}}, false},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            setTestTLS(t, server.URL, test.settings)
+            ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+            defer cancel()
+
+            body, err := Request(ctx, server.URL, []byte("data"))
+            if test.ok && (err != nil || string(body) != "ok") {
+                t.Errorf("request returned %q, %v", body, err)
+            }
+            if !test.ok && err == nil {
+                t.Error("request succeeded")
+            }
+        })
+    }
+}
+
+// 服务器证书不匹配时，在证书链后面附加一个匹配的证书不能通过检查
+func TestRequestTLSExtraPinnedCert(t *testing.T) {
+    leaf, certFile, keyFile := newTestCert(t, "xxb")
+    pinned, _, _ := newTestCert(t, "pinned")
+
+    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
     if err != nil {
-        t.Error(err)
+        t.Fatal(err)
+    }
+    cert.Certificate = append(cert.Certificate, pinned.Raw)
+
+    server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("ok"))
+    }))
+    server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+    server.StartTLS()
+    defer server.Close()
+
+    ca := writePEM(t, "CERTIFICATE", leaf.Raw)
+    leafSPKI := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+    pinnedSPKI := sha256.Sum256(pinned.RawSubjectPublicKeyInfo)
+    leafPin := base64.StdEncoding.EncodeToString(leafSPKI[:])
+    pinnedPin := base64.StdEncoding.EncodeToString(pinnedSPKI[:])
+
+    tests := []struct {
+        name     string
+        settings util.BackendTLS
+        ok       bool
+    }{
+        {"leaf pin", util.BackendTLS{Verify: true, CA: ca, Pins: []string{leafPin}}, true},
+        {"leaf pin without verify", util.BackendTLS{Verify: false, Pins: []string{leafPin}}, true},
+        {"extra cert pin", util.BackendTLS{Verify: true, CA: ca, Pins: []string{pinnedPin}}, false},
+        {"extra cert pin without verify", util.BackendTLS{Verify: false, Pins: []string{pinnedPin}}, false},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            setTestTLS(t, server.URL, test.settings)
+            ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+            defer cancel()
+
+            body, err := Request(ctx, server.URL, []byte("data"))
+            if test.ok && (err != nil || string(body) != "ok") {
+                t.Errorf("request returned %q, %v", body, err)
+            }
+            if !test.ok && err == nil {
+                t.Error("request succeeded")
+            }
+        })
     }
+}
+
+func TestRequestMutualTLS(t *testing.T) {
+    clientCert, certFile, keyFile := newTestCert(t, "xxd")
 
-    t.Log("----------------")
-    //t.Error(string(body), postData)
-    t.Log(string(body), postData)
+    server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+    }))
+    server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+    server.TLS.ClientCAs.AddCert(clientCert)
+    server.StartTLS()
+    defer server.Close()
+
+    ca := writePEM(t, "CERTIFICATE", server.Certificate().Raw)
+
+    setTestTLS(t, server.URL, util.BackendTLS{Verify: true, CA: ca})
+    if _, err := RequestInfo(server.URL, []byte("data")); err == nil {
+        t.Error("request without client certificate succeeded")
+    }
+
+    setTestTLS(t, server.URL, util.BackendTLS{Verify: true, CA: ca, Cert: certFile, Key: keyFile})
+    if body, err := RequestInfo(server.URL, []byte("data")); err != nil || string(body) != "xxd" {
+        t.Errorf("mutual tls request returned %q, %v", body, err)
+    }
 }
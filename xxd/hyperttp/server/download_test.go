@@ -0,0 +1,174 @@
+package server
+
+import (
+    "bytes"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+    "xxd/util"
+)
+
+var testPNG = append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+
+// 保存一个已上传的文件，返回下载参数
+func saveTestDownload(t *testing.T, fileName string, content []byte) url.Values {
+    setTestUploadPath(t)
+
+    fileTime := util.GetUnixTime()
+    savePath := util.Config.UploadPath + testServerName + "/" + util.GetYmdPath(fileTime)
+    if err := util.Mkdir(savePath); err != nil {
+        t.Fatal(err)
+    }
+    if err := ioutil.WriteFile(savePath+util.GetMD5(fileName+"7"+util.Int642String(fileTime)), content, 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    link := util.DownloadLink{Server: testServerName, FileID: "7", FileName: fileName, Time: util.Int642String(fileTime), UserID: 1, Expires: util.GetUnixTime() + 60}
+    return linkParams(link)
+}
+
+// 签名下载地址中的参数
+func linkParams(link util.DownloadLink) url.Values {
+    params, _ := url.ParseQuery(strings.TrimPrefix(link.URL(), download+"?"))
+    return params
+}
+
+func copyParams(params url.Values) url.Values {
+    copied := url.Values{}
+    for k, v := range params {
+        copied[k] = v
+    }
+    return copied
+}
+
+func downloadRequest(params url.Values, header http.Header) *httptest.ResponseRecorder {
+    r := httptest.NewRequest("GET", download+"?"+params.Encode(), nil)
+    for key, values := range header {
+        r.Header[key] = values
+    }
+
+    w := httptest.NewRecorder()
+    fileDownload(w, r)
+    return w
+}
+
+func TestDownloadInlineImage(t *testing.T) {
+    params := saveTestDownload(t, "截图.png", testPNG)
+
+    w := downloadRequest(params, nil)
+    if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), testPNG) {
+        t.Fatalf("download returned %d", w.Code)
+    }
+    if contentType := w.Header().Get("Content-Type"); contentType != "image/png" {
+        t.Errorf("content type %q", contentType)
+    }
+    if disposition := w.Header().Get("Content-Disposition"); disposition != "inline; filename*=utf-8''%E6%88%AA%E5%9B%BE.png" {
+        t.Errorf("content disposition %q", disposition)
+    }
+
+    etag := w.Header().Get("ETag")
+    if etag == "" {
+        t.Fatal("no etag")
+    }
+    if w := downloadRequest(params, http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+        t.Errorf("if-none-match returned %d", w.Code)
+    }
+}
+
+func TestDownloadRange(t *testing.T) {
+    content := []byte("0123456789abcdefghij")
+    params := saveTestDownload(t, "notes.bin", content)
+
+    w := downloadRequest(params, http.Header{"Range": {"bytes=5-9"}})
+    if w.Code != http.StatusPartialContent || w.Body.String() != "56789" {
+        t.Fatalf("range returned %d %q", w.Code, w.Body.String())
+    }
+    if contentRange := w.Header().Get("Content-Range"); contentRange != "bytes 5-9/20" {
+        t.Errorf("content range %q", contentRange)
+    }
+    if disposition := w.Header().Get("Content-Disposition"); disposition != `attachment; filename=notes.bin` {
+        t.Errorf("content disposition %q", disposition)
+    }
+
+    // ETag不匹配时If-Range返回整个文件
+    w = downloadRequest(params, http.Header{"Range": {"bytes=5-9"}, "If-Range": {`"stale"`}})
+    if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+        t.Errorf("stale if-range returned %d %q", w.Code, w.Body.String())
+    }
+}
+
+func TestDownloadRejected(t *testing.T) {
+    params := saveTestDownload(t, "notes.txt", []byte("notes"))
+
+    for _, key := range []string{"fileName", "time", "id"} {
+        missing := copyParams(params)
+        missing.Del(key)
+        if w := downloadRequest(missing, nil); w.Code != http.StatusBadRequest {
+            t.Errorf("request without %s returned %d", key, w.Code)
+        }
+    }
+
+    unsigned := copyParams(params)
+    unsigned.Del("sig")
+    if w := downloadRequest(unsigned, nil); w.Code != http.StatusUnauthorized {
+        t.Errorf("unsigned link returned %d", w.Code)
+    }
+
+    // 修改任何签名的参数都会使签名无效
+    for key, value := range map[string]string{"id": "8", "fileName": "other.txt", "user": "2", "expires": "9999999999", "ServerName": "other", "sig": "00"} {
+        forged := copyParams(params)
+        forged.Set(key, value)
+        if w := downloadRequest(forged, nil); w.Code != http.StatusForbidden {
+            t.Errorf("link with forged %s returned %d", key, w.Code)
+        }
+    }
+
+    fileTime, _ := util.String2Int64(params.Get("time"))
+    expired := util.DownloadLink{Server: testServerName, FileID: "7", FileName: "notes.txt", Time: params.Get("time"), UserID: 1, Expires: fileTime - 1}
+    if w := downloadRequest(linkParams(expired), nil); w.Code != http.StatusUnauthorized {
+        t.Errorf("expired link returned %d", w.Code)
+    }
+
+    unknown := util.DownloadLink{Server: testServerName, FileID: "8", FileName: "notes.txt", Time: params.Get("time"), UserID: 1, Expires: fileTime + 60}
+    if w := downloadRequest(linkParams(unknown), nil); w.Code != http.StatusNotFound {
+        t.Errorf("unknown file returned %d", w.Code)
+    }
+}
+
+func TestDownloadLegacySid(t *testing.T) {
+    params := saveTestDownload(t, "notes.txt", []byte("notes"))
+    // 桌面端和网页端各自的会话
+    for _, session := range []string{"desktop", "web"} {
+        if err := util.CreateUid(testServerName, 1, session); err != nil {
+            t.Fatal(err)
+        }
+        defer util.DelUid(testServerName, 1, session)
+    }
+
+    legacy := url.Values{"fileName": {"notes.txt"}, "time": {params.Get("time")}, "id": {"7"}, "ServerName": {testServerName}, "gid": {"1"}, "sid": {util.GetMD5("web" + "notes.txt")}}
+    if w := downloadRequest(legacy, nil); w.Code != http.StatusOK {
+        t.Errorf("legacy link returned %d", w.Code)
+    }
+
+    // 桌面端退出后网页端的链接仍然有效
+    util.DelUid(testServerName, 1, "desktop")
+    if w := downloadRequest(legacy, nil); w.Code != http.StatusOK {
+        t.Errorf("legacy link returned %d after the other client logged out", w.Code)
+    }
+
+    wrong := copyParams(legacy)
+    wrong.Set("sid", util.GetMD5("other"))
+    if w := downloadRequest(wrong, nil); w.Code != http.StatusUnauthorized {
+        t.Errorf("wrong sid returned %d", w.Code)
+    }
+
+    old := util.Config.LegacyDownload
+    util.Config.LegacyDownload = false
+    defer func() { util.Config.LegacyDownload = old }()
+    if w := downloadRequest(legacy, nil); w.Code != http.StatusUnauthorized {
+        t.Errorf("legacy link returned %d with legacyDownload=0", w.Code)
+    }
+}
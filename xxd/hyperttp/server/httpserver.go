@@ -10,9 +10,12 @@
 package server
 
 import (
+    "context"
+    "crypto/subtle"
     "encoding/json"
     "fmt"
     "io"
+    "mime"
     "net/http"
     "os"
     "xxd/api"
@@ -27,6 +30,9 @@ type retCInfo struct {
     // encrypt key
     Token string `json:"token"`
 
+    // session key id, sent in the xxd-key-id websocket header
+    KeyID string `json:"keyID,omitempty"`
+
     // multiSite or singleSite
     SiteType string `json:"siteType"`
 
@@ -34,6 +40,9 @@ type retCInfo struct {
 
     ChatPort  int  `json:"chatPort"`
     TestModel bool `json:"testModel"`
+
+    // supported crypto protocol, sent in the xxd-crypto websocket header
+    Crypto []string `json:"crypto"`
 }
 
 // route
@@ -41,6 +50,7 @@ const (
     download = "/download"
     upload   = "/upload"
     sInfo    = "/serverInfo"
+    metric   = "/metrics"
 )
 
 // 获取文件大小的接口
@@ -53,6 +63,9 @@ type Stat interface {
     Stat() (os.FileInfo, error)
 }
 
+var mux = http.NewServeMux()
+var httpServer = &http.Server{Handler: mux}
+
 // 启动 http server
 func InitHttp() {
     crt, key, err := CreateSignedCertKey()
@@ -66,13 +79,17 @@ func InitHttp() {
         util.Exit("Warning: Backend server login error")
     }
 
-    mux := http.NewServeMux()
-
     mux.HandleFunc(download, fileDownload)
     mux.HandleFunc(upload, fileUpload)
+    mux.HandleFunc(uploadInit, chunkUploadInit)
+    mux.HandleFunc(uploadChunk, chunkUploadPut)
+    mux.HandleFunc(uploadStatus, chunkUploadStatus)
+    mux.HandleFunc(uploadFinish, chunkUploadFinish)
     mux.HandleFunc(sInfo, serverInfo)
+    mux.HandleFunc(metric, serveMetrics)
 
     addr := util.Config.Ip + ":" + util.Config.CommonPort
+    httpServer.Addr = addr
 
     util.Println("Listen IP: ", util.Config.Ip)
     util.Println("ChatPort port: ", util.Config.ChatPort)
@@ -83,87 +100,195 @@ func InitHttp() {
     util.LogInfo().Println("CommonPort port: ", util.Config.CommonPort)
 
     if util.Config.IsHttps != "1" {
-        if err := http.ListenAndServe(addr, mux); err != nil {
+        if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
             util.LogError().Println("Warning: http server listen error:", err)
             util.Exit("Warning: http server listen error")
         }
     }else{
-        if err := http.ListenAndServeTLS(addr, crt, key, mux); err != nil {
+        if err := httpServer.ListenAndServeTLS(crt, key); err != nil && err != http.ErrServerClosed {
             util.LogError().Println("Warning: https server listen error:", err)
             util.Exit("Warning: https server listen error")
         }
     }
 
-    util.Println("---------------------------------------- \n",)
-    util.Println("Visit http://xuan.im to get more help, or join official QQ group 367833155. \n",)
-    util.Println("Press Ctrl+C to stop the server. \n",)
+    util.Printf("---------------------------------------- \n\n")
+    util.Printf("Visit http://xuan.im to get more help, or join official QQ group 367833155. \n\n")
+    util.Printf("Press Ctrl+C to stop the server. \n\n")
 
 
 }
 
-//文件下载
+//停止接受新的请求，并等待正在处理的请求完成
+func Shutdown(ctx context.Context) error {
+    return httpServer.Shutdown(ctx)
+}
+
+//其他模块在通用端口上注册路由
+func HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+    mux.HandleFunc(pattern, handler)
+}
+
+//验证请求头"Authorization: Bearer <token>"
+func VerifyBearer(r *http.Request, token string) bool {
+    authorization := []byte(r.Header.Get("Authorization"))
+    return subtle.ConstantTimeCompare(authorization, []byte("Bearer "+token)) == 1
+}
+
+//文件下载，支持Range断点续传和ETag缓存，图片在浏览器中直接显示
 func fileDownload(w http.ResponseWriter, r *http.Request) {
-    if r.Method != "GET" {
+    if r.Method != "GET" && r.Method != "HEAD" {
+        w.WriteHeader(http.StatusMethodNotAllowed)
         fmt.Fprintln(w, "not supported request")
         return
     }
 
     r.ParseForm()
-    reqFileName := r.Form["fileName"][0]
-    reqFileTime := r.Form["time"][0]
-    reqFileID := r.Form["id"][0]
+    for _, key := range []string{"fileName", "time", "id"} {
+        if r.Form.Get(key) == "" {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintln(w, "missing parameter "+key)
+            return
+        }
+    }
+
+    reqFileName := r.Form.Get("fileName")
+    reqFileTime := r.Form.Get("time")
+    reqFileID := r.Form.Get("id")
 
-    serverName := r.Form["ServerName"][0]
+    serverName := r.Form.Get("ServerName")
     if serverName == "" {
-        serverName = util.Config.DefaultServer
+        serverName = util.GetDefaultServer()
     }
 
-    //新增加验证方式
-    reqSid := r.Form["sid"][0]
-    reqGid := r.Form["gid"][0]
-    session,err :=util.GetUid(serverName, reqGid)
-    util.Println("Info: file_session:",session)
-    if err!=nil {
-        fmt.Fprintln(w, "Warning: Not supported request")
+    if _, err := util.String2Int64(reqFileTime); err != nil {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprintln(w, "invalid parameter time")
         return
     }
-    if reqSid != string(util.GetMD5( session  + reqFileName )) {
-        w.WriteHeader(http.StatusUnauthorized)
+
+    if code, message := verifyDownload(r, serverName); code != http.StatusOK {
+        w.WriteHeader(code)
+        fmt.Fprintln(w, message)
         return
     }
 
-    fileTime, err := util.String2Int64(reqFileTime)
+    key := uploadKey(serverName, reqFileName, reqFileID, reqFileTime)
+    info, err := util.UploadStorage.Stat(key)
+    if err == util.ErrNotFound {
+        w.WriteHeader(http.StatusNotFound)
+        return
+    }
     if err != nil {
-        util.LogError().Println("Warning: file download,time undefined:", err)
+        util.LogError().Println("file download, stat error:", err)
         w.WriteHeader(http.StatusInternalServerError)
         return
     }
 
-    // new file name = md5(old filename + fileID + fileTime)
-    fileName := util.Config.UploadPath + serverName + "/" + util.GetYmdPath(fileTime) + util.GetMD5(reqFileName+reqFileID+reqFileTime)
-    //util.Println(fileName)
-    if util.IsNotExist(fileName) || util.IsDir(fileName) {
-        w.WriteHeader(http.StatusNotFound)
-        return
+    // size参数请求图片的缩略图，不是图片或图片本身较小时返回原文件
+    baseName := util.FileBaseName(reqFileName)
+    typeName := baseName
+    if reqSize := r.Form.Get("size"); reqSize != "" {
+        size, ok := thumbnailSizes[reqSize]
+        if !ok {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintln(w, "invalid parameter size")
+            return
+        }
+
+        thumbKey, thumbInfo, err := thumbnail(key, size)
+        if err != nil {
+            util.LogError().Println("file download, thumbnail error:", err)
+        } else if thumbKey != "" {
+            key, info, typeName = thumbKey, thumbInfo, ""
+        }
     }
 
-    //fileExtension := util.FileExtension(reqFileName)
-    //util.Println("fileExtension", fileExtension)
-    //if fileExtension != ".jpg" && fileExtension != ".png" && fileExtension != ".jpeg" && fileExtension != ".gif" {
-    //}
+    file := util.NewStorageReader(util.UploadStorage, key, info.Size)
+    defer file.Close()
 
-    w.Header().Add("Content-Type", "application/octet-stream")
-    w.Header().Add("content-disposition", "attachment; filename=\""+ util.FileBaseName(reqFileName) +"\"")
+    contentType := downloadContentType(typeName, file)
+    disposition := "attachment"
+    if inlineTypes[contentType] {
+        disposition = "inline"
+    }
+
+    w.Header().Set("Content-Type", contentType)
+    w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": baseName}))
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.Header().Set("Cache-Control", "private")
+    if info.ETag != "" {
+        w.Header().Set("ETag", info.ETag)
+    }
+
+    http.ServeContent(w, r, baseName, info.ModTime, file)
+}
+
+//验证下载链接，签名错误返回403，过期返回401。没有sig参数时按设置验证旧的sid=md5(session+fileName)
+func verifyDownload(r *http.Request, serverName string) (int, string) {
+    reqSig := r.Form.Get("sig")
+    if reqSig == "" {
+        if !util.Config.LegacyDownload || r.Form.Get("sid") == "" || r.Form.Get("gid") == "" {
+            return http.StatusUnauthorized, "download link is not signed"
+        }
+
+        // 旧的下载链接，gid参数为用户ID，用户的任何一个客户端的会话都可以
+        sessions, _ := util.GetUids(serverName, r.Form.Get("gid"))
+        for _, session := range sessions {
+            if subtle.ConstantTimeCompare([]byte(r.Form.Get("sid")), []byte(util.GetMD5(session+r.Form.Get("fileName")))) == 1 {
+                return http.StatusOK, ""
+            }
+        }
+        return http.StatusUnauthorized, "invalid sid"
+    }
+
+    userID, userErr := util.String2Int64(r.Form.Get("user"))
+    expires, expiresErr := util.String2Int64(r.Form.Get("expires"))
+    if userErr != nil || expiresErr != nil {
+        return http.StatusForbidden, "invalid signature"
+    }
 
-    http.ServeFile(w, r, fileName)
+    link := util.DownloadLink{
+        Server:   serverName,
+        FileID:   r.Form.Get("id"),
+        FileName: r.Form.Get("fileName"),
+        Time:     r.Form.Get("time"),
+        UserID:   userID,
+        Expires:  expires,
+    }
+    if !link.Verify(reqSig) {
+        return http.StatusForbidden, "invalid signature"
+    }
+    if util.GetUnixTime() > expires {
+        return http.StatusUnauthorized, "download link expired"
+    }
+
+    return http.StatusOK, ""
+}
+
+// 可以在浏览器中直接显示的类型，svg可以包含脚本，仍然作为附件下载
+var inlineTypes = map[string]bool{
+    "image/png":  true,
+    "image/jpeg": true,
+    "image/gif":  true,
+    "image/webp": true,
+    "image/bmp":  true,
+}
+
+//根据扩展名判断文件类型，无法判断时检测文件内容
+func downloadContentType(fileName string, file io.ReadSeeker) string {
+    if contentType := mime.TypeByExtension(util.FileExtension(fileName)); contentType != "" {
+        return contentType
+    }
+
+    buf := make([]byte, 512)
+    n, _ := io.ReadFull(file, buf)
+    file.Seek(0, io.SeekStart)
+    return http.DetectContentType(buf[:n])
 }
 
 //文件上传
 func fileUpload(w http.ResponseWriter, r *http.Request) {
-    w.Header().Add("Access-Control-Allow-Origin", "*")
-    w.Header().Add("Access-Control-Allow-Methods", "POST,GET,OPTIONS,DELETE")
-    w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-FILENAME, ServerName")
-    w.Header().Add("Access-Control-Allow-Credentials", "true")
+    setUploadHeaders(w)
 
     if r.Method != "POST" {
         fmt.Fprintln(w, "not supported request")
@@ -173,17 +298,18 @@ func fileUpload(w http.ResponseWriter, r *http.Request) {
     //util.Println(r.Header)
     serverName := r.Header.Get("ServerName")
     if serverName == "" {
-        serverName = util.Config.DefaultServer
+        serverName = util.GetDefaultServer()
     }
 
-    authorization := r.Header.Get("Authorization")
-    if authorization != string(util.Token) {
+    r.ParseMultipartForm(32 << 20)
+
+    // 会话密钥只能以登录的用户身份上传
+    userID, userErr := util.String2Int64(r.Form.Get("userID"))
+    if !api.VerifyToken([]byte(r.Header.Get("Authorization")), serverName, userID) {
         w.WriteHeader(http.StatusUnauthorized)
         return
     }
 
-    r.ParseMultipartForm(32 << 20)
-
     file, handler, err := r.FormFile("file")
     if err != nil {
         util.LogError().Println("form file error:", err)
@@ -194,12 +320,6 @@ func fileUpload(w http.ResponseWriter, r *http.Request) {
 
     nowTime := util.GetUnixTime()
     savePath := util.Config.UploadPath + serverName + "/" + util.GetYmdPath(nowTime)
-    if err := util.Mkdir(savePath); err != nil {
-        util.LogError().Println("mkdir error:", err)
-        w.WriteHeader(http.StatusInternalServerError)
-        fmt.Fprintln(w, "mkdir error")
-        return
-    }
 
     var fileSize int64 = 0
     if statInterface, ok := file.(Stat); ok {
@@ -228,39 +348,96 @@ func fileUpload(w http.ResponseWriter, r *http.Request) {
     //util.Println(r.Form)
     fileName := util.FileBaseName(handler.Filename)
     nowTimeStr := util.Int642String(nowTime)
-    gid := r.Form["gid"][0]
-    userID := r.Form["userID"][0]
+    gid := r.Form.Get("gid")
+    if userErr != nil || gid == "" {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprintln(w, "gid and userID are required")
+        return
+    }
 
-    x2rJson := `{"userID":` + userID + `,"module":"chat","method":"uploadFile","params":["` + fileName + `","` + savePath + `",` + util.Int642String(fileSize) + `,` + nowTimeStr + `,"` + gid + `"]}`
+    if quotaExceeded(serverName, userID, fileSize) {
+        w.WriteHeader(http.StatusRequestEntityTooLarge)
+        fmt.Fprintln(w, "upload quota exceeded")
+        return
+    }
 
-    //util.Println(x2rJson)
-    fileID, err := api.UploadFileInfo(serverName, []byte(x2rJson))
+    // 先保存到临时文件计算sha256，登记成功后再存入内容存储
+    tmp, hash, written, err := writeObjectTemp(file)
+    if err != nil {
+        util.LogError().Println("save file error:", err)
+        w.WriteHeader(http.StatusInternalServerError)
+        fmt.Fprintln(w, "save file error")
+        return
+    }
+
+    if !scanUpload(w, tmp, quarantineInfo{Server: serverName, UserID: userID, Gid: gid, Name: fileName, Size: written, Hash: hash}) {
+        os.Remove(tmp)
+        return
+    }
+
+    fileID, err := registerUpload(serverName, userID, gid, fileName, savePath, fileSize, nowTime)
     if err != nil {
         util.LogError().Println("Upload file info error:", err)
+        os.Remove(tmp)
         w.WriteHeader(http.StatusInternalServerError)
         fmt.Fprintln(w, "Upload file info error")
         return
     }
-    if fileID == "" {
-        fileID = fmt.Sprintf("%d", rand.Intn(999999) + 1)
-    }
 
-    // new file name = md5(old filename + fileID + nowTime)
-    saveFile := savePath + util.GetMD5(fileName+fileID+nowTimeStr)
-    //util.Println(saveFile)
-    f, err := os.OpenFile(saveFile, os.O_WRONLY|os.O_CREATE, 0644)
+    key := uploadKey(serverName, fileName, fileID, nowTimeStr)
+    width, height, _ := imageSize(tmp)
+    duplicate, err := storeObject(tmp, hash, key)
     if err != nil {
-        util.LogError().Println("open file error:", err)
+        util.LogError().Println("save file error:", err)
+        os.Remove(tmp)
         w.WriteHeader(http.StatusInternalServerError)
-        fmt.Fprintln(w, "open file error")
+        fmt.Fprintln(w, "save file error")
         return
     }
-    defer f.Close()
-    io.Copy(f, file)
 
-    x2cJson := `{"result":"success","data":{"time":` + nowTimeStr + `,"id":` + fileID + `,"name":"` + fileName + `"}}`
-    //fmt.Fprintln(w, handler.Header)
-    //util.Println(x2cJson)
+    countUpload(serverName, written, duplicate)
+    recordUpload(util.UploadRecord{Server: serverName, FileID: fileID, UserID: userID, Key: key, Size: written, Time: nowTime})
+
+    writeUploadResult(w, nowTime, fileID, fileName, width, height)
+}
+
+//上传文件在存储中的key，server/Y/m/d/md5(filename + fileID + time)
+func uploadKey(serverName, fileName, fileID, fileTime string) string {
+    unixTime, _ := util.String2Int64(fileTime)
+    return serverName + "/" + util.GetYmdPath(unixTime) + util.GetMD5(fileName+fileID+fileTime)
+}
+
+//向后端服务器登记上传的文件，返回文件ID
+func registerUpload(serverName string, userID int64, gid, fileName, savePath string, size, nowTime int64) (string, error) {
+    x2rJson, err := json.Marshal(map[string]interface{}{
+        "userID": userID,
+        "module": "chat",
+        "method": "uploadFile",
+        "params": []interface{}{fileName, savePath, size, nowTime, gid},
+    })
+    if err != nil {
+        return "", err
+    }
+
+    fileID, err := api.UploadFileInfo(serverName, x2rJson)
+    if err != nil {
+        return "", err
+    }
+    if fileID == "" {
+        fileID = fmt.Sprintf("%d", rand.Intn(999999) + 1)
+    }
+
+    return fileID, nil
+}
+
+//上传成功的返回结果，图片同时返回宽和高
+func writeUploadResult(w http.ResponseWriter, nowTime int64, fileID, fileName string, width, height int) {
+    name, _ := json.Marshal(fileName)
+    dimensions := ""
+    if width > 0 && height > 0 {
+        dimensions = `,"width":` + util.Int2String(width) + `,"height":` + util.Int2String(height)
+    }
+    x2cJson := `{"result":"success","data":{"time":` + util.Int642String(nowTime) + `,"id":` + fileID + `,"name":` + string(name) + dimensions + `}}`
     fmt.Fprintln(w, x2cJson)
 }
 
@@ -299,13 +476,29 @@ func serverInfo(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // 新版本客户端使用只属于本次登录的会话密钥
+    token, keyID := util.Token, ""
+    if r.Form.Get("sessionKey") == "1" {
+        keyID, token, err = api.IssueSessionKey()
+        if err != nil {
+            util.LogError().Println("issue session key error:", err)
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+    } else if !util.Config.LegacyToken {
+        w.WriteHeader(http.StatusUpgradeRequired)
+        return
+    }
+
     info := retCInfo{
         Version:        util.Version,
-        Token:          string(util.Token),
-        SiteType:       util.Config.SiteType,
+        Token:          string(token),
+        KeyID:          keyID,
+        SiteType:       util.GetSiteType(),
         UploadFileSize: util.Config.UploadFileSize,
         ChatPort:       chatPort,
-        TestModel:      util.IsTest}
+        TestModel:      util.IsTest,
+        Crypto:         cryptoList()}
 
     jsonData, err := json.Marshal(info)
     if err != nil {
@@ -316,3 +509,12 @@ func serverInfo(w http.ResponseWriter, r *http.Request) {
 
     fmt.Fprintln(w, string(jsonData))
 }
+
+//客户端可以使用的加密协议
+func cryptoList() []string {
+    if util.Config.LegacyCrypto {
+        return []string{util.CryptoGCM, util.CryptoCBC}
+    }
+
+    return []string{util.CryptoGCM}
+}
@@ -0,0 +1,65 @@
+/**
+ * The metrics file of hyperttp current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     server
+ * @link        http://www.zentao.net
+ */
+package server
+
+import (
+    "net/http"
+    "xxd/metrics"
+    "xxd/util"
+)
+
+var (
+    uploadTotal = metrics.NewCounter("xxd_upload_total", "Files uploaded.", "backend")
+    uploadBytes = metrics.NewCounter("xxd_upload_bytes_total", "Bytes of uploaded files.", "backend")
+    uploadDedup = metrics.NewCounter("xxd_upload_dedup_total", "Uploaded files whose content was already stored.", "backend")
+    dedupBytes  = metrics.NewCounter("xxd_upload_dedup_bytes_total", "Bytes not stored again because the content was already stored.", "backend")
+    uploadScan  = metrics.NewCounter("xxd_upload_scan_total", "Uploaded files scanned, by result (clean, infected or error).", "backend", "result")
+)
+
+func init() {
+    metrics.NewGaugeFunc("xxd_offline_queue_depth", "Offline users waiting to be reported to the backend.", []string{"backend"}, queueDepth(util.DBCountOffline))
+    metrics.NewGaugeFunc("xxd_sendfail_queue_depth", "Failed messages waiting to be reported to the backend.", []string{"backend"}, queueDepth(util.DBCountSendfail))
+}
+
+func countUpload(serverName string, size int64, duplicate bool) {
+    uploadTotal.Inc(serverName)
+    uploadBytes.Add(float64(size), serverName)
+    if duplicate {
+        uploadDedup.Inc(serverName)
+        dedupBytes.Add(float64(size), serverName)
+    }
+}
+
+func queueDepth(count func() (map[string]int, error)) func() []metrics.Sample {
+    return func() []metrics.Sample {
+        depth, err := count()
+        if err != nil {
+            return nil
+        }
+
+        var samples []metrics.Sample
+        for serverName, n := range depth {
+            samples = append(samples, metrics.Sample{Labels: []string{serverName}, Value: float64(n)})
+        }
+        return samples
+    }
+}
+
+//统计数据，配置了metricsToken时需要在Authorization中提交
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+    if util.Config.MetricsToken != "" {
+        if !VerifyBearer(r, util.Config.MetricsToken) {
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+    }
+
+    metrics.Handler(w, r)
+}
@@ -0,0 +1,332 @@
+/**
+ * The objects file of hyperttp current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     server
+ * @link        http://www.zentao.net
+ */
+package server
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+    "xxd/util"
+)
+
+// 上传的文件按内容的sha256保存在 UploadPath/.objects/前两位/sha256 下，
+// 原来按文件名生成的路径 UploadPath/server/Y/m/d/md5(filename+fileID+time) 是指向它的硬链接。
+// 文件的链接数减一就是引用它的上传数，链接数为1的文件已没有引用。
+const objectDirName = ".objects"
+
+// 写入中的临时文件，超过该时间的会被清理
+const objectTempExpire = 24 * time.Hour
+
+// 保存和清理文件时加锁，避免清理掉刚要链接的文件
+var objectMu sync.Mutex
+
+// 建立硬链接，测试时替换
+var linkFile = os.Link
+
+func objectRoot() string {
+    return filepath.Join(util.Config.UploadPath, objectDirName)
+}
+
+func objectPath(hash string) string {
+    return filepath.Join(objectRoot(), hash[:2], hash)
+}
+
+//把上传的内容写入临时文件，同时计算sha256
+func writeObjectTemp(r io.Reader) (string, string, int64, error) {
+    tmpDir := filepath.Join(objectRoot(), "tmp")
+    if err := util.Mkdir(tmpDir); err != nil {
+        return "", "", 0, err
+    }
+
+    f, err := ioutil.TempFile(tmpDir, "upload-")
+    if err != nil {
+        return "", "", 0, err
+    }
+    defer f.Close()
+
+    hash := sha256.New()
+    written, err := io.Copy(io.MultiWriter(f, hash), r)
+    if err == nil {
+        err = f.Close()
+    }
+    if err != nil {
+        os.Remove(f.Name())
+        return "", "", 0, err
+    }
+
+    return f.Name(), hex.EncodeToString(hash.Sum(nil)), written, nil
+}
+
+//保存上传的临时文件到key。本地存储按内容去重，内容已存在时丢弃临时文件，返回是否重复
+func storeObject(tmp, hash, key string) (bool, error) {
+    local, ok := util.UploadStorage.(util.LocalStorage)
+    if !ok {
+        defer os.Remove(tmp)
+        return false, putFile(util.UploadStorage, key, tmp)
+    }
+
+    objectMu.Lock()
+    defer objectMu.Unlock()
+
+    object := objectPath(hash)
+    alias := local.Path(key)
+    if err := util.Mkdir(filepath.Dir(object)); err != nil {
+        return false, err
+    }
+    if err := util.Mkdir(filepath.Dir(alias)); err != nil {
+        return false, err
+    }
+
+    duplicate := !util.IsNotExist(object)
+    if duplicate {
+        os.Remove(tmp)
+    } else if err := os.Rename(tmp, object); err != nil {
+        return false, err
+    }
+
+    if err := linkObject(object, alias); err != nil {
+        // 文件系统不支持硬链接时不去重，文件只保存在alias。
+        // 复制的文件链接数为1，放在 .objects 下会被当作没有引用而清理
+        util.LogError().Println("link upload error, stored without deduplication:", err)
+        if duplicate {
+            return false, copyFile(object, alias)
+        }
+        return false, os.Rename(object, alias)
+    }
+
+    return duplicate, nil
+}
+
+func putFile(storage util.Storage, key, path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    info, err := f.Stat()
+    if err != nil {
+        return err
+    }
+
+    return storage.Put(key, f, info.Size())
+}
+
+//在alias建立指向object的硬链接，已存在的alias会被替换
+func linkObject(object, alias string) error {
+    tmp := alias + ".link"
+    os.Remove(tmp)
+
+    if err := linkFile(object, tmp); err != nil {
+        return err
+    }
+
+    if err := os.Rename(tmp, alias); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+
+    return nil
+}
+
+func copyFile(src, dst string) error {
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+
+    out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        return err
+    }
+
+    return out.Close()
+}
+
+//文件被引用的次数，无法获取链接数时返回-1
+func objectRefs(path string) int {
+    links := fileLinks(path)
+    if links == 0 {
+        return -1
+    }
+
+    return int(links) - 1
+}
+
+//删除没有引用的文件和过期的临时文件，返回删除的文件数和字节数
+func collectObjects() (int, int64) {
+    objectMu.Lock()
+    defer objectMu.Unlock()
+
+    var removed int
+    var freed int64
+    filepath.Walk(objectRoot(), func(path string, info os.FileInfo, err error) error {
+        if err != nil || info.IsDir() {
+            return nil
+        }
+
+        if filepath.Base(filepath.Dir(path)) == "tmp" {
+            if time.Since(info.ModTime()) < objectTempExpire {
+                return nil
+            }
+        } else if objectRefs(path) != 0 {
+            return nil
+        }
+
+        if err := os.Remove(path); err != nil {
+            util.LogError().Println("remove upload object error:", err)
+            return nil
+        }
+        removed++
+        freed += info.Size()
+        return nil
+    })
+
+    return removed, freed
+}
+
+//把按文件名保存的旧文件迁移到内容存储，内容相同的文件合并为同一个文件的链接。
+//使用其他存储时把 uploadPath 下的文件上传到存储中，已存在的跳过。
+//不在上传文件索引中的文件补录到索引，计入配额和保留策略
+func MigrateUploads() error {
+    var files, duplicates, indexed int
+    var saved int64
+
+    index := make(uploadIndex)
+    root := filepath.Clean(util.Config.UploadPath)
+    _, isLocal := util.UploadStorage.(util.LocalStorage)
+    err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+
+        if info.IsDir() {
+            if path != root && strings.HasPrefix(info.Name(), ".") {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+            return nil
+        }
+
+        var duplicate bool
+        if isLocal {
+            duplicate, err = migrateUpload(path)
+        } else {
+            duplicate, err = copyUpload(root, path)
+        }
+        if err != nil {
+            util.LogError().Println("migrate upload error:", path, err)
+            return nil
+        }
+
+        files++
+        if duplicate {
+            duplicates++
+            saved += info.Size()
+        }
+
+        rel, err := filepath.Rel(root, path)
+        if err != nil {
+            return nil
+        }
+        if added, err := index.backfill(filepath.ToSlash(rel), info); err != nil {
+            util.LogError().Println("index upload error:", path, err)
+        } else if added {
+            indexed++
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    util.Printf("%d uploaded files added to the upload index.\n", indexed)
+    util.LogInfo().Printf("migrate uploads: %d files added to the upload index\n", indexed)
+
+    if !isLocal {
+        util.Printf("Checked %d uploaded files, %d uploaded to %s storage, %d already stored.\n", files, files-duplicates, util.Config.Storage.Driver, duplicates)
+        util.LogInfo().Printf("migrate uploads to %s storage: %d files, %d already stored\n", util.Config.Storage.Driver, files, duplicates)
+        return nil
+    }
+
+    removed, _ := collectObjects()
+    util.Printf("Checked %d uploaded files, %d duplicates linked, %d bytes saved, %d unused objects removed.\n", files, duplicates, saved, removed)
+    util.LogInfo().Printf("migrate uploads: %d files, %d duplicates, %d bytes saved, %d unused objects removed\n", files, duplicates, saved, removed)
+    return nil
+}
+
+//把本地文件上传到存储，存储中已有该文件时返回true
+func copyUpload(root, path string) (bool, error) {
+    rel, err := filepath.Rel(root, path)
+    if err != nil {
+        return false, err
+    }
+
+    key := filepath.ToSlash(rel)
+    if _, err := util.UploadStorage.Stat(key); err == nil {
+        return true, nil
+    } else if err != util.ErrNotFound {
+        return false, err
+    }
+
+    return false, putFile(util.UploadStorage, key, path)
+}
+
+func migrateUpload(path string) (bool, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return false, err
+    }
+
+    hash := sha256.New()
+    _, err = io.Copy(hash, f)
+    f.Close()
+    if err != nil {
+        return false, err
+    }
+
+    object := objectPath(hex.EncodeToString(hash.Sum(nil)))
+
+    objectMu.Lock()
+    defer objectMu.Unlock()
+
+    objectInfo, err := os.Stat(object)
+    if err != nil {
+        // 第一次出现的内容，旧文件本身成为存储的文件
+        if err := util.Mkdir(filepath.Dir(object)); err != nil {
+            return false, err
+        }
+        return false, linkFile(path, object)
+    }
+
+    info, err := os.Stat(path)
+    if err != nil {
+        return false, err
+    }
+    if os.SameFile(info, objectInfo) {
+        return false, nil
+    }
+
+    return true, linkObject(object, path)
+}
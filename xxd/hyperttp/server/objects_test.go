@@ -0,0 +1,211 @@
+package server
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "xxd/util"
+)
+
+func setTestUploadPath(t *testing.T) {
+    oldPath := util.Config.UploadPath
+    util.Config.UploadPath = t.TempDir() + "/"
+    t.Cleanup(func() { util.Config.UploadPath = oldPath })
+}
+
+func storeTestObject(t *testing.T, content []byte, key string) bool {
+    tmp, hash, _, err := writeObjectTemp(bytes.NewReader(content))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    duplicate, err := storeObject(tmp, hash, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return duplicate
+}
+
+func TestStoreObjectDedup(t *testing.T) {
+    setTestUploadPath(t)
+    content := []byte("installer")
+    first := filepath.Join(util.Config.UploadPath, "a")
+    second := filepath.Join(util.Config.UploadPath, "b")
+
+    if storeTestObject(t, content, "a") {
+        t.Error("first upload was a duplicate")
+    }
+    if !storeTestObject(t, content, "b") {
+        t.Error("second upload was not a duplicate")
+    }
+
+    firstInfo, _ := os.Stat(first)
+    secondInfo, _ := os.Stat(second)
+    if !os.SameFile(firstInfo, secondInfo) {
+        t.Error("uploads with the same content were stored twice")
+    }
+
+    object := objectPath(hashOf(content))
+    if refs := objectRefs(object); refs != 2 {
+        t.Errorf("object has %d references, want 2", refs)
+    }
+
+    // 删除一个引用后文件还在，全部删除后被清理
+    os.Remove(first)
+    if removed, _ := collectObjects(); removed != 0 {
+        t.Error("referenced object was removed")
+    }
+    if saved, _ := ioutil.ReadFile(second); !bytes.Equal(saved, content) {
+        t.Error("remaining alias lost its content")
+    }
+
+    os.Remove(second)
+    if removed, freed := collectObjects(); removed != 1 || freed != int64(len(content)) {
+        t.Errorf("collect removed %d files %d bytes", removed, freed)
+    }
+    if !util.IsNotExist(object) {
+        t.Error("unreferenced object was kept")
+    }
+}
+
+func TestStoreObjectWithoutLinks(t *testing.T) {
+    setTestUploadPath(t)
+    content := []byte("installer")
+    storeTestObject(t, content, "a")
+
+    // 文件系统不支持硬链接时文件只保存在alias，清理时不会被删掉
+    linkFile = func(oldname, newname string) error {
+        return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrPermission}
+    }
+    defer func() { linkFile = os.Link }()
+
+    if storeTestObject(t, content, "b") {
+        t.Error("copied upload was counted as a duplicate")
+    }
+    if storeTestObject(t, []byte("other"), "c") {
+        t.Error("first upload was a duplicate")
+    }
+    if !util.IsNotExist(objectPath(hashOf([]byte("other")))) {
+        t.Error("upload without a link was kept under objects")
+    }
+
+    if removed, _ := collectObjects(); removed != 0 {
+        t.Errorf("collect removed %d files", removed)
+    }
+    files := map[string]string{"a": "installer", "b": "installer", "c": "other"}
+    for name, content := range files {
+        saved, err := ioutil.ReadFile(filepath.Join(util.Config.UploadPath, name))
+        if err != nil || string(saved) != content {
+            t.Errorf("file %s changed to %q, %v", name, saved, err)
+        }
+    }
+}
+
+func TestMigrateUploads(t *testing.T) {
+    setTestUploadPath(t)
+    dir := filepath.Join(util.Config.UploadPath, testServerName, "2017", "01", "01")
+    util.Mkdir(dir)
+
+    files := map[string]string{"a": "same", "b": "same", "c": "other"}
+    for name, content := range files {
+        ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+    }
+
+    for i := 0; i < 2; i++ {
+        if err := MigrateUploads(); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    for name, content := range files {
+        saved, err := ioutil.ReadFile(filepath.Join(dir, name))
+        if err != nil || string(saved) != content {
+            t.Errorf("file %s changed to %q, %v", name, saved, err)
+        }
+    }
+
+    if refs := objectRefs(objectPath(hashOf([]byte("same")))); refs != 2 {
+        t.Errorf("duplicated content has %d references, want 2", refs)
+    }
+    if refs := objectRefs(objectPath(hashOf([]byte("other")))); refs != 1 {
+        t.Errorf("unique content has %d references, want 1", refs)
+    }
+}
+
+func hashOf(content []byte) string {
+    hash := sha256.Sum256(content)
+    return hex.EncodeToString(hash[:])
+}
+
+// 不支持硬链接的存储
+type testStorage struct {
+    files map[string][]byte
+}
+
+func (s *testStorage) Put(key string, r io.Reader, size int64) error {
+    s.files[key], _ = ioutil.ReadAll(r)
+    return nil
+}
+
+func (s *testStorage) Get(key string, offset, length int64) (io.ReadCloser, error) {
+    content, ok := s.files[key]
+    if !ok {
+        return nil, util.ErrNotFound
+    }
+    if length < 0 {
+        length = int64(len(content)) - offset
+    }
+    return ioutil.NopCloser(bytes.NewReader(content[offset : offset+length])), nil
+}
+
+func (s *testStorage) Stat(key string) (util.StorageInfo, error) {
+    content, ok := s.files[key]
+    if !ok {
+        return util.StorageInfo{}, util.ErrNotFound
+    }
+    return util.StorageInfo{Size: int64(len(content)), ModTime: time.Unix(1500000000, 0), ETag: `"test"`}, nil
+}
+
+func (s *testStorage) Delete(key string) error {
+    delete(s.files, key)
+    return nil
+}
+
+func TestRemoteStorage(t *testing.T) {
+    setTestUploadPath(t)
+    storage := &testStorage{files: make(map[string][]byte)}
+    old := util.UploadStorage
+    util.UploadStorage = storage
+    t.Cleanup(func() { util.UploadStorage = old })
+
+    content := []byte("0123456789abcdefghij")
+    fileTime := util.Int642String(util.GetUnixTime())
+    key := uploadKey(testServerName, "notes.bin", "7", fileTime)
+    if storeTestObject(t, content, key) || !bytes.Equal(storage.files[key], content) {
+        t.Fatal("upload was not put into the storage")
+    }
+
+    params := linkParams(util.DownloadLink{Server: testServerName, FileID: "7", FileName: "notes.bin", Time: fileTime, UserID: 1, Expires: util.GetUnixTime() + 60})
+    w := downloadRequest(params, http.Header{"Range": {"bytes=10-14"}})
+    if w.Code != http.StatusPartialContent || w.Body.String() != "abcde" || w.Header().Get("ETag") != `"test"` {
+        t.Errorf("download returned %d %q %v", w.Code, w.Body.String(), w.Header())
+    }
+
+    // 迁移时把本地的旧文件上传到存储
+    oldFile := filepath.Join(util.Config.UploadPath, testServerName, "2017", "01", "01", "old")
+    util.Mkdir(filepath.Dir(oldFile))
+    ioutil.WriteFile(oldFile, []byte("old"), 0644)
+    if err := MigrateUploads(); err != nil {
+        t.Fatal(err)
+    }
+    if string(storage.files[testServerName+"/2017/01/01/old"]) != "old" {
+        t.Error("old file was not copied to the storage")
+    }
+}
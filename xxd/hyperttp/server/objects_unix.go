@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+/**
+ * The objects_unix file of hyperttp current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     server
+ * @link        http://www.zentao.net
+ */
+package server
+
+import (
+    "os"
+    "syscall"
+)
+
+//文件的硬链接数，无法获取时返回0
+func fileLinks(path string) uint64 {
+    info, err := os.Stat(path)
+    if err != nil {
+        return 0
+    }
+
+    if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+        return uint64(stat.Nlink)
+    }
+
+    return 0
+}
@@ -0,0 +1,258 @@
+/**
+ * The retention file of hyperttp current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     server
+ * @link        http://www.zentao.net
+ */
+package server
+
+import (
+    "os"
+    "sort"
+    "strings"
+    "time"
+    "xxd/api"
+    "xxd/util"
+)
+
+// 每次通知后端服务器的文件ID数量
+const purgeBatch = 500
+
+// 一个后端服务器按保留策略需要删除的文件
+type retentionPlan struct {
+    Server string
+    Files  []util.UploadRecord
+    Size   int64 // 需要删除的文件总大小
+    Total  int64 // 删除前的总大小
+}
+
+//上传后超过后端服务器或用户的配额时返回true，读取索引出错时不限制
+func quotaExceeded(serverName string, userID, size int64) bool {
+    info, ok := util.GetRanzhiServer(serverName)
+    if !ok || (info.Upload.Quota <= 0 && info.Upload.UserQuota <= 0) {
+        return false
+    }
+
+    serverSize, userSize, err := util.DB.UploadUsage(serverName, userID)
+    if err != nil {
+        util.LogError().Println("Store upload usage error", err)
+        return false
+    }
+
+    if info.Upload.Quota > 0 && serverSize+size > info.Upload.Quota {
+        return true
+    }
+
+    return info.Upload.UserQuota > 0 && userSize+size > info.Upload.UserQuota
+}
+
+//上传成功后记录到索引
+func recordUpload(upload util.UploadRecord) {
+    if err := util.DB.InsertUpload(upload); err != nil {
+        util.LogError().Println("Store insert upload error", err)
+    }
+}
+
+// 索引中已有的文件，map[服务器名称][key]
+type uploadIndex map[string]map[string]bool
+
+//把升级前上传、不在索引中的文件加入索引，上传时间使用文件的修改时间，加入时返回true。
+//key为"服务器名称/年/月/日/md5"，这些文件的文件ID和用户未知，使用key作为索引中的文件ID，只计入后端服务器的配额
+func (index uploadIndex) backfill(key string, info os.FileInfo) (bool, error) {
+    parts := strings.Split(key, "/")
+    if len(parts) != 5 || len(parts[4]) != 32 {
+        return false, nil
+    }
+
+    serverName := parts[0]
+    if _, ok := util.GetRanzhiServer(serverName); !ok {
+        return false, nil
+    }
+
+    keys, ok := index[serverName]
+    if !ok {
+        uploads, err := util.DB.SelectUploads(serverName)
+        if err != nil {
+            return false, err
+        }
+
+        keys = make(map[string]bool, len(uploads))
+        for _, upload := range uploads {
+            keys[upload.Key] = true
+        }
+        index[serverName] = keys
+    }
+    if keys[key] {
+        return false, nil
+    }
+
+    upload := util.UploadRecord{Server: serverName, FileID: key, Key: key, Size: info.Size(), Time: info.ModTime().Unix()}
+    if err := util.DB.InsertUpload(upload); err != nil {
+        return false, err
+    }
+    keys[key] = true
+    return true, nil
+}
+
+//通知后端服务器时使用的文件ID，补录的文件没有文件ID，返回空字符串
+func backendFileID(upload util.UploadRecord) string {
+    if upload.FileID == upload.Key {
+        return ""
+    }
+
+    return upload.FileID
+}
+
+//按保留策略选出需要删除的文件：先选超过保留天数的文件，剩余文件的总大小仍超过上限时，从最早上传的文件开始继续选
+func planRetention(serverName string, policy util.UploadPolicy, now int64) (retentionPlan, error) {
+    plan := retentionPlan{Server: serverName}
+    if policy.RetentionDays <= 0 && policy.RetentionSize <= 0 {
+        return plan, nil
+    }
+
+    uploads, err := util.DB.SelectUploads(serverName)
+    if err != nil {
+        return plan, err
+    }
+
+    for _, upload := range uploads {
+        plan.Total += upload.Size
+    }
+
+    expire := now - policy.RetentionDays*24*3600
+    remain := plan.Total
+    for _, upload := range uploads {
+        expired := policy.RetentionDays > 0 && upload.Time < expire
+        oversize := policy.RetentionSize > 0 && remain > policy.RetentionSize
+        if !expired && !oversize {
+            break
+        }
+
+        plan.Files = append(plan.Files, upload)
+        plan.Size += upload.Size
+        remain -= upload.Size
+    }
+
+    return plan, nil
+}
+
+//所有后端服务器的保留策略执行计划
+func planAllRetention() []retentionPlan {
+    names := util.GetRanzhiServerNames()
+    sort.Strings(names)
+
+    var plans []retentionPlan
+    now := util.GetUnixTime()
+    for _, serverName := range names {
+        info, ok := util.GetRanzhiServer(serverName)
+        if !ok {
+            continue
+        }
+
+        plan, err := planRetention(serverName, info.Upload, now)
+        if err != nil {
+            util.LogError().Printf("retention: select uploads of server %s error, %v\n", serverName, err)
+            continue
+        }
+        if len(plan.Files) > 0 {
+            plans = append(plans, plan)
+        }
+    }
+
+    return plans
+}
+
+//执行上传文件保留策略，dryRun为true时只记录日志。定时任务每天调用一次
+func RunRetention(dryRun bool) {
+    for _, plan := range planAllRetention() {
+        if dryRun {
+            util.LogInfo().Printf("retention dry run: server %s would purge %d files, %d of %d bytes\n", plan.Server, len(plan.Files), plan.Size, plan.Total)
+            continue
+        }
+
+        purged, freed := purgeUploads(plan)
+        util.LogInfo().Printf("retention: server %s purged %d files, %d bytes\n", plan.Server, purged, freed)
+    }
+
+    if _, ok := util.UploadStorage.(util.LocalStorage); ok {
+        if removed, freed := collectObjects(); removed > 0 {
+            util.LogInfo().Printf("retention: %d unused objects removed, %d bytes freed\n", removed, freed)
+        }
+    }
+}
+
+//输出保留策略会删除的文件，不删除文件
+func RetentionReport() {
+    plans := planAllRetention()
+    if len(plans) == 0 {
+        util.Println("No uploaded files to purge.")
+        return
+    }
+
+    for _, plan := range plans {
+        util.Printf("Server %s: %d files, %d of %d bytes would be purged.\n", plan.Server, len(plan.Files), plan.Size, plan.Total)
+        for _, upload := range plan.Files {
+            fileID := backendFileID(upload)
+            if fileID == "" {
+                fileID = "-"
+            }
+            util.Printf("  %s\tuser %d\t%d bytes\t%s\t%s\n", fileID, upload.UserID, upload.Size, time.Unix(upload.Time, 0).Format("2006-01-02"), upload.Key)
+        }
+    }
+}
+
+//分批通知后端服务器，后端服务器确认后删除文件和索引，返回删除的文件数和字节数
+func purgeUploads(plan retentionPlan) (int, int64) {
+    var purged int
+    var freed int64
+    for start := 0; start < len(plan.Files); start += purgeBatch {
+        end := start + purgeBatch
+        if end > len(plan.Files) {
+            end = len(plan.Files)
+        }
+        batch := plan.Files[start:end]
+
+        fileIDs := make([]string, len(batch))
+        keys := make([]string, len(batch))
+        for i, upload := range batch {
+            fileIDs[i] = backendFileID(upload)
+            keys[i] = upload.Key
+        }
+
+        // 后端服务器没有确认时保留文件，下次再删除
+        if err := api.PurgeFiles(plan.Server, fileIDs, keys); err != nil {
+            util.LogError().Printf("retention: notify server %s error, %v\n", plan.Server, err)
+            break
+        }
+
+        // 删除失败的文件保留索引，下次再删除
+        var deleted []string
+        for _, upload := range batch {
+            if err := deleteUpload(upload.Key); err != nil {
+                util.LogError().Printf("retention: delete %s error, %v\n", upload.Key, err)
+                continue
+            }
+            deleted = append(deleted, upload.FileID)
+            freed += upload.Size
+            purged++
+        }
+
+        if err := util.DB.DeleteUploads(plan.Server, deleted); err != nil {
+            util.LogError().Println("Store delete uploads error", err)
+        }
+    }
+
+    return purged, freed
+}
+
+//删除上传文件和它的缩略图
+func deleteUpload(key string) error {
+    for _, size := range thumbnailSizes {
+        util.UploadStorage.Delete(thumbnailDirName + "/" + util.Int2String(size) + "/" + key)
+    }
+
+    return util.UploadStorage.Delete(key)
+}
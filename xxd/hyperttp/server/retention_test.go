@@ -0,0 +1,193 @@
+package server
+
+import (
+    "bytes"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+    "xxd/util"
+)
+
+// 使用单独的内存存储，避免其他测试上传的文件计入配额
+func setTestStore(t *testing.T) {
+    store, err := util.OpenStore("memory", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    old := util.DB
+    util.DB = store
+    t.Cleanup(func() { util.DB = old })
+}
+
+func setTestPolicy(t *testing.T, policy util.UploadPolicy) {
+    info, _ := util.GetRanzhiServer(testServerName)
+    info.Upload = policy
+    util.SetRanzhi(map[string]util.RanzhiServer{testServerName: info}, testServerName)
+}
+
+func TestUploadQuota(t *testing.T) {
+    requests := startTestUpload(t)
+    setTestStore(t)
+    setTestPolicy(t, util.UploadPolicy{UserQuota: minChunkSize + 100})
+
+    content := bytes.Repeat([]byte("q"), minChunkSize)
+    uploadID := initUpload(t, len(content))
+    putChunk(t, uploadID, 0, content)
+    if code, _ := uploadRequest(t, chunkUploadFinish, "POST", uploadFinish+"?uploadID="+uploadID, nil); code != http.StatusOK {
+        t.Fatalf("finish returned %d", code)
+    }
+    <-requests
+
+    if serverSize, userSize, _ := util.DB.UploadUsage(testServerName, 1); serverSize != minChunkSize || userSize != minChunkSize {
+        t.Errorf("usage %d %d after upload", serverSize, userSize)
+    }
+
+    form := url.Values{"fileName": {"b.psd"}, "size": {"101"}, "gid": {"1&2"}, "userID": {"1"}}
+    if code, _ := uploadRequest(t, chunkUploadInit, "POST", uploadInit, []byte(form.Encode())); code != http.StatusRequestEntityTooLarge {
+        t.Errorf("upload over the user quota returned %d", code)
+    }
+
+    // 其他用户不受影响，后端服务器的总配额仍然有效
+    form.Set("userID", "2")
+    if code, _ := uploadRequest(t, chunkUploadInit, "POST", uploadInit, []byte(form.Encode())); code != http.StatusOK {
+        t.Errorf("upload of another user returned %d", code)
+    }
+    setTestPolicy(t, util.UploadPolicy{Quota: minChunkSize})
+    if code, _ := uploadRequest(t, chunkUploadInit, "POST", uploadInit, []byte(form.Encode())); code != http.StatusRequestEntityTooLarge {
+        t.Errorf("upload over the server quota returned %d", code)
+    }
+}
+
+func TestPlanRetention(t *testing.T) {
+    setTestStore(t)
+
+    now := util.GetUnixTime()
+    day := int64(24 * 3600)
+    for i, age := range []int64{40, 20, 10, 1} {
+        util.DB.InsertUpload(util.UploadRecord{Server: testServerName, FileID: util.Int2String(i + 1), UserID: 1, Key: util.Int2String(i + 1), Size: 100, Time: now - age*day})
+    }
+
+    for _, test := range []struct {
+        policy util.UploadPolicy
+        want   []string
+    }{
+        {util.UploadPolicy{}, nil},
+        {util.UploadPolicy{RetentionDays: 30}, []string{"1"}},
+        {util.UploadPolicy{RetentionSize: 250}, []string{"1", "2"}},
+        {util.UploadPolicy{RetentionDays: 15, RetentionSize: 350}, []string{"1", "2"}},
+        {util.UploadPolicy{RetentionDays: 30, RetentionSize: 150}, []string{"1", "2", "3"}},
+    } {
+        plan, err := planRetention(testServerName, test.policy, now)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        var got []string
+        for _, upload := range plan.Files {
+            got = append(got, upload.FileID)
+        }
+        if !reflect.DeepEqual(got, test.want) {
+            t.Errorf("policy %+v purges %v, want %v", test.policy, got, test.want)
+        }
+        if len(test.want) > 0 && plan.Total != 400 {
+            t.Errorf("policy %+v total %d", test.policy, plan.Total)
+        }
+    }
+}
+
+func TestRunRetention(t *testing.T) {
+    requests := startTestUpload(t)
+    setTestStore(t)
+    setTestPolicy(t, util.UploadPolicy{RetentionDays: 30})
+
+    now := util.GetUnixTime()
+    for i, age := range []int64{40, 1} {
+        key := testServerName + "/" + util.Int2String(i)
+        storeTestObject(t, []byte("content"+util.Int2String(i)), key)
+        util.DB.InsertUpload(util.UploadRecord{Server: testServerName, FileID: util.Int2String(i + 1), UserID: 1, Key: key, Size: 8, Time: now - age*24*3600})
+    }
+    oldFile := filepath.Join(util.Config.UploadPath, testServerName, "0")
+
+    RunRetention(true)
+    if _, err := os.Stat(oldFile); err != nil {
+        t.Fatalf("dry run deleted the file: %v", err)
+    }
+    select {
+    case request := <-requests:
+        t.Fatalf("dry run notified the backend: %v", request)
+    default:
+    }
+
+    RunRetention(false)
+    request := <-requests
+    if request.Method() != "purgeFiles" || !reflect.DeepEqual(request["params"], []interface{}{[]interface{}{"1"}, []interface{}{testServerName + "/0"}}) {
+        t.Errorf("backend was notified with %v", request)
+    }
+    if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+        t.Errorf("expired file was not deleted: %v", err)
+    }
+    if _, err := os.Stat(filepath.Join(util.Config.UploadPath, testServerName, "1")); err != nil {
+        t.Errorf("recent file was deleted: %v", err)
+    }
+
+    uploads, _ := util.DB.SelectUploads(testServerName)
+    if len(uploads) != 1 || uploads[0].FileID != "2" {
+        t.Errorf("uploads after retention %v", uploads)
+    }
+
+    // 被删除文件的内容没有其他引用，也从 .objects 中删除
+    if _, err := os.Stat(objectPath(hashOf([]byte("content0")))); !os.IsNotExist(err) {
+        t.Errorf("unused object was not collected: %v", err)
+    }
+}
+
+// 升级前上传的文件由 -migrateUploads 补录到索引，按文件的修改时间执行保留策略
+func TestMigrateUploadsIndex(t *testing.T) {
+    requests := startTestUpload(t)
+    setTestStore(t)
+    setTestPolicy(t, util.UploadPolicy{RetentionDays: 30, Quota: 20})
+
+    now := time.Now()
+    oldTime := now.Add(-40 * 24 * time.Hour)
+    oldKey := testServerName + "/" + util.GetYmdPath(oldTime.Unix()) + util.GetMD5("old")
+    newKey := testServerName + "/" + util.GetYmdPath(now.Unix()) + util.GetMD5("new")
+    for key, mtime := range map[string]time.Time{oldKey: oldTime, newKey: now} {
+        path := filepath.Join(util.Config.UploadPath, filepath.FromSlash(key))
+        util.Mkdir(filepath.Dir(path))
+        ioutil.WriteFile(path, []byte("0123456789"), 0644)
+        os.Chtimes(path, mtime, mtime)
+    }
+
+    // 已在索引中的文件和不是上传文件的路径不补录
+    util.DB.InsertUpload(util.UploadRecord{Server: testServerName, FileID: "7", UserID: 1, Key: newKey, Size: 10, Time: now.Unix()})
+    ioutil.WriteFile(filepath.Join(util.Config.UploadPath, testServerName, "readme"), []byte("x"), 0644)
+
+    for i := 0; i < 2; i++ {
+        if err := MigrateUploads(); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    uploads, _ := util.DB.SelectUploads(testServerName)
+    if len(uploads) != 2 || uploads[0].Key != oldKey || uploads[0].Time != oldTime.Unix() || uploads[0].Size != 10 || uploads[0].UserID != 0 {
+        t.Fatalf("uploads after migration %+v", uploads)
+    }
+    if !quotaExceeded(testServerName, 2, 1) {
+        t.Error("backfilled file was not counted in the server quota")
+    }
+
+    RunRetention(false)
+    request := <-requests
+    if !reflect.DeepEqual(request["params"], []interface{}{[]interface{}{""}, []interface{}{oldKey}}) {
+        t.Errorf("backend was notified with %v", request["params"])
+    }
+    if _, err := os.Stat(filepath.Join(util.Config.UploadPath, filepath.FromSlash(oldKey))); !os.IsNotExist(err) {
+        t.Errorf("backfilled file was not purged: %v", err)
+    }
+}
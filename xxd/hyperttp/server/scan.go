@@ -0,0 +1,102 @@
+/**
+ * The scan file of hyperttp current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     server
+ * @link        http://www.zentao.net
+ */
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "time"
+    "xxd/util"
+)
+
+// 发现病毒的文件移到 uploadPath/.quarantine/ 下，同名的.json文件记录上传信息
+const quarantineDirName = ".quarantine"
+
+// 被隔离文件的上传信息
+type quarantineInfo struct {
+    Server string `json:"server"`
+    UserID int64  `json:"userID"`
+    Gid    string `json:"gid"`
+    Name   string `json:"name"`
+    Size   int64  `json:"size"`
+    Hash   string `json:"hash"`
+    Threat string `json:"threat"`
+    Time   int64  `json:"time"`
+}
+
+//扫描上传的临时文件，发现病毒时隔离文件。返回false时已向客户端返回错误，调用方删除临时文件
+func scanUpload(w http.ResponseWriter, path string, info quarantineInfo) bool {
+    if util.UploadScanner == nil {
+        return true
+    }
+
+    result, err := util.UploadScanner.Scan(path)
+    if err != nil {
+        uploadScan.Inc(info.Server, "error")
+        util.LogError().Printf("scan upload %s error: %v\n", info.Name, err)
+        if util.Config.Scanner.FailOpen {
+            return true
+        }
+
+        uploadError(w, http.StatusServiceUnavailable, "scan file error")
+        return false
+    }
+
+    if !result.Infected {
+        uploadScan.Inc(info.Server, "clean")
+        return true
+    }
+
+    uploadScan.Inc(info.Server, "infected")
+    info.Threat = result.Threat
+    info.Time = util.GetUnixTime()
+    util.LogInfo().Printf("upload quarantined, server:%s user:%d gid:%s file:%s threat:%s\n", info.Server, info.UserID, info.Gid, info.Name, info.Threat)
+    if err := quarantine(path, info); err != nil {
+        util.LogError().Println("quarantine upload error:", err)
+    }
+
+    // 与客户端的 chat.error 消息格式相同
+    message, _ := json.Marshal(map[string]interface{}{
+        "module":  "chat",
+        "method":  "error",
+        "code":    http.StatusUnprocessableEntity,
+        "message": "file is infected",
+        "data":    map[string]string{"name": info.Name, "threat": info.Threat},
+    })
+    w.WriteHeader(http.StatusUnprocessableEntity)
+    fmt.Fprintln(w, string(message))
+    return false
+}
+
+//把文件移到隔离目录，管理员可以根据.json文件中的信息处理
+func quarantine(path string, info quarantineInfo) error {
+    dir := filepath.Join(util.Config.UploadPath, quarantineDirName)
+    if err := util.Mkdir(dir); err != nil {
+        return err
+    }
+
+    name := filepath.Join(dir, time.Unix(info.Time, 0).Format("20060102150405")+"-"+info.Hash)
+    if err := os.Rename(path, name); err != nil {
+        if err := copyFile(path, name); err != nil {
+            return err
+        }
+    }
+
+    data, err := json.MarshalIndent(info, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    return ioutil.WriteFile(name+".json", data, 0600)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "testing"
+    "xxd/util"
+)
+
+// 内容包含EICAR时报告病毒，err不为空时返回扫描错误
+type testScanner struct {
+    err error
+}
+
+func (s *testScanner) Scan(path string) (util.ScanResult, error) {
+    if s.err != nil {
+        return util.ScanResult{}, s.err
+    }
+
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return util.ScanResult{}, err
+    }
+    if bytes.Contains(content, []byte("EICAR")) {
+        return util.ScanResult{Infected: true, Threat: "Eicar-Test-Signature"}, nil
+    }
+    return util.ScanResult{}, nil
+}
+
+func setTestScanner(t *testing.T, scanner util.Scanner) {
+    old := util.UploadScanner
+    util.UploadScanner = scanner
+    t.Cleanup(func() { util.UploadScanner = old })
+}
+
+func finishRequest(uploadID string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest("POST", uploadFinish+"?uploadID="+uploadID, nil)
+    r.Header.Set("Authorization", testClientToken)
+    r.Header.Set("ServerName", testServerName)
+
+    w := httptest.NewRecorder()
+    chunkUploadFinish(w, r)
+    return w
+}
+
+func TestScanQuarantine(t *testing.T) {
+    requests := startTestUpload(t)
+    setTestScanner(t, &testScanner{})
+
+    content := []byte("fake EICAR test content")
+    uploadID := initUpload(t, len(content))
+    putChunk(t, uploadID, 0, content)
+
+    w := finishRequest(uploadID)
+    if w.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("infected upload returned %d", w.Code)
+    }
+
+    var notice map[string]interface{}
+    json.Unmarshal(w.Body.Bytes(), &notice)
+    data, _ := notice["data"].(map[string]interface{})
+    if notice["module"] != "chat" || notice["method"] != "error" || data["threat"] != "Eicar-Test-Signature" || data["name"] != "design.psd" {
+        t.Errorf("infected upload notice %s", w.Body.String())
+    }
+
+    select {
+    case request := <-requests:
+        t.Fatalf("infected upload was registered: %v", request)
+    default:
+    }
+
+    files, _ := filepath.Glob(filepath.Join(util.Config.UploadPath, quarantineDirName, "*-"+hashOf(content)))
+    if len(files) != 1 {
+        t.Fatalf("quarantined files %v", files)
+    }
+    if quarantined, _ := ioutil.ReadFile(files[0]); !bytes.Equal(quarantined, content) {
+        t.Errorf("quarantined content %q", quarantined)
+    }
+
+    var info quarantineInfo
+    infoData, _ := ioutil.ReadFile(files[0] + ".json")
+    if err := json.Unmarshal(infoData, &info); err != nil || info.Threat != "Eicar-Test-Signature" || info.UserID != 1 || info.Gid != "1&2" {
+        t.Errorf("quarantine info %s, %v", infoData, err)
+    }
+}
+
+func TestScanError(t *testing.T) {
+    requests := startTestUpload(t)
+    scanner := &testScanner{err: util.Errorf("scanner is down")}
+    setTestScanner(t, scanner)
+
+    content := []byte("clean")
+    uploadID := initUpload(t, len(content))
+    putChunk(t, uploadID, 0, content)
+
+    if w := finishRequest(uploadID); w.Code != http.StatusServiceUnavailable {
+        t.Fatalf("upload with the scanner down returned %d", w.Code)
+    }
+
+    // 扫描恢复后使用已上传的分块完成上传
+    scanner.err = nil
+    if w := finishRequest(uploadID); w.Code != http.StatusOK {
+        t.Fatalf("retry returned %d %s", w.Code, w.Body.String())
+    }
+    <-requests
+
+    // failOpen 时扫描出错仍然允许上传
+    scanner.err = util.Errorf("scanner is down")
+    old := util.Config.Scanner.FailOpen
+    util.Config.Scanner.FailOpen = true
+    defer func() { util.Config.Scanner.FailOpen = old }()
+
+    uploadID = initUpload(t, len(content))
+    putChunk(t, uploadID, 0, content)
+    if w := finishRequest(uploadID); w.Code != http.StatusOK {
+        t.Errorf("fail open upload returned %d", w.Code)
+    }
+}
@@ -0,0 +1,264 @@
+/**
+ * The thumbnail file of hyperttp current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     server
+ * @link        http://www.zentao.net
+ */
+package server
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "image"
+    "image/draw"
+    _ "image/gif"
+    "image/jpeg"
+    "image/png"
+    "os"
+    "sync"
+    "xxd/util"
+)
+
+// 下载时 size 参数可以使用的缩略图尺寸，为缩略图最长边的像素数
+var thumbnailSizes = map[string]int{
+    "128":  128,
+    "256":  256,
+    "512":  512,
+    "1024": 1024,
+}
+
+// 像素数超过该值的图片不生成缩略图，避免占用过多内存
+const maxThumbnailPixels = 40 * 1000 * 1000
+
+// 缩略图保存在存储的 .thumbs/尺寸/ 下
+const thumbnailDirName = ".thumbs"
+
+// 同时只生成一张缩略图
+var thumbnailMu sync.Mutex
+
+//图片的宽和高，按EXIF方向旋转后的尺寸，不是图片时返回false
+func imageSize(path string) (int, int, bool) {
+    f, err := os.Open(path)
+    if err != nil {
+        return 0, 0, false
+    }
+    defer f.Close()
+
+    reader := bufio.NewReaderSize(f, 64<<10)
+    header, _ := reader.Peek(64 << 10)
+    config, _, err := image.DecodeConfig(reader)
+    if err != nil {
+        return 0, 0, false
+    }
+
+    if exifOrientation(header) >= 5 {
+        return config.Height, config.Width, true
+    }
+
+    return config.Width, config.Height, true
+}
+
+//返回缩略图的key和信息，图片不需要缩小或无法生成缩略图时返回空key
+func thumbnail(key string, size int) (string, util.StorageInfo, error) {
+    thumbKey := thumbnailDirName + "/" + util.Int2String(size) + "/" + key
+    if info, err := util.UploadStorage.Stat(thumbKey); err == nil {
+        return thumbKey, info, nil
+    }
+
+    thumbnailMu.Lock()
+    defer thumbnailMu.Unlock()
+
+    if info, err := util.UploadStorage.Stat(thumbKey); err == nil {
+        return thumbKey, info, nil
+    }
+
+    body, err := util.UploadStorage.Get(key, 0, -1)
+    if err != nil {
+        return "", util.StorageInfo{}, err
+    }
+    defer body.Close()
+
+    reader := bufio.NewReaderSize(body, 64<<10)
+    header, _ := reader.Peek(64 << 10)
+    config, format, err := image.DecodeConfig(bytes.NewReader(header))
+    if err != nil || config.Width*config.Height > maxThumbnailPixels {
+        return "", util.StorageInfo{}, nil
+    }
+    if config.Width <= size && config.Height <= size {
+        return "", util.StorageInfo{}, nil
+    }
+
+    src, _, err := image.Decode(reader)
+    if err != nil {
+        return "", util.StorageInfo{}, nil
+    }
+
+    thumb := orient(shrink(src, size), exifOrientation(header))
+
+    var buf bytes.Buffer
+    if format == "jpeg" {
+        err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+    } else {
+        err = png.Encode(&buf, thumb)
+    }
+    if err != nil {
+        return "", util.StorageInfo{}, err
+    }
+
+    if err := util.UploadStorage.Put(thumbKey, &buf, int64(buf.Len())); err != nil {
+        return "", util.StorageInfo{}, err
+    }
+
+    info, err := util.UploadStorage.Stat(thumbKey)
+    return thumbKey, info, err
+}
+
+//按比例缩小到最长边为size，每个像素取对应区域的平均值
+func shrink(src image.Image, size int) *image.RGBA {
+    bounds := src.Bounds()
+    rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+    draw.Draw(rgba, rgba.Rect, src, bounds.Min, draw.Src)
+
+    sw, sh := bounds.Dx(), bounds.Dy()
+    dw, dh := size, sh*size/sw
+    if sh > sw {
+        dw, dh = sw*size/sh, size
+    }
+    if dw < 1 {
+        dw = 1
+    }
+    if dh < 1 {
+        dh = 1
+    }
+
+    dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+    for y := 0; y < dh; y++ {
+        y0, y1 := y*sh/dh, (y+1)*sh/dh
+        for x := 0; x < dw; x++ {
+            x0, x1 := x*sw/dw, (x+1)*sw/dw
+
+            var sum [4]int
+            for sy := y0; sy < y1; sy++ {
+                offset := rgba.PixOffset(x0, sy)
+                for sx := x0; sx < x1; sx++ {
+                    sum[0] += int(rgba.Pix[offset])
+                    sum[1] += int(rgba.Pix[offset+1])
+                    sum[2] += int(rgba.Pix[offset+2])
+                    sum[3] += int(rgba.Pix[offset+3])
+                    offset += 4
+                }
+            }
+
+            n := (x1 - x0) * (y1 - y0)
+            offset := dst.PixOffset(x, y)
+            for i := range sum {
+                dst.Pix[offset+i] = uint8(sum[i] / n)
+            }
+        }
+    }
+
+    return dst
+}
+
+//按EXIF方向旋转或翻转图片，使其正向显示
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+    if orientation < 2 || orientation > 8 {
+        return src
+    }
+
+    w, h := src.Rect.Dx(), src.Rect.Dy()
+    dw, dh := w, h
+    if orientation >= 5 {
+        dw, dh = h, w
+    }
+
+    dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            var dx, dy int
+            switch orientation {
+            case 2:
+                dx, dy = w-1-x, y
+            case 3:
+                dx, dy = w-1-x, h-1-y
+            case 4:
+                dx, dy = x, h-1-y
+            case 5:
+                dx, dy = y, x
+            case 6:
+                dx, dy = h-1-y, x
+            case 7:
+                dx, dy = h-1-y, w-1-x
+            case 8:
+                dx, dy = y, w-1-x
+            }
+            copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+        }
+    }
+
+    return dst
+}
+
+//读取JPEG中EXIF的方向(1-8)，没有时返回0
+func exifOrientation(header []byte) int {
+    if len(header) < 4 || header[0] != 0xFF || header[1] != 0xD8 {
+        return 0
+    }
+
+    for i := 2; i+4 <= len(header); {
+        if header[i] != 0xFF {
+            return 0
+        }
+        marker := header[i+1]
+        length := int(binary.BigEndian.Uint16(header[i+2:]))
+        if marker == 0xDA || length < 2 || i+2+length > len(header) {
+            return 0
+        }
+
+        segment := header[i+4 : i+2+length]
+        if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+            return tiffOrientation(segment[6:])
+        }
+        i += 2 + length
+    }
+
+    return 0
+}
+
+func tiffOrientation(tiff []byte) int {
+    if len(tiff) < 8 {
+        return 0
+    }
+
+    var order binary.ByteOrder
+    switch string(tiff[:2]) {
+    case "II":
+        order = binary.LittleEndian
+    case "MM":
+        order = binary.BigEndian
+    default:
+        return 0
+    }
+
+    ifd := int(order.Uint32(tiff[4:]))
+    if ifd+2 > len(tiff) {
+        return 0
+    }
+
+    entries := int(order.Uint16(tiff[ifd:]))
+    for i := 0; i < entries; i++ {
+        entry := ifd + 2 + i*12
+        if entry+12 > len(tiff) {
+            return 0
+        }
+        if order.Uint16(tiff[entry:]) == 0x0112 {
+            return int(order.Uint16(tiff[entry+8:]))
+        }
+    }
+
+    return 0
+}
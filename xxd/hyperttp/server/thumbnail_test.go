@@ -0,0 +1,142 @@
+package server
+
+import (
+    "bytes"
+    "encoding/binary"
+    "image"
+    "image/color"
+    "image/jpeg"
+    "image/png"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "path/filepath"
+    "testing"
+    "xxd/util"
+)
+
+func testImage(width, height int) *image.RGBA {
+    img := image.NewRGBA(image.Rect(0, 0, width, height))
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0x80, 0xFF})
+        }
+    }
+    return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+    var buf bytes.Buffer
+    if err := png.Encode(&buf, img); err != nil {
+        t.Fatal(err)
+    }
+    return buf.Bytes()
+}
+
+// 在JPEG的SOI之后插入带方向的EXIF
+func encodeJPEG(t *testing.T, img image.Image, orientation uint16) []byte {
+    var buf bytes.Buffer
+    if err := jpeg.Encode(&buf, img, nil); err != nil {
+        t.Fatal(err)
+    }
+
+    tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+    binary.BigEndian.PutUint16(tiff[18:], orientation)
+    segment := append([]byte("Exif\x00\x00"), tiff...)
+
+    app1 := []byte{0xFF, 0xE1, 0, 0}
+    binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+
+    data := buf.Bytes()
+    return append(append(append([]byte{}, data[:2]...), append(app1, segment...)...), data[2:]...)
+}
+
+func TestThumbnail(t *testing.T) {
+    params := saveTestDownload(t, "photo.png", encodePNG(t, testImage(600, 300)))
+    params.Set("size", "128")
+
+    w := downloadRequest(params, nil)
+    if w.Code != http.StatusOK {
+        t.Fatalf("thumbnail returned %d", w.Code)
+    }
+    if contentType := w.Header().Get("Content-Type"); contentType != "image/png" {
+        t.Errorf("content type %q", contentType)
+    }
+    config, _, err := image.DecodeConfig(w.Body)
+    if err != nil || config.Width != 128 || config.Height != 64 {
+        t.Fatalf("thumbnail is %dx%d, %v", config.Width, config.Height, err)
+    }
+
+    // 第二次请求使用缓存的缩略图
+    etag := w.Header().Get("ETag")
+    if w := downloadRequest(params, http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+        t.Errorf("cached thumbnail returned %d", w.Code)
+    }
+    thumbs, _ := filepath.Glob(filepath.Join(util.Config.UploadPath, thumbnailDirName, "128", testServerName, "*", "*", "*", "*"))
+    if len(thumbs) != 1 {
+        t.Errorf("cached thumbnails %v", thumbs)
+    }
+
+    // 原图小于请求的尺寸时返回原图
+    params.Set("size", "1024")
+    if w := downloadRequest(params, nil); w.Code != http.StatusOK || w.Body.Len() != len(encodePNG(t, testImage(600, 300))) {
+        t.Errorf("small image returned %d with %d bytes", w.Code, w.Body.Len())
+    }
+
+    params.Set("size", "100")
+    if w := downloadRequest(params, nil); w.Code != http.StatusBadRequest {
+        t.Errorf("invalid size returned %d", w.Code)
+    }
+}
+
+func TestThumbnailNotImage(t *testing.T) {
+    params := saveTestDownload(t, "notes.txt", []byte("notes"))
+    params.Set("size", "128")
+
+    if w := downloadRequest(params, nil); w.Code != http.StatusOK || w.Body.String() != "notes" {
+        t.Errorf("not an image returned %d %q", w.Code, w.Body.String())
+    }
+}
+
+func TestThumbnailOrientation(t *testing.T) {
+    content := encodeJPEG(t, testImage(400, 200), 6)
+    if orientation := exifOrientation(content); orientation != 6 {
+        t.Fatalf("orientation %d", orientation)
+    }
+
+    params := saveTestDownload(t, "camera.jpg", content)
+    params.Set("size", "128")
+
+    w := downloadRequest(params, nil)
+    config, format, err := image.DecodeConfig(w.Body)
+    if err != nil || format != "jpeg" || config.Width != 64 || config.Height != 128 {
+        t.Fatalf("thumbnail is %s %dx%d, %v", format, config.Width, config.Height, err)
+    }
+
+    path := filepath.Join(t.TempDir(), "camera.jpg")
+    ioutil.WriteFile(path, content, 0644)
+    if width, height, ok := imageSize(path); !ok || width != 200 || height != 400 {
+        t.Errorf("image size %dx%d", width, height)
+    }
+}
+
+func TestUploadImageSize(t *testing.T) {
+    startTestUpload(t)
+
+    content := encodePNG(t, testImage(300, 200))
+    form := url.Values{"fileName": {"photo.png"}, "size": {util.Int2String(len(content))}, "gid": {"1&2"}, "userID": {"1"}}
+    code, data := uploadRequest(t, chunkUploadInit, "POST", uploadInit, []byte(form.Encode()))
+    if code != http.StatusOK {
+        t.Fatalf("init returned %d", code)
+    }
+
+    uploadID := data["uploadID"].(string)
+    if code := putChunk(t, uploadID, 0, content); code != http.StatusOK {
+        t.Fatalf("chunk returned %d", code)
+    }
+
+    code, result := uploadRequest(t, chunkUploadFinish, "POST", uploadFinish+"?uploadID="+uploadID, nil)
+    if code != http.StatusOK || result["width"] != float64(300) || result["height"] != float64(200) {
+        t.Errorf("finish returned %d %v", code, result)
+    }
+}
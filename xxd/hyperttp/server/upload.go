@@ -0,0 +1,483 @@
+/**
+ * The upload file of hyperttp current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     server
+ * @link        http://www.zentao.net
+ */
+package server
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "time"
+    "xxd/api"
+    "xxd/util"
+)
+
+// 分块上传的路由：创建上传、上传分块、查询进度、完成上传
+const (
+    uploadInit   = "/upload/init"
+    uploadChunk  = "/upload/chunk"
+    uploadStatus = "/upload/status"
+    uploadFinish = "/upload/finish"
+)
+
+// 分块大小，客户端可以在创建上传时指定
+const (
+    defaultChunkSize = 4 << 20
+    minChunkSize     = 256 << 10
+    maxChunkSize     = 32 << 20
+)
+
+// 超过该时间没有上传分块的未完成上传会被删除
+const chunkUploadExpire = 24 * time.Hour
+
+// 未完成的上传保存在 UploadPath/.chunks/上传ID/ 下，info.json 为上传信息，分块文件名为分块序号
+const chunkDirName = ".chunks"
+const chunkInfoFile = "info.json"
+
+type chunkUpload struct {
+    Server    string `json:"server"`
+    UserID    int64  `json:"userID"`
+    Gid       string `json:"gid"`
+    Name      string `json:"name"`
+    Size      int64  `json:"size"`
+    ChunkSize int64  `json:"chunkSize"`
+}
+
+// 正在合并的上传，同一上传同时只能完成一次
+var (
+    finishing   = make(map[string]bool)
+    finishingMu sync.Mutex
+)
+
+func setUploadHeaders(w http.ResponseWriter) {
+    w.Header().Add("Access-Control-Allow-Origin", "*")
+    w.Header().Add("Access-Control-Allow-Methods", "POST,GET,PUT,OPTIONS,DELETE")
+    w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-FILENAME, ServerName")
+    w.Header().Add("Access-Control-Allow-Credentials", "true")
+}
+
+func uploadError(w http.ResponseWriter, code int, message string) {
+    w.WriteHeader(code)
+    fmt.Fprintln(w, message)
+}
+
+func uploadSuccess(w http.ResponseWriter, data interface{}) {
+    jsonData, err := json.Marshal(map[string]interface{}{"result": "success", "data": data})
+    if err != nil {
+        util.LogError().Println("json marshal error:", err)
+        w.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    fmt.Fprintln(w, string(jsonData))
+}
+
+//分块上传的请求方法检查，返回false时已写入响应
+func chunkRequest(w http.ResponseWriter, r *http.Request, method string) bool {
+    setUploadHeaders(w)
+    if r.Method == "OPTIONS" {
+        return false
+    }
+
+    if r.Method != method {
+        uploadError(w, http.StatusMethodNotAllowed, "not supported request")
+        return false
+    }
+
+    return true
+}
+
+//上传的token需要属于上传文件的用户，返回false时已写入响应
+func authorizeUpload(w http.ResponseWriter, r *http.Request, serverName string, userID int64) bool {
+    if !api.VerifyToken([]byte(r.Header.Get("Authorization")), serverName, userID) {
+        w.WriteHeader(http.StatusUnauthorized)
+        return false
+    }
+
+    return true
+}
+
+//创建上传，表单字段 fileName、size、gid、userID，可选 chunkSize
+func chunkUploadInit(w http.ResponseWriter, r *http.Request) {
+    if !chunkRequest(w, r, "POST") {
+        return
+    }
+
+    serverName := r.Header.Get("ServerName")
+    if serverName == "" {
+        serverName = util.GetDefaultServer()
+    }
+    if _, ok := util.GetRanzhiServer(serverName); !ok {
+        uploadError(w, http.StatusBadRequest, "server name not found")
+        return
+    }
+
+    r.ParseForm()
+    upload := chunkUpload{
+        Server:    serverName,
+        Gid:       r.Form.Get("gid"),
+        Name:      util.FileBaseName(r.Form.Get("fileName")),
+        ChunkSize: defaultChunkSize,
+    }
+
+    var err error
+    upload.UserID, err = util.String2Int64(r.Form.Get("userID"))
+    if !authorizeUpload(w, r, serverName, upload.UserID) {
+        return
+    }
+    if err != nil {
+        uploadError(w, http.StatusBadRequest, "userID is required")
+        return
+    }
+    if upload.Gid == "" || r.Form.Get("fileName") == "" {
+        uploadError(w, http.StatusBadRequest, "gid and fileName are required")
+        return
+    }
+    if upload.Size, err = util.String2Int64(r.Form.Get("size")); err != nil || upload.Size <= 0 {
+        uploadError(w, http.StatusBadRequest, "size is required")
+        return
+    }
+    if upload.Size > util.Config.UploadFileSize {
+        uploadError(w, http.StatusBadRequest, "file is too large")
+        return
+    }
+    if quotaExceeded(serverName, upload.UserID, upload.Size) {
+        uploadError(w, http.StatusRequestEntityTooLarge, "upload quota exceeded")
+        return
+    }
+    if chunkSize := r.Form.Get("chunkSize"); chunkSize != "" {
+        upload.ChunkSize, err = util.String2Int64(chunkSize)
+        if err != nil || upload.ChunkSize < minChunkSize || upload.ChunkSize > maxChunkSize {
+            uploadError(w, http.StatusBadRequest, "chunkSize out of range")
+            return
+        }
+    }
+
+    removeExpiredUploads()
+
+    uploadID, err := newUploadID()
+    if err != nil {
+        util.LogError().Println("create upload id error:", err)
+        w.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    dir := chunkDir(uploadID)
+    if err := util.Mkdir(dir); err != nil {
+        util.LogError().Println("mkdir error:", err)
+        uploadError(w, http.StatusInternalServerError, "mkdir error")
+        return
+    }
+
+    info, _ := json.Marshal(upload)
+    if err := ioutil.WriteFile(filepath.Join(dir, chunkInfoFile), info, 0644); err != nil {
+        util.LogError().Println("save upload info error:", err)
+        os.RemoveAll(dir)
+        uploadError(w, http.StatusInternalServerError, "save upload info error")
+        return
+    }
+
+    uploadSuccess(w, map[string]interface{}{
+        "uploadID":  uploadID,
+        "chunkSize": upload.ChunkSize,
+        "chunks":    upload.chunks(),
+    })
+}
+
+//上传一个分块，参数 uploadID、index，请求体为分块内容。重复上传同一分块会覆盖
+func chunkUploadPut(w http.ResponseWriter, r *http.Request) {
+    if !chunkRequest(w, r, "PUT") {
+        return
+    }
+
+    uploadID := r.URL.Query().Get("uploadID")
+    upload, ok := loadUpload(w, uploadID)
+    if !ok || !authorizeUpload(w, r, upload.Server, upload.UserID) {
+        return
+    }
+
+    index, err := strconv.ParseInt(r.URL.Query().Get("index"), 10, 64)
+    if err != nil || index < 0 || index >= upload.chunks() {
+        uploadError(w, http.StatusBadRequest, "index out of range")
+        return
+    }
+
+    expected := upload.chunkLength(index)
+    if r.ContentLength >= 0 && r.ContentLength != expected {
+        uploadError(w, http.StatusBadRequest, "chunk size mismatch")
+        return
+    }
+
+    chunkFile := filepath.Join(chunkDir(uploadID), strconv.FormatInt(index, 10))
+    part, err := ioutil.TempFile(chunkDir(uploadID), "part-")
+    if err != nil {
+        util.LogError().Println("open chunk error:", err)
+        uploadError(w, http.StatusInternalServerError, "open chunk error")
+        return
+    }
+    defer os.Remove(part.Name())
+
+    written, err := io.Copy(part, io.LimitReader(r.Body, expected+1))
+    part.Close()
+    if err != nil {
+        uploadError(w, http.StatusBadRequest, "read chunk error")
+        return
+    }
+    if written != expected {
+        uploadError(w, http.StatusBadRequest, "chunk size mismatch")
+        return
+    }
+
+    if err := os.Rename(part.Name(), chunkFile); err != nil {
+        util.LogError().Println("save chunk error:", err)
+        uploadError(w, http.StatusInternalServerError, "save chunk error")
+        return
+    }
+
+    uploadSuccess(w, map[string]interface{}{"index": index, "offset": upload.offset(uploadID)})
+}
+
+//查询上传进度，offset 为从文件开头连续收到的字节数，received 为已收到的分块序号
+func chunkUploadStatus(w http.ResponseWriter, r *http.Request) {
+    if !chunkRequest(w, r, "GET") {
+        return
+    }
+
+    uploadID := r.URL.Query().Get("uploadID")
+    upload, ok := loadUpload(w, uploadID)
+    if !ok || !authorizeUpload(w, r, upload.Server, upload.UserID) {
+        return
+    }
+
+    received := []int64{}
+    for index := int64(0); index < upload.chunks(); index++ {
+        if upload.hasChunk(uploadID, index) {
+            received = append(received, index)
+        }
+    }
+
+    uploadSuccess(w, map[string]interface{}{
+        "uploadID":  uploadID,
+        "size":      upload.Size,
+        "chunkSize": upload.ChunkSize,
+        "chunks":    upload.chunks(),
+        "offset":    upload.offset(uploadID),
+        "received":  received,
+    })
+}
+
+//完成上传，合并所有分块后才向后端服务器登记文件，返回格式与单次上传相同
+func chunkUploadFinish(w http.ResponseWriter, r *http.Request) {
+    if !chunkRequest(w, r, "POST") {
+        return
+    }
+
+    uploadID := r.URL.Query().Get("uploadID")
+    upload, ok := loadUpload(w, uploadID)
+    if !ok || !authorizeUpload(w, r, upload.Server, upload.UserID) {
+        return
+    }
+
+    finishingMu.Lock()
+    if finishing[uploadID] {
+        finishingMu.Unlock()
+        uploadError(w, http.StatusConflict, "upload is finishing")
+        return
+    }
+    finishing[uploadID] = true
+    finishingMu.Unlock()
+
+    defer func() {
+        finishingMu.Lock()
+        delete(finishing, uploadID)
+        finishingMu.Unlock()
+    }()
+
+    if upload.offset(uploadID) != upload.Size {
+        uploadError(w, http.StatusConflict, "upload is incomplete")
+        return
+    }
+
+    // 创建上传后其他文件可能已经用完配额
+    if quotaExceeded(upload.Server, upload.UserID, upload.Size) {
+        uploadError(w, http.StatusRequestEntityTooLarge, "upload quota exceeded")
+        return
+    }
+
+    assembled := filepath.Join(chunkDir(uploadID), "file")
+    hash, err := upload.assemble(uploadID, assembled)
+    if err != nil {
+        util.LogError().Println("assemble upload error:", err)
+        os.Remove(assembled)
+        uploadError(w, http.StatusInternalServerError, "save file error")
+        return
+    }
+
+    // 扫描出错时保留分块，客户端可以稍后重新完成上传，发现病毒的上传随过期的分块一起删除
+    if !scanUpload(w, assembled, quarantineInfo{Server: upload.Server, UserID: upload.UserID, Gid: upload.Gid, Name: upload.Name, Size: upload.Size, Hash: hash}) {
+        os.Remove(assembled)
+        return
+    }
+
+    nowTime := util.GetUnixTime()
+    savePath := util.Config.UploadPath + upload.Server + "/" + util.GetYmdPath(nowTime)
+
+    fileID, err := registerUpload(upload.Server, upload.UserID, upload.Gid, upload.Name, savePath, upload.Size, nowTime)
+    if err != nil {
+        util.LogError().Println("Upload file info error:", err)
+        os.Remove(assembled)
+        uploadError(w, http.StatusInternalServerError, "Upload file info error")
+        return
+    }
+
+    key := uploadKey(upload.Server, upload.Name, fileID, util.Int642String(nowTime))
+    width, height, _ := imageSize(assembled)
+    duplicate, err := storeObject(assembled, hash, key)
+    if err != nil {
+        util.LogError().Println("save file error:", err)
+        os.Remove(assembled)
+        uploadError(w, http.StatusInternalServerError, "save file error")
+        return
+    }
+    os.RemoveAll(chunkDir(uploadID))
+
+    countUpload(upload.Server, upload.Size, duplicate)
+    recordUpload(util.UploadRecord{Server: upload.Server, FileID: fileID, UserID: upload.UserID, Key: key, Size: upload.Size, Time: nowTime})
+
+    writeUploadResult(w, nowTime, fileID, upload.Name, width, height)
+}
+
+func newUploadID() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+
+    return hex.EncodeToString(b), nil
+}
+
+func chunkDir(uploadID string) string {
+    return filepath.Join(util.Config.UploadPath, chunkDirName, uploadID)
+}
+
+//读取上传信息，上传不存在时返回404
+func loadUpload(w http.ResponseWriter, uploadID string) (chunkUpload, bool) {
+    var upload chunkUpload
+    if _, err := hex.DecodeString(uploadID); err != nil || len(uploadID) != 32 {
+        uploadError(w, http.StatusNotFound, "upload not found")
+        return upload, false
+    }
+
+    info, err := ioutil.ReadFile(filepath.Join(chunkDir(uploadID), chunkInfoFile))
+    if err != nil {
+        uploadError(w, http.StatusNotFound, "upload not found")
+        return upload, false
+    }
+
+    if err := json.Unmarshal(info, &upload); err != nil || upload.ChunkSize <= 0 {
+        util.LogError().Println("upload info error:", uploadID, err)
+        uploadError(w, http.StatusNotFound, "upload not found")
+        return upload, false
+    }
+
+    return upload, true
+}
+
+//分块数量
+func (upload chunkUpload) chunks() int64 {
+    return (upload.Size + upload.ChunkSize - 1) / upload.ChunkSize
+}
+
+//分块应有的大小，最后一块可能较小
+func (upload chunkUpload) chunkLength(index int64) int64 {
+    if index == upload.chunks()-1 {
+        return upload.Size - index*upload.ChunkSize
+    }
+
+    return upload.ChunkSize
+}
+
+func (upload chunkUpload) hasChunk(uploadID string, index int64) bool {
+    info, err := os.Stat(filepath.Join(chunkDir(uploadID), strconv.FormatInt(index, 10)))
+    return err == nil && info.Size() == upload.chunkLength(index)
+}
+
+//从文件开头连续收到的字节数
+func (upload chunkUpload) offset(uploadID string) int64 {
+    var offset int64
+    for index := int64(0); index < upload.chunks(); index++ {
+        if !upload.hasChunk(uploadID, index) {
+            break
+        }
+        offset += upload.chunkLength(index)
+    }
+
+    return offset
+}
+
+//按顺序合并分块，返回文件内容的sha256
+func (upload chunkUpload) assemble(uploadID, target string) (string, error) {
+    f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+
+    hash := sha256.New()
+    out := io.MultiWriter(f, hash)
+
+    var written int64
+    for index := int64(0); index < upload.chunks(); index++ {
+        chunk, err := os.Open(filepath.Join(chunkDir(uploadID), strconv.FormatInt(index, 10)))
+        if err != nil {
+            return "", err
+        }
+
+        n, err := io.Copy(out, chunk)
+        chunk.Close()
+        if err != nil {
+            return "", err
+        }
+        written += n
+    }
+
+    if written != upload.Size {
+        return "", util.Errorf("assembled %d bytes, want %d", written, upload.Size)
+    }
+
+    return hex.EncodeToString(hash.Sum(nil)), f.Close()
+}
+
+//删除长时间没有上传分块的未完成上传
+func removeExpiredUploads() {
+    root := filepath.Join(util.Config.UploadPath, chunkDirName)
+    dirs, err := ioutil.ReadDir(root)
+    if err != nil {
+        return
+    }
+
+    for _, dir := range dirs {
+        if !dir.IsDir() || time.Since(dir.ModTime()) < chunkUploadExpire {
+            continue
+        }
+
+        if err := os.RemoveAll(filepath.Join(root, dir.Name())); err != nil {
+            util.LogError().Println("remove expired upload error:", err)
+        }
+    }
+}
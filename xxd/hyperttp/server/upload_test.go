@@ -0,0 +1,223 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "xxd/api"
+    "xxd/api/apitest"
+    "xxd/util"
+)
+
+const (
+    testServerName   = "xuanxuan"
+    testBackendToken = "88888888888888888888888888888888"
+    testClientToken  = "99999999999999999999999999999999"
+)
+
+// 测试程序不调用 util.Init，使用内存存储和本地文件存储，不扫描上传的文件
+func TestMain(m *testing.M) {
+    util.DB, _ = util.OpenStore("memory", "")
+    util.UploadStorage, _ = util.OpenStorage(util.StorageConfig{Driver: "local"})
+    os.Exit(m.Run())
+}
+
+// 模拟后端服务器，记录uploadFile请求并返回文件ID 7
+func startTestUpload(t *testing.T) chan api.ParseData {
+    requests := make(chan api.ParseData, 4)
+    xxb := apitest.NewBackend(t, testBackendToken, func(request api.ParseData) api.ParseData {
+        requests <- request
+        return api.ParseData{"module": "chat", "method": "uploadFile", "result": "success", "data": "7"}
+    })
+
+    old, oldDefault := util.Config.RanzhiServer, util.GetDefaultServer()
+    util.SetRanzhi(map[string]util.RanzhiServer{
+        testServerName: {RanzhiAddr: xxb.URL, RanzhiToken: []byte(testBackendToken), RanzhiCrypto: util.CryptoGCM},
+    }, testServerName)
+    t.Cleanup(func() { util.SetRanzhi(old, oldDefault) })
+
+    oldPath, oldSize, oldLegacy, oldToken := util.Config.UploadPath, util.Config.UploadFileSize, util.Config.LegacyToken, util.Token
+    util.Config.UploadPath = t.TempDir() + "/"
+    util.Config.UploadFileSize = 4 * minChunkSize
+    util.Config.LegacyToken, util.Token = true, []byte(testClientToken)
+    t.Cleanup(func() {
+        util.Config.UploadPath, util.Config.UploadFileSize = oldPath, oldSize
+        util.Config.LegacyToken, util.Token = oldLegacy, oldToken
+    })
+
+    return requests
+}
+
+func uploadRequest(t *testing.T, handler http.HandlerFunc, method, target string, body []byte) (int, map[string]interface{}) {
+    r := httptest.NewRequest(method, target, bytes.NewReader(body))
+    r.Header.Set("Authorization", testClientToken)
+    r.Header.Set("ServerName", testServerName)
+    if method == "POST" {
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    }
+
+    w := httptest.NewRecorder()
+    handler(w, r)
+
+    var result map[string]interface{}
+    json.Unmarshal(w.Body.Bytes(), &result)
+    data, _ := result["data"].(map[string]interface{})
+    return w.Code, data
+}
+
+func initUpload(t *testing.T, size int) string {
+    form := url.Values{"fileName": {"design.psd"}, "size": {util.Int2String(size)}, "gid": {"1&2"}, "userID": {"1"}, "chunkSize": {util.Int2String(minChunkSize)}}
+    code, data := uploadRequest(t, chunkUploadInit, "POST", uploadInit, []byte(form.Encode()))
+    if code != http.StatusOK {
+        t.Fatalf("init returned %d", code)
+    }
+
+    return data["uploadID"].(string)
+}
+
+func putChunk(t *testing.T, uploadID string, index int, chunk []byte) int {
+    code, _ := uploadRequest(t, chunkUploadPut, "PUT", uploadChunk+"?uploadID="+uploadID+"&index="+util.Int2String(index), chunk)
+    return code
+}
+
+func TestChunkUpload(t *testing.T) {
+    requests := startTestUpload(t)
+
+    content := bytes.Repeat([]byte("0123456789"), (2*minChunkSize+100)/10)
+    uploadID := initUpload(t, len(content))
+
+    // 分块可以乱序上传，offset只计算从开头连续收到的部分
+    if code := putChunk(t, uploadID, 2, content[2*minChunkSize:]); code != http.StatusOK {
+        t.Fatalf("last chunk returned %d", code)
+    }
+    if code := putChunk(t, uploadID, 0, content[:minChunkSize]); code != http.StatusOK {
+        t.Fatalf("first chunk returned %d", code)
+    }
+
+    code, status := uploadRequest(t, chunkUploadStatus, "GET", uploadStatus+"?uploadID="+uploadID, nil)
+    if code != http.StatusOK || status["offset"] != float64(minChunkSize) {
+        t.Fatalf("status returned %d %v", code, status)
+    }
+
+    if code, _ := uploadRequest(t, chunkUploadFinish, "POST", uploadFinish+"?uploadID="+uploadID, nil); code != http.StatusConflict {
+        t.Fatalf("incomplete upload finished with %d", code)
+    }
+    select {
+    case request := <-requests:
+        t.Fatalf("backend was called before the file was whole: %v", request)
+    default:
+    }
+
+    if code := putChunk(t, uploadID, 1, content[minChunkSize:2*minChunkSize]); code != http.StatusOK {
+        t.Fatalf("second chunk returned %d", code)
+    }
+
+    code, result := uploadRequest(t, chunkUploadFinish, "POST", uploadFinish+"?uploadID="+uploadID, nil)
+    if code != http.StatusOK || result["id"] != float64(7) || result["name"] != "design.psd" {
+        t.Fatalf("finish returned %d %v", code, result)
+    }
+
+    request := <-requests
+    params := request["params"].([]interface{})
+    if request.UserID() != 1 || params[0] != "design.psd" || params[2] != float64(len(content)) || params[4] != "1&2" {
+        t.Errorf("backend got %v", request)
+    }
+
+    fileTime := util.Int642String(int64(result["time"].(float64)))
+    saveFile := util.Config.UploadPath + testServerName + "/" + util.GetYmdPath(int64(result["time"].(float64))) + util.GetMD5("design.psd"+"7"+fileTime)
+    saved, err := ioutil.ReadFile(saveFile)
+    if err != nil || !bytes.Equal(saved, content) {
+        t.Errorf("saved file differs from the upload: %v", err)
+    }
+
+    if _, err := os.Stat(chunkDir(uploadID)); !os.IsNotExist(err) {
+        t.Error("chunks were not removed")
+    }
+}
+
+func TestChunkUploadRejected(t *testing.T) {
+    startTestUpload(t)
+
+    form := url.Values{"fileName": {"big.iso"}, "size": {util.Int2String(4*minChunkSize + 1)}, "gid": {"1&2"}, "userID": {"1"}}
+    if code, _ := uploadRequest(t, chunkUploadInit, "POST", uploadInit, []byte(form.Encode())); code != http.StatusBadRequest {
+        t.Errorf("too large file returned %d", code)
+    }
+
+    uploadID := initUpload(t, minChunkSize+10)
+    if code := putChunk(t, uploadID, 0, []byte("short")); code != http.StatusBadRequest {
+        t.Errorf("short chunk returned %d", code)
+    }
+    if code := putChunk(t, uploadID, 2, make([]byte, 10)); code != http.StatusBadRequest {
+        t.Errorf("chunk out of range returned %d", code)
+    }
+    if code := putChunk(t, strings.Repeat("0", 32), 0, make([]byte, minChunkSize)); code != http.StatusNotFound {
+        t.Errorf("unknown upload returned %d", code)
+    }
+    if code := putChunk(t, "../"+uploadID, 0, make([]byte, minChunkSize)); code != http.StatusNotFound {
+        t.Errorf("bad upload id returned %d", code)
+    }
+
+    r := httptest.NewRequest("GET", uploadStatus+"?uploadID="+uploadID, nil)
+    w := httptest.NewRecorder()
+    chunkUploadStatus(w, r)
+    if w.Code != http.StatusUnauthorized {
+        t.Errorf("request without token returned %d", w.Code)
+    }
+
+    // 长时间没有活动的上传被删除
+    old := filepath.Join(util.Config.UploadPath, chunkDirName, uploadID)
+    expired := time.Now().Add(-chunkUploadExpire - time.Minute)
+    os.Chtimes(old, expired, expired)
+    initUpload(t, 10)
+    if _, err := os.Stat(old); !os.IsNotExist(err) {
+        t.Error("expired upload was not removed")
+    }
+}
+
+func TestUploadSessionKeyUser(t *testing.T) {
+    startTestUpload(t)
+    uploadID := initUpload(t, 10)
+    util.Config.LegacyToken = false
+
+    keyID, key, _ := api.IssueSessionKey()
+    api.ClaimSessionKey(keyID)
+    api.BindSessionKey(keyID, testServerName, 2)
+    defer api.ReleaseSessionKey(keyID)
+
+    request := func(handler http.HandlerFunc, method, target, body string) int {
+        r := httptest.NewRequest(method, target, strings.NewReader(body))
+        r.Header.Set("Authorization", string(key))
+        r.Header.Set("ServerName", testServerName)
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        w := httptest.NewRecorder()
+        handler(w, r)
+        return w.Code
+    }
+
+    // 会话密钥只能以登录的用户身份上传
+    form := url.Values{"fileName": {"a.txt"}, "size": {"10"}, "gid": {"1&2"}}
+    form.Set("userID", "2")
+    if code := request(chunkUploadInit, "POST", uploadInit, form.Encode()); code != http.StatusOK {
+        t.Errorf("init as the logged in user returned %d", code)
+    }
+    form.Set("userID", "1")
+    if code := request(chunkUploadInit, "POST", uploadInit, form.Encode()); code != http.StatusUnauthorized {
+        t.Errorf("init as another user returned %d", code)
+    }
+
+    // 其他用户创建的上传
+    if code := request(chunkUploadPut, "PUT", uploadChunk+"?uploadID="+uploadID+"&index=0", "0123456789"); code != http.StatusUnauthorized {
+        t.Errorf("chunk of another user's upload returned %d", code)
+    }
+    if code := request(chunkUploadStatus, "GET", uploadStatus+"?uploadID="+uploadID, ""); code != http.StatusUnauthorized {
+        t.Errorf("status of another user's upload returned %d", code)
+    }
+}
@@ -10,6 +10,12 @@
 package main
 
 import (
+    "context"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+    "xxd/api"
     "xxd/crontask"
     "xxd/hyperttp/server"
     "xxd/util"
@@ -17,6 +23,22 @@ import (
 )
 
 func main() {
+    util.Init()
+
+    if util.MigrateUploads {
+        if err := server.MigrateUploads(); err != nil {
+            util.Exit("Warning: migrate uploads error: " + err.Error())
+        }
+        util.DB.Close()
+        return
+    }
+
+    if util.RetentionReport {
+        server.RetentionReport()
+        util.DB.Close()
+        return
+    }
+
     crontask.CronTask()
 
     go server.InitHttp()
@@ -25,9 +47,57 @@ func main() {
     exitServer()
 }
 
+//收到 SIGHUP 时重新加载配置，收到 SIGINT 或 SIGTERM 后平滑关闭服务
 func exitServer() {
-    for util.Run && util.GetNumGoroutine() > 2 {
-        //util.Println("sleep ...")
-        util.Sleep(3)
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+    var sig os.Signal
+    for sig = range signals {
+        if sig != syscall.SIGHUP {
+            break
+        }
+
+        reloadConfig()
+    }
+
+    // 再次收到信号时直接退出
+    signal.Stop(signals)
+
+    util.Printf("Receive signal %s, shutting down ...\n", sig)
+    util.LogInfo().Printf("receive signal %s, shutting down, timeout %d seconds\n", sig, util.Config.ShutdownTimeout)
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Duration(util.Config.ShutdownTimeout)*time.Second)
+    defer cancel()
+
+    if err := server.Shutdown(ctx); err != nil {
+        util.LogError().Println("http server shutdown error:", err)
+    }
+
+    if err := wsocket.Shutdown(ctx); err != nil {
+        util.LogError().Println("websocket server shutdown error:", err)
     }
+
+    util.Run = false
+    util.DB.Close()
+    util.LogInfo().Println("xxd stopped")
+}
+
+//重新加载后端服务器配置
+func reloadConfig() {
+    change, err := util.ReloadConfig()
+    if err != nil {
+        util.LogError().Println("reload config error:", err)
+        return
+    }
+
+    util.LogInfo().Printf("reload config, added:%v removed:%v changed:%v default changed:%t\n", change.Added, change.Removed, change.Changed, change.DefaultChanged)
+
+    for _, serverName := range change.Added {
+        if err := api.StartServer(serverName); err != nil {
+            util.LogError().Printf("start xxd to new server [%s] error: %s\n", serverName, err)
+        }
+    }
+
+    wsocket.Reload(change)
 }
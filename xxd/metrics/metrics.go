@@ -0,0 +1,331 @@
+/**
+ * The metrics file of metrics current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     metrics
+ * @link        http://www.zentao.net
+ */
+package metrics
+
+import (
+    "bufio"
+    "fmt"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// 以 Prometheus 文本格式输出的统计数据，不依赖 xxd 的其他包
+type metric interface {
+    describe() *desc
+    write(w *bufio.Writer)
+}
+
+type desc struct {
+    name   string
+    help   string
+    typ    string
+    labels []string
+}
+
+// 一组标签值及对应的数值，GaugeFunc 使用
+type Sample struct {
+    Labels []string
+    Value  float64
+}
+
+type Registry struct {
+    mu      sync.Mutex
+    metrics map[string]metric
+}
+
+var Default = NewRegistry()
+
+// 默认的延迟分布，单位秒
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func NewRegistry() *Registry {
+    return &Registry{metrics: make(map[string]metric)}
+}
+
+func (r *Registry) register(m metric) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    name := m.describe().name
+    if _, ok := r.metrics[name]; ok {
+        panic("metrics: duplicate metric " + name)
+    }
+
+    r.metrics[name] = m
+}
+
+//输出所有统计数据，按名称排序
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+    r.mu.Lock()
+    names := make([]string, 0, len(r.metrics))
+    for name := range r.metrics {
+        names = append(names, name)
+    }
+    list := make([]metric, 0, len(names))
+    sort.Strings(names)
+    for _, name := range names {
+        list = append(list, r.metrics[name])
+    }
+    r.mu.Unlock()
+
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    buf := bufio.NewWriter(w)
+    for _, m := range list {
+        d := m.describe()
+        fmt.Fprintf(buf, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+        fmt.Fprintf(buf, "# TYPE %s %s\n", d.name, d.typ)
+        m.write(buf)
+    }
+    buf.Flush()
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+    Default.ServeHTTP(w, r)
+}
+
+// 只增不减的计数
+type Counter struct {
+    desc
+    mu     sync.Mutex
+    values map[string]*counterValue
+}
+
+type counterValue struct {
+    labels []string
+    value  float64
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+    c := &Counter{desc: desc{name, help, "counter", labels}, values: make(map[string]*counterValue)}
+    r.register(c)
+    return c
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+    return Default.NewCounter(name, help, labels...)
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+    c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+    if v < 0 {
+        return
+    }
+
+    key := labelKey(labelValues)
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    cv, ok := c.values[key]
+    if !ok {
+        cv = &counterValue{labels: append([]string{}, labelValues...)}
+        c.values[key] = cv
+    }
+    cv.value += v
+}
+
+//读取当前值，测试使用
+func (c *Counter) Value(labelValues ...string) float64 {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if cv, ok := c.values[labelKey(labelValues)]; ok {
+        return cv.value
+    }
+
+    return 0
+}
+
+func (c *Counter) describe() *desc {
+    return &c.desc
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    for _, key := range sortedKeys(c.values) {
+        cv := c.values[key]
+        fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, cv.labels, "", ""), formatValue(cv.value))
+    }
+}
+
+// 延迟等数值的分布
+type Histogram struct {
+    desc
+    buckets []float64
+    mu      sync.Mutex
+    series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+    labels []string
+    counts []uint64
+    sum    float64
+    count  uint64
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+    sorted := append([]float64{}, buckets...)
+    sort.Float64s(sorted)
+
+    h := &Histogram{desc: desc{name, help, "histogram", labels}, buckets: sorted, series: make(map[string]*histogramSeries)}
+    r.register(h)
+    return h
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+    return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+    key := labelKey(labelValues)
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    s, ok := h.series[key]
+    if !ok {
+        s = &histogramSeries{labels: append([]string{}, labelValues...), counts: make([]uint64, len(h.buckets))}
+        h.series[key] = s
+    }
+
+    for i, bound := range h.buckets {
+        if v <= bound {
+            s.counts[i]++
+        }
+    }
+    s.sum += v
+    s.count++
+}
+
+func (h *Histogram) describe() *desc {
+    return &h.desc
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    for _, key := range sortedKeys(h.series) {
+        s := h.series[key]
+        for i, bound := range h.buckets {
+            fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", formatValue(bound)), s.counts[i])
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", "+Inf"), s.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels, "", ""), formatValue(s.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels, "", ""), s.count)
+    }
+}
+
+// 输出时调用函数取值的 gauge，用于在线人数、队列长度等状态
+type GaugeFunc struct {
+    desc
+    fn func() []Sample
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, fn func() []Sample) *GaugeFunc {
+    g := &GaugeFunc{desc: desc{name, help, "gauge", labels}, fn: fn}
+    r.register(g)
+    return g
+}
+
+func NewGaugeFunc(name, help string, labels []string, fn func() []Sample) *GaugeFunc {
+    return Default.NewGaugeFunc(name, help, labels, fn)
+}
+
+func (g *GaugeFunc) describe() *desc {
+    return &g.desc
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+    samples := g.fn()
+    sort.Slice(samples, func(i, j int) bool {
+        return labelKey(samples[i].Labels) < labelKey(samples[j].Labels)
+    })
+
+    for _, s := range samples {
+        fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, s.Labels, "", ""), formatValue(s.Value))
+    }
+}
+
+func labelKey(labelValues []string) string {
+    return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys(m interface{}) []string {
+    var keys []string
+    switch values := m.(type) {
+    case map[string]*counterValue:
+        for key := range values {
+            keys = append(keys, key)
+        }
+    case map[string]*histogramSeries:
+        for key := range values {
+            keys = append(keys, key)
+        }
+    }
+
+    sort.Strings(keys)
+    return keys
+}
+
+//格式化标签，extraName 不为空时追加一个标签(直方图的le)
+func formatLabels(names, values []string, extraName, extraValue string) string {
+    var pairs []string
+    for i, name := range names {
+        value := ""
+        if i < len(values) {
+            value = values[i]
+        }
+        pairs = append(pairs, name+`="`+escapeLabel(value)+`"`)
+    }
+
+    if extraName != "" {
+        pairs = append(pairs, extraName+`="`+extraValue+`"`)
+    }
+
+    if len(pairs) == 0 {
+        return ""
+    }
+
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+    switch {
+    case math.IsInf(v, 1):
+        return "+Inf"
+    case math.IsInf(v, -1):
+        return "-Inf"
+    case math.IsNaN(v):
+        return "NaN"
+    }
+
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+    return labelReplacer.Replace(s)
+}
+
+func escapeHelp(s string) string {
+    return helpReplacer.Replace(s)
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+    "io/ioutil"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+    server := httptest.NewServer(r)
+    defer server.Close()
+
+    resp, err := server.Client().Get(server.URL + "/metrics")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+
+    if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+        t.Errorf("content type %q", contentType)
+    }
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return string(body)
+}
+
+func TestExposition(t *testing.T) {
+    r := NewRegistry()
+
+    counter := r.NewCounter("xxd_test_total", "Test counter.", "backend")
+    counter.Inc("xuanxuan")
+    counter.Add(2, "xuanxuan")
+    counter.Inc(`quo"te`)
+
+    histogram := r.NewHistogram("xxd_test_seconds", "Test histogram.", []float64{0.1, 1}, "addr")
+    histogram.Observe(0.05, "a")
+    histogram.Observe(0.5, "a")
+    histogram.Observe(5, "a")
+
+    r.NewGaugeFunc("xxd_test_online", "Test gauge.", []string{"backend"}, func() []Sample {
+        return []Sample{{Labels: []string{"b"}, Value: 2}, {Labels: []string{"a"}, Value: 1}}
+    })
+
+    want := `# HELP xxd_test_online Test gauge.
+# TYPE xxd_test_online gauge
+xxd_test_online{backend="a"} 1
+xxd_test_online{backend="b"} 2
+# HELP xxd_test_seconds Test histogram.
+# TYPE xxd_test_seconds histogram
+xxd_test_seconds_bucket{addr="a",le="0.1"} 1
+xxd_test_seconds_bucket{addr="a",le="1"} 2
+xxd_test_seconds_bucket{addr="a",le="+Inf"} 3
+xxd_test_seconds_sum{addr="a"} 5.55
+xxd_test_seconds_count{addr="a"} 3
+# HELP xxd_test_total Test counter.
+# TYPE xxd_test_total counter
+xxd_test_total{backend="quo\"te"} 1
+xxd_test_total{backend="xuanxuan"} 3
+`
+
+    if got := scrape(t, r); got != want {
+        t.Errorf("exposition mismatch\ngot:\n%s\nwant:\n%s", got, want)
+    }
+}
+
+func TestDuplicateMetric(t *testing.T) {
+    r := NewRegistry()
+    r.NewCounter("xxd_dup_total", "first")
+
+    defer func() {
+        if recover() == nil {
+            t.Error("duplicate metric name did not panic")
+        }
+    }()
+    r.NewCounter("xxd_dup_total", "second")
+}
+
+func TestCounterIgnoresNegative(t *testing.T) {
+    r := NewRegistry()
+    counter := r.NewCounter("xxd_neg_total", "Negative.")
+    counter.Add(-1)
+    if counter.Value() != 0 {
+        t.Errorf("counter value %v after negative add", counter.Value())
+    }
+}
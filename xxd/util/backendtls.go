@@ -0,0 +1,143 @@
+/**
+ * The backendtls file of util current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     util
+ * @link        http://www.zentao.net
+ */
+package util
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// 通过https请求后端服务器时的证书设置
+type BackendTLS struct {
+    Verify bool     // 是否校验后端服务器的证书
+    CA     string   // CA证书文件，为空时使用系统的CA证书
+    Cert   string   // 双向认证时xxd使用的证书和私钥文件
+    Key    string
+    Pins   []string // 后端服务器证书公钥(SPKI)的sha256，base64编码，设置后校验通过的证书链中必须有一个公钥匹配，不校验证书时服务器证书的公钥必须匹配
+}
+
+var DefaultBackendTLS = BackendTLS{Verify: true}
+
+//解析[backend.服务器名称]段中的证书设置
+func parseBackendTLS(options map[string]string) (BackendTLS, error) {
+    settings := DefaultBackendTLS
+    settings.Verify = options["verify"] != "0"
+    settings.CA = configFilePath(options["ca"])
+    settings.Cert = configFilePath(options["cert"])
+    settings.Key = configFilePath(options["key"])
+
+    for _, pin := range strings.Split(options["pins"], ",") {
+        pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+        if pin == "" {
+            continue
+        }
+
+        if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+            return settings, Errorf("pin %s is not a base64 sha256 hash", pin)
+        }
+        settings.Pins = append(settings.Pins, pin)
+    }
+
+    if (settings.Cert == "") != (settings.Key == "") {
+        return settings, Errorf("%s", "cert and key must be set together")
+    }
+
+    // 启动和重新加载配置时检查证书文件
+    _, err := settings.ClientConfig()
+    return settings, err
+}
+
+//相对路径相对于xxd的运行目录
+func configFilePath(path string) string {
+    if path == "" || filepath.IsAbs(path) {
+        return path
+    }
+
+    dir, _ := os.Getwd()
+    return dir + "/" + path
+}
+
+//创建请求后端服务器使用的tls配置
+func (t BackendTLS) ClientConfig() (*tls.Config, error) {
+    config := &tls.Config{InsecureSkipVerify: !t.Verify}
+
+    if t.CA != "" {
+        data, err := ioutil.ReadFile(t.CA)
+        if err != nil {
+            return nil, err
+        }
+
+        config.RootCAs = x509.NewCertPool()
+        if !config.RootCAs.AppendCertsFromPEM(data) {
+            return nil, Errorf("no certificate found in %s", t.CA)
+        }
+    }
+
+    if t.Cert != "" {
+        cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+        if err != nil {
+            return nil, err
+        }
+        config.Certificates = []tls.Certificate{cert}
+    }
+
+    if len(t.Pins) > 0 {
+        var pins [][]byte
+        for _, pin := range t.Pins {
+            hash, _ := base64.StdEncoding.DecodeString(pin)
+            pins = append(pins, hash)
+        }
+
+        // 不校验证书时也会调用。服务器发送的其他证书没有经过校验，只检查校验通过的证书链，
+        // 不校验证书时只检查服务器自己的证书
+        config.VerifyConnection = func(state tls.ConnectionState) error {
+            chains := state.VerifiedChains
+            if !t.Verify && len(state.PeerCertificates) > 0 {
+                chains = [][]*x509.Certificate{state.PeerCertificates[:1]}
+            }
+
+            for _, chain := range chains {
+                for _, cert := range chain {
+                    hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+                    for _, pin := range pins {
+                        if bytes.Equal(hash[:], pin) {
+                            return nil
+                        }
+                    }
+                }
+            }
+
+            return Errorf("%s", "backend certificate does not match any pin")
+        }
+    }
+
+    return config, nil
+}
+
+//根据地址获取后端服务器的证书设置，不是配置中的服务器时使用默认设置
+func GetBackendTLS(addr string) BackendTLS {
+    configMu.RLock()
+    defer configMu.RUnlock()
+
+    for _, info := range Config.RanzhiServer {
+        if info.RanzhiAddr == addr {
+            return info.RanzhiTLS
+        }
+    }
+
+    return DefaultBackendTLS
+}
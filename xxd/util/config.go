@@ -14,14 +14,48 @@ import (
     "log"
     "strings"
     "os"
+    "path/filepath"
+    "sync"
+    "time"
 )
 
 type RanzhiServer struct {
-    RanzhiAddr  string
-    RanzhiToken []byte
-    //RanzhiEncrypt bool
+    RanzhiAddr   string
+    RanzhiToken  []byte
+    RanzhiCrypto string // 与后端服务器通信的加密协议 cbc 或 gcm
+    RanzhiTLS    BackendTLS
+    Upload       UploadPolicy
+    LoginPolicy  string // 同一用户同时登录多个客户端的策略，LoginSingle、LoginPerDevice 或 LoginUnlimited
 }
 
+// 同一用户同时登录多个客户端的策略
+const (
+    LoginSingle    = "single"          // 只允许一个客户端，新的登录挤掉旧的客户端
+    LoginPerDevice = "per-device-type" // 每种设备(桌面端、网页端、移动端)一个客户端
+    LoginUnlimited = "unlimited"       // 不限制
+)
+
+// 上传文件的配额和保留策略，大小单位为字节，0为不限制
+type UploadPolicy struct {
+    Quota         int64 // 该后端服务器上传文件的总大小
+    UserQuota     int64 // 每个用户上传文件的总大小
+    RetentionDays int64 // 删除上传时间超过该天数的文件
+    RetentionSize int64 // 总大小超过该值时从最早上传的文件开始删除
+}
+
+// 上传文件保留策略的执行方式
+const (
+    RetentionOff    = "0"      // 不执行
+    RetentionDryRun = "dryrun" // 只在日志中记录会删除的文件
+    RetentionOn     = "1"      // 删除文件并通知后端服务器
+)
+
+// 加密协议版本
+const (
+    CryptoCBC = "cbc" // AES-CBC，兼容旧版本的客户端和后端服务器
+    CryptoGCM = "gcm" // AES-GCM，每条消息使用随机nonce并校验完整性
+)
+
 type ConfigIni struct {
     Ip         string
     ChatPort   string
@@ -33,19 +67,105 @@ type ConfigIni struct {
 
     MaxOnlineUser int64
 
+    // 平滑关闭的最长等待时间，单位秒
+    ShutdownTimeout int64
+
+    // 请求后端服务器的超时时间，单位秒，包括重试
+    BackendTimeout int64
+
     // multiSite or singleSite
     SiteType      string
     DefaultServer string
     RanzhiServer  map[string]RanzhiServer
 
+    // 是否允许客户端使用旧的 AES-CBC 协议
+    LegacyCrypto bool
+
+    // 是否允许客户端使用所有人共用的 Token
+    LegacyToken bool
+    // 会话密钥签发后需要在该时间内建立连接，单位秒
+    SessionKeyTTL int64
+    // 会话密钥轮换周期，单位秒，0 为不轮换
+    SessionKeyRotate int64
+
+    // 下载链接的签名密钥，为空时每次启动随机生成，集群的各节点需要配置相同的值
+    DownloadSecret string
+    // 下载链接的有效时间，单位秒
+    DownloadTTL int64
+    // 是否允许客户端使用旧的 sid=md5(session+fileName) 下载链接
+    LegacyDownload bool
+    // 旧的下载链接使用的文件会话的有效时间，单位秒，客户端连接期间会自动延长
+    FileSessionTTL int64
+
+    // 启用消息确认的客户端每个用户每种设备最多保留的未确认消息数，0 为不启用消息确认
+    AckQueueSize int64
+    // 客户端断开后保留未确认消息的时间，单位秒，在该时间内重新连接时重发
+    AckWindow int64
+
+    // 访问 /metrics 时需要提交的 token，为空时不验证
+    MetricsToken string
+
+    // 管理接口 /admin/ 需要提交的 token，为空时不开启管理接口
+    AdminToken string
+
+    // 第三方系统通过 /webhook 发送消息的集成，map[名称]
+    Webhooks map[string]Webhook
+
+    // 集群模式，ClusterListen 为空时不开启
+    ClusterNode   string
+    ClusterListen string
+    ClusterPeers  []string
+    ClusterToken  string
+
+    // 离线用户、发送失败消息和文件会话的存储，sqlite、file或memory
+    DBDriver string
+    DBPath   string
+
+    // 上传文件的存储，local 或 s3
+    Storage StorageConfig
+
+    // 上传文件保留策略的执行方式，RetentionOff、RetentionDryRun 或 RetentionOn
+    Retention string
+
+    // 上传文件的扫描，Driver为空时不扫描
+    Scanner ScannerConfig
+
     LogPath string
     CrtPath string
 }
 
+// 第三方系统的集成，消息以 UserID 的身份发送
+type Webhook struct {
+    Secret string // 签名使用的密钥
+    UserID int64
+    Server string // 只允许发送到该后端服务器，为空时不限制
+}
+
+// 配置重新加载后后端服务器的变化
+type BackendChange struct {
+    Added          []string
+    Removed        []string
+    Changed        []string // 地址、token或加密协议发生变化
+    DefaultChanged bool
+}
+
 const configPath = "config/xxd.conf"
 
+const defaultShutdownTimeout int64 = 30
+const defaultBackendTimeout int64 = 10
+const defaultSessionKeyTTL int64 = 300
+const defaultSessionKeyRotate int64 = 3600
+const defaultDownloadTTL int64 = 3600
+const defaultFileSessionTTL int64 = 86400
+const defaultAckQueueSize int64 = 1000
+const defaultAckWindow int64 = 300
+const defaultScanTimeout int64 = 60
+
 var Config = ConfigIni{SiteType: "singleSite", RanzhiServer: make(map[string]RanzhiServer)}
 
+// 保护 RanzhiServer、DefaultServer、SiteType，重新加载配置时会被修改
+var configMu sync.RWMutex
+
 func init() {
     dir, _ := os.Getwd()
     data, err := goconfig.LoadConfigFile(dir + "/" + configPath)
@@ -61,11 +181,26 @@ func init() {
 
         Config.SiteType = "singleSite"
         Config.DefaultServer = "xuanxuan"
-        Config.RanzhiServer["xuanxuan"] = RanzhiServer{"serverInfo", []byte("serverInfo")}
+        Config.RanzhiServer["xuanxuan"] = RanzhiServer{"serverInfo", []byte("serverInfo"), CryptoCBC, DefaultBackendTLS, UploadPolicy{}, LoginSingle}
+        Config.LegacyCrypto = true
+        Config.LegacyToken = true
+        Config.SessionKeyTTL = defaultSessionKeyTTL
+        Config.SessionKeyRotate = defaultSessionKeyRotate
+        Config.DownloadTTL = defaultDownloadTTL
+        Config.LegacyDownload = true
+        Config.FileSessionTTL = defaultFileSessionTTL
+        Config.AckQueueSize = defaultAckQueueSize
+        Config.AckWindow = defaultAckWindow
 
         Config.LogPath = dir + "/log/"
         Config.CrtPath = dir + "/certificate/"
         Config.MaxOnlineUser = 0
+        Config.ShutdownTimeout = defaultShutdownTimeout
+        Config.BackendTimeout = defaultBackendTimeout
+        Config.DBDriver, Config.DBPath = defaultDatabase(dir)
+        Config.Storage = StorageConfig{Driver: "local"}
+        Config.Retention = RetentionOff
+        Config.Scanner = ScannerConfig{Timeout: time.Duration(defaultScanTimeout) * time.Second}
 
         log.Println("config init error，use default conf!")
         log.Println(Config)
@@ -82,6 +217,20 @@ func init() {
     getCrtPath(data)
     getUploadFileSize(data)
     getMaxOnlineUser(data)
+    getShutdownTimeout(data)
+    Config.BackendTimeout = getSeconds(data, "backendTimeout", defaultBackendTimeout)
+    getLegacyCrypto(data)
+    getSessionKey(data)
+    getDownload(data)
+    getAck(data)
+    Config.MetricsToken, _ = data.GetValue("server", "metricsToken")
+    Config.AdminToken, _ = data.GetValue("server", "adminToken")
+    getCluster(data)
+    getDatabase(data)
+    getStorage(data)
+    getRetention(data)
+    getScanner(data)
+    getWebhooks(data)
 }
 
 //获取配置文件IP
@@ -198,8 +347,99 @@ func getMaxOnlineUser(config *goconfig.ConfigFile) error {
     return err
 }
 
+//获取平滑关闭的超时时间
+func getShutdownTimeout(config *goconfig.ConfigFile) error {
+
+    Config.ShutdownTimeout = defaultShutdownTimeout
+
+    timeout, err := config.GetValue("server", "shutdownTimeout")
+    if err != nil {
+        log.Printf("config: get server shutdownTimeout error:%v, default %d seconds.", err, defaultShutdownTimeout)
+        return err
+    }
+
+    shutdownTimeout, err := String2Int64(timeout)
+    if err != nil || shutdownTimeout <= 0 {
+        log.Printf("config: server shutdownTimeout [%s] is invalid, default %d seconds.", timeout, defaultShutdownTimeout)
+        return err
+    }
+
+    Config.ShutdownTimeout = shutdownTimeout
+    return nil
+}
+
+//是否允许客户端使用旧的 AES-CBC 协议，默认允许
+func getLegacyCrypto(config *goconfig.ConfigFile) {
+    legacyCrypto, err := config.GetValue("server", "legacyCrypto")
+    Config.LegacyCrypto = err != nil || legacyCrypto != "0"
+}
+
+//获取会话密钥相关配置
+func getSessionKey(config *goconfig.ConfigFile) {
+    legacyToken, err := config.GetValue("server", "legacyToken")
+    Config.LegacyToken = err != nil || legacyToken != "0"
+
+    Config.SessionKeyTTL = getSeconds(config, "sessionKeyTTL", defaultSessionKeyTTL)
+    Config.SessionKeyRotate = getSeconds(config, "sessionKeyRotate", defaultSessionKeyRotate)
+}
+
+//获取下载链接相关配置，默认仍然允许旧的下载链接
+func getDownload(config *goconfig.ConfigFile) {
+    Config.DownloadSecret, _ = config.GetValue("server", "downloadSecret")
+    Config.DownloadTTL = getSeconds(config, "downloadTTL", defaultDownloadTTL)
+
+    legacyDownload, err := config.GetValue("server", "legacyDownload")
+    Config.LegacyDownload = err != nil || legacyDownload != "0"
+
+    Config.FileSessionTTL = getSeconds(config, "fileSessionTTL", defaultFileSessionTTL)
+    if Config.FileSessionTTL == 0 {
+        Config.FileSessionTTL = defaultFileSessionTTL
+    }
+}
+
+//获取消息确认相关配置，ackQueueSize为0时不启用
+func getAck(config *goconfig.ConfigFile) {
+    Config.AckQueueSize = defaultAckQueueSize
+    if value, err := config.GetValue("server", "ackQueueSize"); err == nil {
+        if size, err := String2Int64(value); err == nil && size >= 0 {
+            Config.AckQueueSize = size
+        } else {
+            log.Printf("config: server ackQueueSize [%s] is invalid, default %d.", value, defaultAckQueueSize)
+        }
+    }
+
+    Config.AckWindow = getSeconds(config, "ackWindow", defaultAckWindow)
+}
+
+//获取以秒为单位的配置，未配置或格式错误时使用默认值
+func getSeconds(config *goconfig.ConfigFile, key string, defaultValue int64) int64 {
+    value, err := config.GetValue("server", key)
+    if err != nil {
+        log.Printf("config: get server %s error:%v, default %d seconds.", key, err, defaultValue)
+        return defaultValue
+    }
+
+    seconds, err := String2Int64(value)
+    if err != nil || seconds < 0 {
+        log.Printf("config: server %s [%s] is invalid, default %d seconds.", key, value, defaultValue)
+        return defaultValue
+    }
+
+    return seconds
+}
+
 //获取服务器列表,conf中[ranzhi]段不能改名.
 func getRanzhi(config *goconfig.ConfigFile) {
+    ranzhiServer, defaultServer, err := parseRanzhi(config)
+    if err != nil {
+        log.Fatal("config: ", err)
+    }
+
+    SetRanzhi(ranzhiServer, defaultServer)
+}
+
+//解析后端服务器列表
+func parseRanzhi(config *goconfig.ConfigFile) (map[string]RanzhiServer, string, error) {
     var section = "backend"
     var keyList []string
     keyList = config.GetKeyList(section)
@@ -210,28 +450,209 @@ func getRanzhi(config *goconfig.ConfigFile) {
         keyList = config.GetKeyList(section)
     }
 
-    Config.DefaultServer = ""
-    if len(keyList) > 1 {
-        Config.SiteType = "multiSite"
-    }
-
+    defaultServer := ""
+    ranzhiServers := make(map[string]RanzhiServer)
     for _, ranzhiName := range keyList {
         ranzhiServer, err := config.GetValue(section, ranzhiName)
         if err != nil {
-            log.Fatal("config: get backend server error,", err)
+            return nil, "", Errorf("get backend server error, %v", err)
         }
 
         serverInfo := strings.Split(ranzhiServer, ",")
         //逗号前面是地址，后面是token，token长度固定为32
         if len(serverInfo) < 2 || len(serverInfo[1]) != 32 {
-            log.Fatal("config: backend server config error")
+            return nil, "", Errorf("backend server %s config error", ranzhiName)
         }
 
         if len(serverInfo) >= 3 && serverInfo[2] == "default" {
-            Config.DefaultServer = ranzhiName
+            defaultServer = ranzhiName
+        }
+
+        //可选的[backend.服务器名称]段，配置该服务器的其他参数
+        //使用GetSection读取，避免GetValue在子段中找不到时回退到[backend]段
+        options, _ := config.GetSection(section + "." + ranzhiName)
+        crypto := options["crypto"]
+        if crypto == "" {
+            crypto = CryptoCBC
+        }
+
+        if crypto != CryptoCBC && crypto != CryptoGCM {
+            return nil, "", Errorf("backend server %s crypto %s not supported", ranzhiName, crypto)
+        }
+
+        tlsSettings, err := parseBackendTLS(options)
+        if err != nil {
+            return nil, "", Errorf("backend server %s tls config error, %v", ranzhiName, err)
+        }
+
+        uploadPolicy, err := parseUploadPolicy(options)
+        if err != nil {
+            return nil, "", Errorf("backend server %s upload config error, %v", ranzhiName, err)
+        }
+
+        loginPolicy := options["loginPolicy"]
+        switch loginPolicy {
+        case "":
+            loginPolicy = LoginSingle
+        case LoginSingle, LoginPerDevice, LoginUnlimited:
+        default:
+            return nil, "", Errorf("backend server %s login policy %s not supported", ranzhiName, loginPolicy)
+        }
+
+        ranzhiServers[ranzhiName] = RanzhiServer{serverInfo[0], []byte(serverInfo[1]), crypto, tlsSettings, uploadPolicy, loginPolicy}
+    }
+
+    return ranzhiServers, defaultServer, nil
+}
+
+//设置后端服务器列表和默认服务器
+func SetRanzhi(ranzhiServers map[string]RanzhiServer, defaultServer string) {
+    configMu.Lock()
+    defer configMu.Unlock()
+
+    Config.RanzhiServer = ranzhiServers
+    Config.DefaultServer = defaultServer
+    Config.SiteType = "singleSite"
+    if len(ranzhiServers) > 1 {
+        Config.SiteType = "multiSite"
+    }
+}
+
+//重新读取配置文件中的后端服务器列表，返回新增、删除和修改过的服务器
+func ReloadConfig() (BackendChange, error) {
+    var change BackendChange
+
+    dir, _ := os.Getwd()
+    data, err := goconfig.LoadConfigFile(dir + "/" + configPath)
+    if err != nil {
+        return change, err
+    }
+
+    ranzhiServers, defaultServer, err := parseRanzhi(data)
+    if err != nil {
+        return change, err
+    }
+
+    if len(ranzhiServers) == 0 {
+        return change, Errorf("%s", "no backend server in config")
+    }
+
+    configMu.RLock()
+    for name, info := range ranzhiServers {
+        old, ok := Config.RanzhiServer[name]
+        if !ok {
+            change.Added = append(change.Added, name)
+            continue
+        }
+
+        if old.RanzhiAddr != info.RanzhiAddr || string(old.RanzhiToken) != string(info.RanzhiToken) || old.RanzhiCrypto != info.RanzhiCrypto {
+            change.Changed = append(change.Changed, name)
+        }
+    }
+
+    for name := range Config.RanzhiServer {
+        if _, ok := ranzhiServers[name]; !ok {
+            change.Removed = append(change.Removed, name)
+        }
+    }
+
+    change.DefaultChanged = Config.DefaultServer != defaultServer
+    configMu.RUnlock()
+
+    SetRanzhi(ranzhiServers, defaultServer)
+    return change, nil
+}
+
+//获取后端服务器配置，serverName为空时返回默认服务器
+func GetRanzhiServer(serverName string) (RanzhiServer, bool) {
+    configMu.RLock()
+    defer configMu.RUnlock()
+
+    if serverName == "" {
+        serverName = Config.DefaultServer
+    }
+
+    info, ok := Config.RanzhiServer[serverName]
+    return info, ok
+}
+
+//获取所有后端服务器名称
+func GetRanzhiServerNames() []string {
+    configMu.RLock()
+    defer configMu.RUnlock()
+
+    names := make([]string, 0, len(Config.RanzhiServer))
+    for name := range Config.RanzhiServer {
+        names = append(names, name)
+    }
+
+    return names
+}
+
+//获取默认服务器名称
+func GetDefaultServer() string {
+    configMu.RLock()
+    defer configMu.RUnlock()
+
+    return Config.DefaultServer
+}
+
+//获取站点类型 multiSite or singleSite
+func GetSiteType() string {
+    configMu.RLock()
+    defer configMu.RUnlock()
+
+    return Config.SiteType
+}
+
+//获取集群配置，没有[cluster]段或listen为空时不开启集群模式
+func getCluster(config *goconfig.ConfigFile) {
+    listen, err := config.GetValue("cluster", "listen")
+    if err != nil || listen == "" {
+        return
+    }
+
+    token, err := config.GetValue("cluster", "token")
+    if err != nil || token == "" {
+        log.Fatal("config: cluster token is required when cluster listen is set")
+    }
+
+    Config.ClusterListen = listen
+    Config.ClusterToken = token
+    Config.ClusterNode, _ = config.GetValue("cluster", "node")
+    if Config.ClusterNode == "" {
+        Config.ClusterNode = listen
+    }
+
+    peers, _ := config.GetValue("cluster", "peers")
+    Config.ClusterPeers = nil
+    for _, peer := range strings.Split(peers, ",") {
+        if peer = strings.TrimSpace(peer); peer != "" {
+            Config.ClusterPeers = append(Config.ClusterPeers, peer)
+        }
+    }
+}
+
+//获取第三方系统的集成，格式为 名称=密钥,用户ID[,后端服务器名称]
+func getWebhooks(config *goconfig.ConfigFile) {
+    Config.Webhooks = make(map[string]Webhook)
+    for _, name := range config.GetKeyList("webhook") {
+        value, _ := config.GetValue("webhook", name)
+        webhookInfo := strings.Split(value, ",")
+        if len(webhookInfo) < 2 || len(webhookInfo[0]) < 16 {
+            log.Fatalf("config: webhook %s config error, secret must be at least 16 characters", name)
+        }
+
+        userID, err := String2Int64(webhookInfo[1])
+        if err != nil || userID <= 0 {
+            log.Fatalf("config: webhook %s user id [%s] is invalid", name, webhookInfo[1])
         }
 
-        Config.RanzhiServer[ranzhiName] = RanzhiServer{serverInfo[0], []byte(serverInfo[1])}
+        webhook := Webhook{Secret: webhookInfo[0], UserID: userID}
+        if len(webhookInfo) >= 3 {
+            webhook.Server = webhookInfo[2]
+        }
+        Config.Webhooks[name] = webhook
     }
 }
 
@@ -272,3 +693,134 @@ func sizeSuffix(uploadFileSize string) (string, string) {
 
     return uploadFileSize, ""
 }
+
+//解析[backend.服务器名称]段中的上传配额和保留策略
+func parseUploadPolicy(options map[string]string) (UploadPolicy, error) {
+    var policy UploadPolicy
+    var err error
+
+    if policy.Quota, err = parseSize(options["quota"]); err != nil {
+        return policy, Errorf("quota %s is invalid", options["quota"])
+    }
+    if policy.UserQuota, err = parseSize(options["userQuota"]); err != nil {
+        return policy, Errorf("userQuota %s is invalid", options["userQuota"])
+    }
+    if policy.RetentionSize, err = parseSize(options["retentionSize"]); err != nil {
+        return policy, Errorf("retentionSize %s is invalid", options["retentionSize"])
+    }
+
+    if days := options["retentionDays"]; days != "" {
+        if policy.RetentionDays, err = String2Int64(days); err != nil || policy.RetentionDays < 0 {
+            return policy, Errorf("retentionDays %s is invalid", days)
+        }
+    }
+
+    return policy, nil
+}
+
+//解析带K、M、G单位的大小，为空时返回0
+func parseSize(value string) (int64, error) {
+    if value == "" {
+        return 0, nil
+    }
+
+    number, suffix := sizeSuffix(value)
+    size, err := String2Int64(number)
+    if err != nil || size < 0 {
+        return 0, Errorf("size %s is invalid", value)
+    }
+
+    switch suffix {
+    case "K":
+        size *= KB
+    case "M":
+        size *= MB
+    case "G":
+        size *= GB
+    }
+
+    return size, nil
+}
+
+//上传文件保留策略的执行方式，默认不执行
+func getRetention(config *goconfig.ConfigFile) {
+    Config.Retention = RetentionOff
+
+    retention, _ := config.GetValue("server", "retention")
+    switch retention {
+    case "", RetentionOff:
+    case RetentionDryRun, RetentionOn:
+        Config.Retention = retention
+    default:
+        log.Printf("config: server retention [%s] is invalid, retention is off.", retention)
+    }
+}
+
+//上传文件的扫描，没有[scanner]段或driver为空时不扫描
+func getScanner(config *goconfig.ConfigFile) {
+    Config.Scanner = ScannerConfig{Timeout: time.Duration(defaultScanTimeout) * time.Second}
+    Config.Scanner.Driver, _ = config.GetValue("scanner", "driver")
+    Config.Scanner.Command, _ = config.GetValue("scanner", "command")
+    Config.Scanner.Address, _ = config.GetValue("scanner", "address")
+    Config.Scanner.Service, _ = config.GetValue("scanner", "service")
+
+    if timeout, err := config.GetValue("scanner", "timeout"); err == nil && timeout != "" {
+        seconds, err := String2Int64(timeout)
+        if err != nil || seconds <= 0 {
+            log.Printf("config: scanner timeout [%s] is invalid, default %d seconds.", timeout, defaultScanTimeout)
+            seconds = defaultScanTimeout
+        }
+        Config.Scanner.Timeout = time.Duration(seconds) * time.Second
+    }
+
+    failOpen, _ := config.GetValue("scanner", "failOpen")
+    Config.Scanner.FailOpen = failOpen == "1"
+}
+
+//存储驱动和路径，没有配置时优先使用sqlite，不支持cgo时使用file
+func getDatabase(config *goconfig.ConfigFile) {
+    dir, _ := os.Getwd()
+    Config.DBDriver, Config.DBPath = defaultDatabase(dir)
+
+    driver, _ := config.GetValue("database", "driver")
+    if driver != "" && driver != Config.DBDriver {
+        Config.DBDriver = driver
+        Config.DBPath = dir + "/config/xxd.db"
+        if driver == "file" {
+            Config.DBPath = dir + "/config/xxd.data"
+        }
+    }
+
+    path, _ := config.GetValue("database", "path")
+    if path != "" {
+        Config.DBPath = path
+        if !filepath.IsAbs(path) {
+            Config.DBPath = dir + "/" + path
+        }
+    }
+}
+
+//上传文件的存储，默认保存在 uploadPath
+func getStorage(config *goconfig.ConfigFile) {
+    Config.Storage = StorageConfig{Driver: "local"}
+    if driver, _ := config.GetValue("storage", "driver"); driver != "" {
+        Config.Storage.Driver = driver
+    }
+
+    Config.Storage.Endpoint, _ = config.GetValue("storage", "endpoint")
+    Config.Storage.Region, _ = config.GetValue("storage", "region")
+    Config.Storage.Bucket, _ = config.GetValue("storage", "bucket")
+    Config.Storage.AccessKey, _ = config.GetValue("storage", "accessKey")
+    Config.Storage.SecretKey, _ = config.GetValue("storage", "secretKey")
+    Config.Storage.Prefix, _ = config.GetValue("storage", "prefix")
+    pathStyle, err := config.GetValue("storage", "pathStyle")
+    Config.Storage.PathStyle = err != nil || pathStyle != "0"
+}
+
+func defaultDatabase(dir string) (string, string) {
+    if _, ok := storeDrivers["sqlite"]; ok {
+        return "sqlite", dir + "/config/xxd.db"
+    }
+
+    return "file", dir + "/config/xxd.data"
+}
@@ -10,85 +10,54 @@
 package util
 
 import (
-    "database/sql"
-    _ "github.com/mattn/go-sqlite3"
-    "os"
-    "strconv"
-    "strings"
+    "log"
 )
 
-func InitDB() *sql.DB {
-    dir, _ := os.Getwd()
-    DB, err := sql.Open("sqlite3", dir+"/config/xxd.db")
+//根据配置打开存储
+func InitDB() Store {
+    driver, path := Config.DBDriver, Config.DBPath
+    DB, err := OpenStore(driver, path)
     if err != nil {
-        LogError().Println("SQLite connect error", err)
+        log.Fatalf("store: open %s %s error, %v", driver, path, err)
     }
+
+    LogInfo().Printf("Store: %s %s\n", driver, path)
     return DB
 }
 
 func DBInsertOffline(server string, userID int64) {
-    stmt, err := DBConn.Prepare("INSERT INTO offline(server, userID) values(?,?)")
-    if err != nil {
-        LogError().Println("SQLite insert offline error", err)
+    if err := DB.InsertOffline(server, userID); err != nil {
+        LogError().Println("Store insert offline error", err)
     }
-    stmt.Exec(server, userID)
 }
 
 func DBUserLogin(server string, userID int64) {
-    _, err := DBConn.Exec("DELETE FROM offline WHERE `server` = '" + server + "' AND `userID` = '" + Int642String(userID) + "'")
-    if err != nil {
-        LogError().Println("SQLite delete offline user error", err)
-    }
+    DBDeleteOffline(server, []int{int(userID)})
 }
 
 func DBInsertSendfail(server string, userID int64, gid string) {
-    stmt, err := DBConn.Prepare("INSERT INTO sendfail(server, userID, gid) values(?,?,?)")
-    if err != nil {
-        LogError().Println("SQLite insert sendfail error", err)
+    if err := DB.InsertSendfail(server, userID, gid); err != nil {
+        LogError().Println("Store insert sendfail error", err)
     }
-    stmt.Exec(server, userID, gid)
 }
 
 func DBSelectOffline(server string) ([]int, error) {
-    rows, err := DBConn.Query("SELECT `userID` FROM offline WHERE `server` = '" + server + "'")
-
+    dict, err := DB.SelectOffline(server)
     if err != nil {
-        LogError().Println("SQLite Query offline error", err)
+        LogError().Println("Store query offline error", err)
         return []int{}, err
     }
 
-    var dict []int
-
-    for rows.Next() {
-        var userID int
-        err := rows.Scan(&userID)
-        if err != nil {
-            LogError().Println("SQLite scan offline userID error", err)
-            return []int{}, err
-        }
-        dict = append(dict, userID)
-    }
     return dict, nil
 }
 
 func DBSelectSendfail(server string) (map[int][]string, error) {
-    rows, err := DBConn.Query("SELECT `userID`,`gid` FROM sendfail WHERE `server` = '" + server + "'")
-
+    dict, err := DB.SelectSendfail(server)
     if err != nil {
-        LogError().Println("SQLite Query sendfail error", err)
+        LogError().Println("Store query sendfail error", err)
         return nil, err
     }
-    dict := make(map[int][]string)
-    for rows.Next() {
-        var userID int
-        var gid string
-        err := rows.Scan(&userID, &gid)
-        if err != nil {
-            LogError().Println("SQLite scan sendFail userID or gid error", err)
-            return nil, err
-        }
-        dict[userID] = append(dict[userID], gid)
-    }
+
     return dict, nil
 }
 
@@ -97,25 +66,33 @@ func DBDeleteOffline(server string, userID []int) {
         return
     }
 
-    var IDs []string
-    for _, id := range userID {
-        IDs = append(IDs, strconv.Itoa(id))
+    if err := DB.DeleteOffline(server, userID); err != nil {
+        LogError().Println("Store delete offline users error:", err)
+    }
+}
+
+func DBDeleteSendfail(server string, gid map[int][]string) {
+    if err := DB.DeleteSendfail(server, gid); err != nil {
+        LogError().Println("Store delete sendfail messages error:", err)
     }
+}
 
-    _, err := DBConn.Exec("DELETE FROM offline WHERE `server` = '" + server + "' AND `userID` IN (" + strings.Join(IDs, ",") + ")")
+//每个服务器待上报的离线用户数
+func DBCountOffline() (map[string]int, error) {
+    count, err := DB.CountOffline()
     if err != nil {
-        LogError().Println("SQLite DELETE offline users error:", err)
+        LogError().Println("Store count offline error", err)
     }
+
+    return count, err
 }
 
-func DBDeleteSendfail(server string, gid map[int][]string) {
-    for userID, gids := range gid {
-        if len(gids) > 0 {
-            in := "'" + strings.Join(gids, "','") + "'"
-            _, err := DBConn.Exec("DELETE FROM sendfail WHERE `server` = '" + server + "' AND `userID` = " + Int2String(userID) + " AND `gid` IN (" + in + ")")
-            if err != nil {
-                LogError().Println("SQLite DELETE sendfail messages error:", err)
-            }
-        }
+//每个服务器待上报的发送失败消息数
+func DBCountSendfail() (map[string]int, error) {
+    count, err := DB.CountSendfail()
+    if err != nil {
+        LogError().Println("Store count sendfail error", err)
     }
+
+    return count, err
 }
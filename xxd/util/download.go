@@ -0,0 +1,85 @@
+/**
+ * The download file of util current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Memory <memory@cnezsoft.com>
+ * @package     util
+ * @link        http://www.zentao.net
+ */
+package util
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "net/url"
+    "sync"
+)
+
+// 下载链接中签名的参数，链接只能由UserID在Expires之前使用
+type DownloadLink struct {
+    Server   string
+    FileID   string
+    FileName string
+    Time     string
+    UserID   int64
+    Expires  int64
+}
+
+var downloadKeyOnce sync.Once
+var downloadKey []byte
+
+//签名使用的密钥，没有配置downloadSecret时使用启动时生成的随机密钥，重启后之前的链接失效
+func downloadSecret() []byte {
+    if Config.DownloadSecret != "" {
+        return []byte(Config.DownloadSecret)
+    }
+
+    downloadKeyOnce.Do(func() {
+        downloadKey = make([]byte, 32)
+        if _, err := rand.Read(downloadKey); err != nil {
+            panic(err)
+        }
+    })
+    return downloadKey
+}
+
+//链接的参数，不包括签名
+func (link DownloadLink) values() url.Values {
+    return url.Values{
+        "ServerName": {link.Server},
+        "id":         {link.FileID},
+        "fileName":   {link.FileName},
+        "time":       {link.Time},
+        "user":       {Int642String(link.UserID)},
+        "expires":    {Int642String(link.Expires)},
+    }
+}
+
+//HMAC-SHA256签名，参数按名称排序并编码后计算，文件名中的特殊字符不会混淆参数的边界
+func (link DownloadLink) Sign() string {
+    mac := hmac.New(sha256.New, downloadSecret())
+    mac.Write([]byte(link.values().Encode()))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+//校验签名，不检查是否过期
+func (link DownloadLink) Verify(sig string) bool {
+    expected, err := hex.DecodeString(sig)
+    if err != nil {
+        return false
+    }
+
+    mac := hmac.New(sha256.New, downloadSecret())
+    mac.Write([]byte(link.values().Encode()))
+    return hmac.Equal(expected, mac.Sum(nil))
+}
+
+//带签名的下载地址，客户端在前面加上通用端口的地址
+func (link DownloadLink) URL() string {
+    values := link.values()
+    values.Set("sig", link.Sign())
+    return "/download?" + values.Encode()
+}
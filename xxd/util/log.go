@@ -121,7 +121,8 @@ func walkFunc(path string, info os.FileInfo, err error) error {
         return err
     }
 
-    if info.IsDir() {
+    // 只删除日志文件，日志目录中的其他文件(例如存储)不受影响
+    if info.IsDir() || filepath.Ext(path) != ".log" {
         return nil
     }
 
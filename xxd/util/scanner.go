@@ -0,0 +1,89 @@
+/**
+ * The scanner file of util current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Memory <memory@cnezsoft.com>
+ * @package     util
+ * @link        http://www.zentao.net
+ */
+package util
+
+import (
+    "log"
+    "sort"
+    "time"
+)
+
+// 上传文件的内容扫描，文件在登记到后端服务器、可以下载之前扫描
+type Scanner interface {
+    Scan(path string) (ScanResult, error) // 扫描失败时返回错误，发现病毒不是错误
+}
+
+type ScanResult struct {
+    Infected bool
+    Threat   string // 发现的病毒或违规内容的名称
+}
+
+// [scanner] 配置
+type ScannerConfig struct {
+    Driver string // 为空时不扫描
+
+    // command
+    Command string // 扫描命令，{file}替换为文件路径，没有{file}时文件路径追加在末尾
+
+    // icap
+    Address string // "/"开头为unix socket，否则为 host:port
+    Service string
+
+    Timeout  time.Duration
+    FailOpen bool // 扫描出错时是否仍然允许上传
+}
+
+// 扫描驱动
+type ScannerDriver func(config ScannerConfig) (Scanner, error)
+
+var scannerDrivers = make(map[string]ScannerDriver)
+
+//注册扫描驱动，command 和 icap 驱动在导入 util 包时注册
+func RegisterScanner(name string, driver ScannerDriver) bool {
+    scannerDrivers[name] = driver
+    return true
+}
+
+//打开扫描驱动
+func OpenScanner(config ScannerConfig) (Scanner, error) {
+    driver, ok := scannerDrivers[config.Driver]
+    if !ok {
+        return nil, Errorf("scanner: unknown driver %q, available: %v", config.Driver, ScannerDrivers())
+    }
+
+    return driver(config)
+}
+
+//已注册的扫描驱动
+func ScannerDrivers() []string {
+    var names []string
+    for name := range scannerDrivers {
+        names = append(names, name)
+    }
+
+    sort.Strings(names)
+    return names
+}
+
+//根据配置打开上传文件的扫描，没有配置时返回nil
+func InitScanner() Scanner {
+    config := Config.Scanner
+    if config.Driver == "" {
+        return nil
+    }
+
+    scanner, err := OpenScanner(config)
+    if err != nil {
+        log.Fatalf("scanner: open %s error, %v", config.Driver, err)
+    }
+
+    LogInfo().Printf("Scanner: %s\n", config.Driver)
+    return scanner
+}
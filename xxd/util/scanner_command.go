@@ -0,0 +1,89 @@
+/**
+ * The scanner_command file of util current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Memory <memory@cnezsoft.com>
+ * @package     util
+ * @link        http://www.zentao.net
+ */
+package util
+
+import (
+    "context"
+    "os/exec"
+    "strings"
+    "time"
+)
+
+// 调用外部命令扫描，例如 clamdscan --no-summary --fdpass {file}。
+// 与clamdscan相同，退出码0为没有病毒，1为发现病毒，其他为扫描出错
+type commandScanner struct {
+    args    []string
+    timeout time.Duration
+}
+
+var _ = RegisterScanner("command", func(config ScannerConfig) (Scanner, error) {
+    args := strings.Fields(config.Command)
+    if len(args) == 0 {
+        return nil, Errorf("scanner: command is required")
+    }
+
+    return commandScanner{args: args, timeout: config.Timeout}, nil
+})
+
+func (s commandScanner) Scan(path string) (ScanResult, error) {
+    args := make([]string, 0, len(s.args)+1)
+    replaced := false
+    for _, arg := range s.args {
+        if strings.Contains(arg, "{file}") {
+            arg = strings.Replace(arg, "{file}", path, -1)
+            replaced = true
+        }
+        args = append(args, arg)
+    }
+    if !replaced {
+        args = append(args, path)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+    defer cancel()
+
+    output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+    if ctx.Err() != nil {
+        return ScanResult{}, Errorf("scanner: %s timed out after %s", args[0], s.timeout)
+    }
+    if err == nil {
+        return ScanResult{}, nil
+    }
+
+    if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+        return ScanResult{Infected: true, Threat: commandThreat(string(output))}, nil
+    }
+
+    return ScanResult{}, Errorf("scanner: %s error, %v: %s", args[0], err, strings.TrimSpace(string(output)))
+}
+
+//从命令输出中取病毒名称，clamdscan的格式为 "路径: 病毒名称 FOUND"，其他命令使用第一行输出
+func commandThreat(output string) string {
+    var first string
+    for _, line := range strings.Split(output, "\n") {
+        line = strings.TrimSpace(line)
+        if first == "" {
+            first = line
+        }
+
+        if strings.HasSuffix(line, " FOUND") {
+            line = strings.TrimSuffix(line, " FOUND")
+            if i := strings.LastIndex(line, ": "); i >= 0 {
+                line = line[i+2:]
+            }
+            return line
+        }
+    }
+
+    if len(first) > 200 {
+        first = first[:200]
+    }
+    return first
+}
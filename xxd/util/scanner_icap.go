@@ -0,0 +1,140 @@
+/**
+ * The scanner_icap file of util current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Memory <memory@cnezsoft.com>
+ * @package     util
+ * @link        http://www.zentao.net
+ */
+package util
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "net/textproto"
+    "os"
+    "strings"
+    "time"
+)
+
+// 通过ICAP(RFC 3507)的RESPMOD请求扫描，例如 c-icap + squidclamav。
+// 返回204为没有病毒，返回200表示服务修改或拦截了内容，视为发现病毒
+type icapScanner struct {
+    network string
+    address string
+    service string
+    timeout time.Duration
+}
+
+var _ = RegisterScanner("icap", func(config ScannerConfig) (Scanner, error) {
+    if config.Address == "" {
+        return nil, Errorf("scanner: icap requires address")
+    }
+
+    s := icapScanner{network: "tcp", address: config.Address, service: config.Service, timeout: config.Timeout}
+    if strings.HasPrefix(config.Address, "/") {
+        s.network = "unix"
+    }
+    if s.service == "" {
+        s.service = "avscan"
+    }
+
+    return s, nil
+})
+
+func (s icapScanner) Scan(path string) (ScanResult, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return ScanResult{}, err
+    }
+    defer f.Close()
+
+    info, err := f.Stat()
+    if err != nil {
+        return ScanResult{}, err
+    }
+
+    conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+    if err != nil {
+        return ScanResult{}, Errorf("scanner: icap connect error, %v", err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(s.timeout))
+
+    if err := s.writeRequest(conn, f, info.Size()); err != nil {
+        return ScanResult{}, Errorf("scanner: icap request error, %v", err)
+    }
+
+    reader := textproto.NewReader(bufio.NewReader(conn))
+    status, err := reader.ReadLine()
+    if err != nil {
+        return ScanResult{}, Errorf("scanner: icap response error, %v", err)
+    }
+    header, err := reader.ReadMIMEHeader()
+    if err != nil {
+        return ScanResult{}, Errorf("scanner: icap response error, %v", err)
+    }
+
+    var code int
+    if _, err := fmt.Sscanf(status, "ICAP/1.0 %d", &code); err != nil {
+        return ScanResult{}, Errorf("scanner: icap invalid status %q", status)
+    }
+
+    switch code {
+    case 204:
+        return ScanResult{}, nil
+    case 200:
+        return ScanResult{Infected: true, Threat: icapThreat(header)}, nil
+    }
+
+    return ScanResult{}, Errorf("scanner: icap status %q", status)
+}
+
+//把文件作为HTTP响应的内容发送，内容使用chunked编码
+func (s icapScanner) writeRequest(conn net.Conn, body io.Reader, size int64) error {
+    host := s.address
+    if s.network == "unix" {
+        host = "localhost"
+    }
+
+    resHeader := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: " + Int642String(size) + "\r\n\r\n"
+
+    w := bufio.NewWriter(conn)
+    fmt.Fprintf(w, "RESPMOD icap://%s/%s ICAP/1.0\r\n", host, s.service)
+    fmt.Fprintf(w, "Host: %s\r\n", host)
+    fmt.Fprintf(w, "Allow: 204\r\n")
+    fmt.Fprintf(w, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(resHeader))
+    w.WriteString(resHeader)
+
+    if size > 0 {
+        fmt.Fprintf(w, "%x\r\n", size)
+        if _, err := io.CopyN(w, body, size); err != nil {
+            return err
+        }
+        w.WriteString("\r\n")
+    }
+    w.WriteString("0\r\n\r\n")
+
+    return w.Flush()
+}
+
+//病毒名称，X-Infection-Found 的格式为 "Type=0; Resolution=2; Threat=名称;"
+func icapThreat(header textproto.MIMEHeader) string {
+    if found := header.Get("X-Infection-Found"); found != "" {
+        for _, field := range strings.Split(found, ";") {
+            if field = strings.TrimSpace(field); strings.HasPrefix(field, "Threat=") {
+                return strings.TrimPrefix(field, "Threat=")
+            }
+        }
+        return found
+    }
+
+    if violations := header.Get("X-Violations-Found"); violations != "" {
+        return violations
+    }
+
+    return "blocked by icap service"
+}
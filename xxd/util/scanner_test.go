@@ -0,0 +1,127 @@
+package util
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "net/http/httputil"
+    "net/textproto"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// 模拟的扫描程序把包含EICAR的内容当作病毒，不使用真正的EICAR测试文件，避免被开发机的杀毒软件拦截
+const testVirus = "fake EICAR test content"
+
+// 作为扫描命令运行时模拟clamdscan：发现病毒退出码为1，文件不存在时为2
+func TestMain(m *testing.M) {
+    if os.Getenv("XXD_FAKE_SCANNER") == "1" {
+        path := os.Args[len(os.Args)-1]
+        content, err := ioutil.ReadFile(path)
+        if err != nil {
+            fmt.Printf("%s: lstat() failed: No such file or directory. ERROR\n", path)
+            os.Exit(2)
+        }
+        if bytes.Contains(content, []byte("EICAR")) {
+            fmt.Printf("%s: Eicar-Test-Signature FOUND\n", path)
+            os.Exit(1)
+        }
+        fmt.Printf("%s: OK\n", path)
+        os.Exit(0)
+    }
+
+    os.Exit(m.Run())
+}
+
+func writeTestFile(t *testing.T, content string) string {
+    path := filepath.Join(t.TempDir(), "upload")
+    if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestCommandScanner(t *testing.T) {
+    os.Setenv("XXD_FAKE_SCANNER", "1")
+    defer os.Unsetenv("XXD_FAKE_SCANNER")
+
+    scanner, err := OpenScanner(ScannerConfig{Driver: "command", Command: os.Args[0] + " --no-summary {file}", Timeout: 10 * time.Second})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if result, err := scanner.Scan(writeTestFile(t, "clean")); err != nil || result.Infected {
+        t.Errorf("clean file returned %+v, %v", result, err)
+    }
+    if result, err := scanner.Scan(writeTestFile(t, testVirus)); err != nil || !result.Infected || result.Threat != "Eicar-Test-Signature" {
+        t.Errorf("infected file returned %+v, %v", result, err)
+    }
+    if _, err := scanner.Scan(filepath.Join(t.TempDir(), "missing")); err == nil {
+        t.Error("scanner error was not reported")
+    }
+}
+
+// 模拟ICAP服务，内容包含EICAR时返回200和X-Infection-Found，否则返回204
+func newFakeICAP(t *testing.T) string {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { listener.Close() })
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+
+            reader := bufio.NewReader(conn)
+            tp := textproto.NewReader(reader)
+            line, _ := tp.ReadLine()
+            header, _ := tp.ReadMIMEHeader()
+            tp.ReadLine() // 封装的HTTP响应
+            tp.ReadMIMEHeader()
+            body, _ := ioutil.ReadAll(httputil.NewChunkedReader(reader))
+
+            switch {
+            case !strings.HasPrefix(line, "RESPMOD icap://") || header.Get("Encapsulated") == "":
+                fmt.Fprint(conn, "ICAP/1.0 400 Bad Request\r\n\r\n")
+            case bytes.Contains(body, []byte("EICAR")):
+                fmt.Fprint(conn, "ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;\r\nEncapsulated: null-body=0\r\n\r\n")
+            default:
+                fmt.Fprint(conn, "ICAP/1.0 204 No Content\r\n\r\n")
+            }
+            conn.Close()
+        }
+    }()
+
+    return listener.Addr().String()
+}
+
+func TestICAPScanner(t *testing.T) {
+    scanner, err := OpenScanner(ScannerConfig{Driver: "icap", Address: newFakeICAP(t), Timeout: 10 * time.Second})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if result, err := scanner.Scan(writeTestFile(t, "clean")); err != nil || result.Infected {
+        t.Errorf("clean file returned %+v, %v", result, err)
+    }
+    if result, err := scanner.Scan(writeTestFile(t, "")); err != nil || result.Infected {
+        t.Errorf("empty file returned %+v, %v", result, err)
+    }
+    if result, err := scanner.Scan(writeTestFile(t, testVirus)); err != nil || !result.Infected || result.Threat != "Eicar-Test-Signature" {
+        t.Errorf("infected file returned %+v, %v", result, err)
+    }
+
+    closed, _ := OpenScanner(ScannerConfig{Driver: "icap", Address: "127.0.0.1:1", Timeout: time.Second})
+    if _, err := closed.Scan(writeTestFile(t, "clean")); err == nil {
+        t.Error("connection error was not reported")
+    }
+}
@@ -0,0 +1,156 @@
+/**
+ * The storage file of util current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Memory <memory@cnezsoft.com>
+ * @package     util
+ * @link        http://www.zentao.net
+ */
+package util
+
+import (
+    "io"
+    "log"
+    "sort"
+    "time"
+)
+
+// 上传文件的存储，key为相对路径，使用"/"分隔，例如 server/2017/01/01/md5
+type Storage interface {
+    Put(key string, r io.Reader, size int64) error
+    Get(key string, offset, length int64) (io.ReadCloser, error) // length小于0时读到文件末尾，不存在时返回 ErrNotFound
+    Stat(key string) (StorageInfo, error)                         // 不存在时返回 ErrNotFound
+    Delete(key string) error                                      // 不存在时不返回错误
+}
+
+// 保存在本地磁盘的存储，可以直接操作文件，上传文件按内容去重
+type LocalStorage interface {
+    Storage
+    Path(key string) string
+}
+
+type StorageInfo struct {
+    Size    int64
+    ModTime time.Time
+    ETag    string
+}
+
+// [storage] 配置
+type StorageConfig struct {
+    Driver string
+
+    // s3
+    Endpoint  string
+    Region    string
+    Bucket    string
+    AccessKey string
+    SecretKey string
+    Prefix    string
+    PathStyle bool
+}
+
+// 存储驱动
+type StorageDriver func(config StorageConfig) (Storage, error)
+
+var storageDrivers = make(map[string]StorageDriver)
+
+//注册上传文件的存储驱动，各驱动在自己的文件中通过 var _ = RegisterStorage(...) 注册
+func RegisterStorage(name string, driver StorageDriver) bool {
+    storageDrivers[name] = driver
+    return true
+}
+
+//打开存储
+func OpenStorage(config StorageConfig) (Storage, error) {
+    driver, ok := storageDrivers[config.Driver]
+    if !ok {
+        return nil, Errorf("storage: unknown driver %q, available: %v", config.Driver, StorageDrivers())
+    }
+
+    return driver(config)
+}
+
+//已注册的存储驱动
+func StorageDrivers() []string {
+    var names []string
+    for name := range storageDrivers {
+        names = append(names, name)
+    }
+
+    sort.Strings(names)
+    return names
+}
+
+//根据配置打开上传文件的存储
+func InitStorage() Storage {
+    config := Config.Storage
+    storage, err := OpenStorage(config)
+    if err != nil {
+        log.Fatalf("storage: open %s error, %v", config.Driver, err)
+    }
+
+    LogInfo().Printf("Storage: %s\n", config.Driver)
+    return storage
+}
+
+// 按需读取存储中的文件，Seek到其他位置后重新请求，可以用于 http.ServeContent
+type StorageReader struct {
+    storage Storage
+    key     string
+    size    int64
+    offset  int64
+    body    io.ReadCloser
+}
+
+func NewStorageReader(storage Storage, key string, size int64) *StorageReader {
+    return &StorageReader{storage: storage, key: key, size: size}
+}
+
+func (r *StorageReader) Read(p []byte) (int, error) {
+    if r.offset >= r.size {
+        return 0, io.EOF
+    }
+
+    if r.body == nil {
+        body, err := r.storage.Get(r.key, r.offset, -1)
+        if err != nil {
+            return 0, err
+        }
+        r.body = body
+    }
+
+    n, err := r.body.Read(p)
+    r.offset += int64(n)
+    return n, err
+}
+
+func (r *StorageReader) Seek(offset int64, whence int) (int64, error) {
+    switch whence {
+    case io.SeekCurrent:
+        offset += r.offset
+    case io.SeekEnd:
+        offset += r.size
+    }
+
+    if offset < 0 {
+        return 0, Errorf("storage: seek %s to negative position", r.key)
+    }
+
+    if offset != r.offset {
+        r.Close()
+        r.offset = offset
+    }
+
+    return offset, nil
+}
+
+func (r *StorageReader) Close() error {
+    if r.body == nil {
+        return nil
+    }
+
+    err := r.body.Close()
+    r.body = nil
+    return err
+}
@@ -0,0 +1,109 @@
+/**
+ * The storage_local file of util current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Memory <memory@cnezsoft.com>
+ * @package     util
+ * @link        http://www.zentao.net
+ */
+package util
+
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+)
+
+// 保存在 uploadPath 下的本地存储
+type localStorage struct{}
+
+var _ = RegisterStorage("local", func(config StorageConfig) (Storage, error) {
+    return localStorage{}, nil
+})
+
+//key对应的文件路径，key中的".."不能超出 uploadPath
+func (localStorage) Path(key string) string {
+    return filepath.Join(Config.UploadPath, filepath.FromSlash(filepath.Clean("/"+key)))
+}
+
+//先写入同目录下的临时文件，写完后再改名，读取的一方不会看到写了一半的文件
+func (s localStorage) Put(key string, r io.Reader, size int64) error {
+    path := s.Path(key)
+    if err := Mkdir(filepath.Dir(path)); err != nil {
+        return err
+    }
+
+    f, err := ioutil.TempFile(filepath.Dir(path), ".put-")
+    if err != nil {
+        return err
+    }
+
+    written, err := io.Copy(f, r)
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil && size >= 0 && written != size {
+        err = Errorf("storage: wrote %d bytes, want %d", written, size)
+    }
+    if err == nil {
+        err = os.Rename(f.Name(), path)
+    }
+    if err != nil {
+        os.Remove(f.Name())
+    }
+
+    return err
+}
+
+func (s localStorage) Get(key string, offset, length int64) (io.ReadCloser, error) {
+    f, err := os.Open(s.Path(key))
+    if os.IsNotExist(err) {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    if _, err := f.Seek(offset, io.SeekStart); err != nil {
+        f.Close()
+        return nil, err
+    }
+
+    if length < 0 {
+        return f, nil
+    }
+
+    return struct {
+        io.Reader
+        io.Closer
+    }{io.LimitReader(f, length), f}, nil
+}
+
+func (s localStorage) Stat(key string) (StorageInfo, error) {
+    info, err := os.Stat(s.Path(key))
+    if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+        return StorageInfo{}, ErrNotFound
+    }
+    if err != nil {
+        return StorageInfo{}, err
+    }
+
+    // 上传后的文件不会修改，文件大小和修改时间可以作为ETag
+    return StorageInfo{
+        Size:    info.Size(),
+        ModTime: info.ModTime(),
+        ETag:    fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()),
+    }, nil
+}
+
+func (s localStorage) Delete(key string) error {
+    err := os.Remove(s.Path(key))
+    if os.IsNotExist(err) {
+        return nil
+    }
+
+    return err
+}
@@ -0,0 +1,270 @@
+/**
+ * The storage_s3 file of util current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Memory <memory@cnezsoft.com>
+ * @package     util
+ * @link        http://www.zentao.net
+ */
+package util
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/url"
+    "path"
+    "sort"
+    "strings"
+    "time"
+)
+
+// S3兼容的对象存储，多个xxd节点可以共用同一个bucket。请求使用 AWS Signature Version 4 签名
+type s3Storage struct {
+    config   StorageConfig
+    endpoint *url.URL
+    client   *http.Client
+}
+
+// 上传时不计算内容的sha256
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// 空内容的sha256
+const emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+var _ = RegisterStorage("s3", newS3Storage)
+
+func newS3Storage(config StorageConfig) (Storage, error) {
+    if config.Endpoint == "" || config.Bucket == "" || config.AccessKey == "" || config.SecretKey == "" {
+        return nil, Errorf("storage: s3 requires endpoint, bucket, accessKey and secretKey")
+    }
+
+    endpoint, err := url.Parse(config.Endpoint)
+    if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+        return nil, Errorf("storage: invalid s3 endpoint %q", config.Endpoint)
+    }
+
+    if config.Region == "" {
+        config.Region = "us-east-1"
+    }
+
+    // 不设置整体超时，大文件上传下载需要较长时间
+    transport := &http.Transport{
+        Proxy:                 http.ProxyFromEnvironment,
+        DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+        TLSHandshakeTimeout:   10 * time.Second,
+        ResponseHeaderTimeout: 30 * time.Second,
+        MaxIdleConnsPerHost:   16,
+        IdleConnTimeout:       90 * time.Second,
+    }
+
+    return &s3Storage{config: config, endpoint: endpoint, client: &http.Client{Transport: transport}}, nil
+}
+
+func (s *s3Storage) objectURL(key string) *url.URL {
+    u := &url.URL{Scheme: s.endpoint.Scheme, Host: s.endpoint.Host}
+    key = strings.TrimPrefix(path.Join("/", s.config.Prefix, key), "/")
+
+    if s.config.PathStyle {
+        u.Path = "/" + s.config.Bucket + "/" + key
+    } else {
+        u.Host = s.config.Bucket + "." + u.Host
+        u.Path = "/" + key
+    }
+    u.RawPath = s3Escape(u.Path, false)
+
+    return u
+}
+
+func (s *s3Storage) do(method, key string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+    req, err := http.NewRequest(method, s.objectURL(key).String(), body)
+    if err != nil {
+        return nil, err
+    }
+
+    for name, values := range header {
+        req.Header[name] = values
+    }
+
+    payload := emptyPayload
+    if body != nil {
+        req.ContentLength = size
+        payload = unsignedPayload
+    }
+
+    s.sign(req, payload, time.Now())
+    return s.client.Do(req)
+}
+
+func (s *s3Storage) Put(key string, r io.Reader, size int64) error {
+    if size < 0 {
+        return Errorf("storage: s3 put %s requires the size", key)
+    }
+
+    resp, err := s.do("PUT", key, r, size, nil)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return s3Error("put", key, resp)
+    }
+
+    return nil
+}
+
+func (s *s3Storage) Get(key string, offset, length int64) (io.ReadCloser, error) {
+    header := http.Header{}
+    if length >= 0 {
+        header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+    } else if offset > 0 {
+        header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+    }
+
+    resp, err := s.do("GET", key, nil, 0, header)
+    if err != nil {
+        return nil, err
+    }
+
+    switch resp.StatusCode {
+    case http.StatusOK, http.StatusPartialContent:
+        return resp.Body, nil
+    case http.StatusNotFound:
+        resp.Body.Close()
+        return nil, ErrNotFound
+    }
+
+    defer resp.Body.Close()
+    return nil, s3Error("get", key, resp)
+}
+
+func (s *s3Storage) Stat(key string) (StorageInfo, error) {
+    resp, err := s.do("HEAD", key, nil, 0, nil)
+    if err != nil {
+        return StorageInfo{}, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusNotFound {
+        return StorageInfo{}, ErrNotFound
+    }
+    if resp.StatusCode != http.StatusOK {
+        return StorageInfo{}, s3Error("stat", key, resp)
+    }
+
+    modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+    return StorageInfo{Size: resp.ContentLength, ModTime: modTime, ETag: resp.Header.Get("ETag")}, nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+    resp, err := s.do("DELETE", key, nil, 0, nil)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+        return s3Error("delete", key, resp)
+    }
+
+    return nil
+}
+
+func s3Error(op, key string, resp *http.Response) error {
+    body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+    return Errorf("storage: s3 %s %s: %s %s", op, key, resp.Status, strings.TrimSpace(string(body)))
+}
+
+//AWS Signature Version 4，签名 host、range 和 x-amz-* 请求头
+func (s *s3Storage) sign(r *http.Request, payload string, now time.Time) {
+    amzDate := now.UTC().Format("20060102T150405Z")
+    date := amzDate[:8]
+    r.Header.Set("X-Amz-Date", amzDate)
+    r.Header.Set("X-Amz-Content-Sha256", payload)
+
+    host := r.Host
+    if host == "" {
+        host = r.URL.Host
+    }
+
+    values := map[string]string{"host": host}
+    for name := range r.Header {
+        lower := strings.ToLower(name)
+        if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+            values[lower] = strings.TrimSpace(r.Header.Get(name))
+        }
+    }
+
+    var names []string
+    for name := range values {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var headers strings.Builder
+    for _, name := range names {
+        headers.WriteString(name + ":" + values[name] + "\n")
+    }
+    signedHeaders := strings.Join(names, ";")
+
+    canonicalRequest := strings.Join([]string{
+        r.Method,
+        r.URL.EscapedPath(),
+        s3Query(r.URL.Query()),
+        headers.String(),
+        signedHeaders,
+        payload,
+    }, "\n")
+
+    scope := date + "/" + s.config.Region + "/s3/aws4_request"
+    hash := sha256.Sum256([]byte(canonicalRequest))
+    stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+    key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+    key = hmacSHA256(key, s.config.Region)
+    key = hmacSHA256(key, "s3")
+    key = hmacSHA256(key, "aws4_request")
+    signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+    r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.config.AccessKey+"/"+scope+",SignedHeaders="+signedHeaders+",Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+func s3Query(query url.Values) string {
+    var pairs []string
+    for name, values := range query {
+        for _, value := range values {
+            pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+        }
+    }
+
+    sort.Strings(pairs)
+    return strings.Join(pairs, "&")
+}
+
+//按S3的规则编码，只保留 A-Z a-z 0-9 - _ . ~，路径中保留"/"
+func s3Escape(s string, escapeSlash bool) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+            b.WriteByte(c)
+        } else {
+            fmt.Fprintf(&b, "%%%02X", c)
+        }
+    }
+
+    return b.String()
+}
@@ -0,0 +1,89 @@
+/**
+ * The store file of util current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Memory <memory@cnezsoft.com>
+ * @package     util
+ * @link        http://www.zentao.net
+ */
+package util
+
+import (
+    "sort"
+)
+
+// 离线用户、发送失败的消息和文件会话的存储
+type Store interface {
+    InsertOffline(server string, userID int64) error
+    SelectOffline(server string) ([]int, error)
+    DeleteOffline(server string, userID []int) error
+    CountOffline() (map[string]int, error)
+
+    InsertSendfail(server string, userID int64, gid string) error
+    SelectSendfail(server string) (map[int][]string, error)
+    DeleteSendfail(server string, gid map[int][]string) error
+    CountSendfail() (map[string]int, error)
+
+    SessionStore
+
+    InsertUpload(upload UploadRecord) error
+    SelectUploads(server string) ([]UploadRecord, error) // 按上传时间从早到晚排序
+    DeleteUploads(server string, fileID []string) error
+    UploadUsage(server string, userID int64) (int64, int64, error) // 后端服务器和用户上传文件的总大小
+
+    Close() error
+}
+
+// 文件会话，用于旧的下载链接。同一用户的每个客户端(例如桌面端和网页端)各自有一个会话，
+// 退出时删除，进程异常退出时留下的会话在过期后失效
+type SessionStore interface {
+    SetFileSession(server string, userID int64, sessionID string, expire int64) error // expire为过期时间戳，已存在时更新过期时间
+    GetFileSessions(server string, userID int64) ([]string, error)                   // 未过期的会话
+    DeleteFileSession(server string, userID int64, sessionID string) error
+    DeleteExpiredSessions() (int, error) // 返回删除的会话数
+}
+
+// 上传文件的索引，用于配额和保留策略。大小为文件本身的大小，内容相同的文件分别计算
+type UploadRecord struct {
+    Server string `json:"server"`
+    FileID string `json:"fileID"`
+    UserID int64  `json:"userID"`
+    Key    string `json:"key"` // 在上传文件存储中的key
+    Size   int64  `json:"size"`
+    Time   int64  `json:"time"`
+}
+
+var ErrNotFound = Errorf("store: not found")
+
+// 存储驱动，参数为配置的存储路径
+type StoreDriver func(path string) (Store, error)
+
+var storeDrivers = make(map[string]StoreDriver)
+
+//注册离线用户、发送失败消息和文件会话的存储驱动，sqlite 驱动只在启用cgo时注册
+func RegisterStore(name string, driver StoreDriver) bool {
+    storeDrivers[name] = driver
+    return true
+}
+
+//打开存储
+func OpenStore(name, path string) (Store, error) {
+    driver, ok := storeDrivers[name]
+    if !ok {
+        return nil, Errorf("store: unknown driver %q, available: %v", name, StoreDrivers())
+    }
+
+    return driver(path)
+}
+
+//已注册的存储驱动，没有cgo时不包含sqlite
+func StoreDrivers() []string {
+    var names []string
+    for name := range storeDrivers {
+        names = append(names, name)
+    }
+
+    sort.Strings(names)
+    return names
+}
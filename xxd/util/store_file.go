@@ -0,0 +1,356 @@
+/**
+ * The store_file file of util current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Memory <memory@cnezsoft.com>
+ * @package     util
+ * @link        http://www.zentao.net
+ */
+package util
+
+import (
+    "bufio"
+    "encoding/json"
+    "os"
+    "path/filepath"
+)
+
+var _ = RegisterStore("file", func(path string) (Store, error) {
+    return openFileStore(path)
+})
+
+// 纯Go的文件存储，不需要cgo。数据保存在内存中，每次修改以一行json追加到文件，
+// 启动时重放并压缩，记录数超过 fileStoreCompact 且大部分已失效时也会压缩。
+const fileStoreCompact = 10000
+
+const (
+    opInsertOffline  = "insertOffline"
+    opDeleteOffline  = "deleteOffline"
+    opInsertSendfail = "insertSendfail"
+    opDeleteSendfail = "deleteSendfail"
+    opSetSession     = "setSession"
+    opDeleteSession  = "deleteSession"
+    opInsertUpload   = "insertUpload"
+    opDeleteUploads  = "deleteUploads"
+)
+
+type fileRecord struct {
+    Op      string           `json:"op"`
+    Server  string           `json:"server"`
+    UserID  int64            `json:"userID,omitempty"`
+    Users   []int            `json:"users,omitempty"`
+    Gid     string           `json:"gid,omitempty"`
+    Gids    map[int][]string `json:"gids,omitempty"`
+    Session string           `json:"session,omitempty"`
+    Expire  int64            `json:"expire,omitempty"`
+    Upload  *UploadRecord    `json:"upload,omitempty"`
+    Files   []string         `json:"files,omitempty"`
+}
+
+type fileStore struct {
+    *memoryStore
+    path    string
+    file    *os.File
+    records int // 文件中的记录数
+}
+
+func openFileStore(path string) (*fileStore, error) {
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return nil, err
+    }
+
+    s := &fileStore{memoryStore: newMemoryStore(), path: path}
+    if err := s.load(); err != nil {
+        return nil, err
+    }
+
+    if err := s.compact(); err != nil {
+        return nil, err
+    }
+
+    return s, nil
+}
+
+//重放文件中的记录，最后一行不完整时(写入时进程退出)忽略
+func (s *fileStore) load() error {
+    file, err := os.Open(s.path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+    for line := 1; scanner.Scan(); line++ {
+        var record fileRecord
+        if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+            LogError().Printf("store file %s line %d ignored: %v\n", s.path, line, err)
+            continue
+        }
+        s.apply(&record)
+    }
+
+    return scanner.Err()
+}
+
+func (s *fileStore) apply(record *fileRecord) {
+    switch record.Op {
+    case opInsertOffline:
+        s.insertOffline(record.Server, record.UserID)
+    case opDeleteOffline:
+        s.deleteOffline(record.Server, record.Users)
+    case opInsertSendfail:
+        s.insertSendfail(record.Server, record.UserID, record.Gid)
+    case opDeleteSendfail:
+        s.deleteSendfail(record.Server, record.Gids)
+    case opSetSession:
+        s.setFileSession(record.Server, record.UserID, record.Session, record.Expire)
+    case opDeleteSession:
+        // 旧版本的记录没有session，删除用户所有的会话
+        s.deleteFileSession(record.Server, record.UserID, record.Session)
+    case opInsertUpload:
+        if record.Upload != nil {
+            s.insertUpload(*record.Upload)
+        }
+    case opDeleteUploads:
+        s.deleteUploads(record.Server, record.Files)
+    }
+}
+
+//把当前数据写入临时文件后替换原文件
+func (s *fileStore) compact() error {
+    tmpPath := s.path + ".tmp"
+    tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+
+    writer := bufio.NewWriter(tmp)
+    encoder := json.NewEncoder(writer)
+    records := 0
+    write := func(record *fileRecord) {
+        if err == nil {
+            err = encoder.Encode(record)
+            records++
+        }
+    }
+
+    for server, users := range s.offline {
+        for userID := range users {
+            write(&fileRecord{Op: opInsertOffline, Server: server, UserID: userID})
+        }
+    }
+    for server, users := range s.sendfail {
+        for userID, gids := range users {
+            for gid := range gids {
+                write(&fileRecord{Op: opInsertSendfail, Server: server, UserID: userID, Gid: gid})
+            }
+        }
+    }
+    // 过期的会话不再写入
+    now := GetUnixTime()
+    for server, users := range s.sessions {
+        for userID, sessions := range users {
+            for sessionID, expire := range sessions {
+                if expire > now {
+                    write(&fileRecord{Op: opSetSession, Server: server, UserID: userID, Session: sessionID, Expire: expire})
+                }
+            }
+        }
+    }
+    for server, uploads := range s.uploads {
+        for _, upload := range uploads {
+            upload := upload
+            write(&fileRecord{Op: opInsertUpload, Server: server, Upload: &upload})
+        }
+    }
+
+    if err == nil {
+        err = writer.Flush()
+    }
+    if err == nil {
+        err = tmp.Sync()
+    }
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(tmpPath)
+        return err
+    }
+
+    if s.file != nil {
+        s.file.Close()
+        s.file = nil
+    }
+
+    if err := os.Rename(tmpPath, s.path); err != nil {
+        return err
+    }
+
+    s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+    s.records = records
+    return err
+}
+
+//追加到文件，写入成功后再应用修改，调用时持有锁
+func (s *fileStore) write(record *fileRecord) error {
+    data, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+
+    if s.file == nil {
+        return s.rewrite(Errorf("store file %s is not open", s.path))
+    }
+
+    info, err := s.file.Stat()
+    if err != nil {
+        return s.rewrite(err)
+    }
+
+    if _, err := s.file.Write(append(data, '\n')); err != nil {
+        // 截断写入的部分，避免下一条记录接在不完整的行后面
+        if s.file.Truncate(info.Size()) != nil {
+            return s.rewrite(err)
+        }
+        return err
+    }
+
+    s.apply(record)
+    s.records++
+    if s.records > fileStoreCompact && s.records > 2*s.live() {
+        return s.compact()
+    }
+
+    return nil
+}
+
+//文件无法追加或截断时用内存中的数据重写文件并重新打开，返回原来的错误
+func (s *fileStore) rewrite(err error) error {
+    if compactErr := s.compact(); compactErr != nil {
+        LogError().Printf("store file %s rewrite error: %v\n", s.path, compactErr)
+    }
+
+    return err
+}
+
+//当前有效的记录数
+func (s *fileStore) live() int {
+    live := 0
+    for _, users := range s.offline {
+        live += len(users)
+    }
+    for _, users := range s.sendfail {
+        for _, gids := range users {
+            live += len(gids)
+        }
+    }
+    for _, users := range s.sessions {
+        for _, sessions := range users {
+            live += len(sessions)
+        }
+    }
+    for _, uploads := range s.uploads {
+        live += len(uploads)
+    }
+
+    return live
+}
+
+func (s *fileStore) InsertOffline(server string, userID int64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.write(&fileRecord{Op: opInsertOffline, Server: server, UserID: userID})
+}
+
+func (s *fileStore) DeleteOffline(server string, userID []int) error {
+    if len(userID) == 0 {
+        return nil
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.write(&fileRecord{Op: opDeleteOffline, Server: server, Users: userID})
+}
+
+func (s *fileStore) InsertSendfail(server string, userID int64, gid string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.write(&fileRecord{Op: opInsertSendfail, Server: server, UserID: userID, Gid: gid})
+}
+
+func (s *fileStore) DeleteSendfail(server string, gid map[int][]string) error {
+    if len(gid) == 0 {
+        return nil
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.write(&fileRecord{Op: opDeleteSendfail, Server: server, Gids: gid})
+}
+
+func (s *fileStore) SetFileSession(server string, userID int64, sessionID string, expire int64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.write(&fileRecord{Op: opSetSession, Server: server, UserID: userID, Session: sessionID, Expire: expire})
+}
+
+func (s *fileStore) DeleteFileSession(server string, userID int64, sessionID string) error {
+    if sessionID == "" {
+        return nil
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.write(&fileRecord{Op: opDeleteSession, Server: server, UserID: userID, Session: sessionID})
+}
+
+//过期时间是绝对时间，只需要从内存中删除，重放时过期的会话同样无效，压缩时不再写入
+func (s *fileStore) DeleteExpiredSessions() (int, error) {
+    return s.memoryStore.DeleteExpiredSessions()
+}
+
+func (s *fileStore) InsertUpload(upload UploadRecord) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.write(&fileRecord{Op: opInsertUpload, Server: upload.Server, Upload: &upload})
+}
+
+func (s *fileStore) DeleteUploads(server string, fileID []string) error {
+    if len(fileID) == 0 {
+        return nil
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.write(&fileRecord{Op: opDeleteUploads, Server: server, Files: fileID})
+}
+
+func (s *fileStore) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.file == nil {
+        return nil
+    }
+
+    err := s.file.Sync()
+    if closeErr := s.file.Close(); err == nil {
+        err = closeErr
+    }
+    s.file = nil
+    return err
+}
@@ -0,0 +1,320 @@
+/**
+ * The store_memory file of util current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Memory <memory@cnezsoft.com>
+ * @package     util
+ * @link        http://www.zentao.net
+ */
+package util
+
+import (
+    "sort"
+    "sync"
+)
+
+var _ = RegisterStore("memory", func(path string) (Store, error) {
+    return newMemoryStore(), nil
+})
+
+// 内存存储，重启后数据丢失，用于测试
+type memoryStore struct {
+    mu       sync.Mutex
+    offline  map[string]map[int64]bool              // map[server][userID]
+    sendfail map[string]map[int64]map[string]bool   // map[server][userID][gid]
+    sessions map[string]map[int64]map[string]int64  // map[server][userID][sessionID]expire
+    uploads  map[string]map[string]UploadRecord     // map[server][fileID]
+}
+
+func newMemoryStore() *memoryStore {
+    return &memoryStore{
+        offline:  make(map[string]map[int64]bool),
+        sendfail: make(map[string]map[int64]map[string]bool),
+        sessions: make(map[string]map[int64]map[string]int64),
+        uploads:  make(map[string]map[string]UploadRecord),
+    }
+}
+
+func (s *memoryStore) InsertOffline(server string, userID int64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.insertOffline(server, userID)
+    return nil
+}
+
+func (s *memoryStore) insertOffline(server string, userID int64) {
+    if _, ok := s.offline[server]; !ok {
+        s.offline[server] = make(map[int64]bool)
+    }
+    s.offline[server][userID] = true
+}
+
+func (s *memoryStore) SelectOffline(server string) ([]int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var users []int
+    for userID := range s.offline[server] {
+        users = append(users, int(userID))
+    }
+
+    sort.Ints(users)
+    return users, nil
+}
+
+func (s *memoryStore) DeleteOffline(server string, userID []int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.deleteOffline(server, userID)
+    return nil
+}
+
+func (s *memoryStore) deleteOffline(server string, userID []int) {
+    for _, id := range userID {
+        delete(s.offline[server], int64(id))
+    }
+
+    if len(s.offline[server]) == 0 {
+        delete(s.offline, server)
+    }
+}
+
+func (s *memoryStore) CountOffline() (map[string]int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    count := make(map[string]int)
+    for server, users := range s.offline {
+        count[server] = len(users)
+    }
+
+    return count, nil
+}
+
+func (s *memoryStore) InsertSendfail(server string, userID int64, gid string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.insertSendfail(server, userID, gid)
+    return nil
+}
+
+func (s *memoryStore) insertSendfail(server string, userID int64, gid string) {
+    if _, ok := s.sendfail[server]; !ok {
+        s.sendfail[server] = make(map[int64]map[string]bool)
+    }
+
+    if _, ok := s.sendfail[server][userID]; !ok {
+        s.sendfail[server][userID] = make(map[string]bool)
+    }
+
+    s.sendfail[server][userID][gid] = true
+}
+
+func (s *memoryStore) SelectSendfail(server string) (map[int][]string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    dict := make(map[int][]string)
+    for userID, gids := range s.sendfail[server] {
+        for gid := range gids {
+            dict[int(userID)] = append(dict[int(userID)], gid)
+        }
+        sort.Strings(dict[int(userID)])
+    }
+
+    return dict, nil
+}
+
+func (s *memoryStore) DeleteSendfail(server string, gid map[int][]string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.deleteSendfail(server, gid)
+    return nil
+}
+
+func (s *memoryStore) deleteSendfail(server string, gid map[int][]string) {
+    for userID, gids := range gid {
+        for _, id := range gids {
+            delete(s.sendfail[server][int64(userID)], id)
+        }
+
+        if len(s.sendfail[server][int64(userID)]) == 0 {
+            delete(s.sendfail[server], int64(userID))
+        }
+    }
+
+    if len(s.sendfail[server]) == 0 {
+        delete(s.sendfail, server)
+    }
+}
+
+func (s *memoryStore) CountSendfail() (map[string]int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    count := make(map[string]int)
+    for server, users := range s.sendfail {
+        for _, gids := range users {
+            count[server] += len(gids)
+        }
+    }
+
+    return count, nil
+}
+
+func (s *memoryStore) SetFileSession(server string, userID int64, sessionID string, expire int64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.setFileSession(server, userID, sessionID, expire)
+    return nil
+}
+
+func (s *memoryStore) setFileSession(server string, userID int64, sessionID string, expire int64) {
+    if _, ok := s.sessions[server]; !ok {
+        s.sessions[server] = make(map[int64]map[string]int64)
+    }
+    if _, ok := s.sessions[server][userID]; !ok {
+        s.sessions[server][userID] = make(map[string]int64)
+    }
+    s.sessions[server][userID][sessionID] = expire
+}
+
+func (s *memoryStore) GetFileSessions(server string, userID int64) ([]string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    now := GetUnixTime()
+    var sessions []string
+    for sessionID, expire := range s.sessions[server][userID] {
+        if expire > now {
+            sessions = append(sessions, sessionID)
+        }
+    }
+
+    sort.Strings(sessions)
+    return sessions, nil
+}
+
+func (s *memoryStore) DeleteFileSession(server string, userID int64, sessionID string) error {
+    if sessionID == "" {
+        return nil
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.deleteFileSession(server, userID, sessionID)
+    return nil
+}
+
+//删除用户的会话，sessionID为空时删除用户所有的会话
+func (s *memoryStore) deleteFileSession(server string, userID int64, sessionID string) {
+    if sessionID == "" {
+        delete(s.sessions[server], userID)
+    } else {
+        delete(s.sessions[server][userID], sessionID)
+        if len(s.sessions[server][userID]) == 0 {
+            delete(s.sessions[server], userID)
+        }
+    }
+
+    if len(s.sessions[server]) == 0 {
+        delete(s.sessions, server)
+    }
+}
+
+func (s *memoryStore) DeleteExpiredSessions() (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    now := GetUnixTime()
+    deleted := 0
+    for server, users := range s.sessions {
+        for userID, sessions := range users {
+            for sessionID, expire := range sessions {
+                if expire <= now {
+                    s.deleteFileSession(server, userID, sessionID)
+                    deleted++
+                }
+            }
+        }
+    }
+
+    return deleted, nil
+}
+
+func (s *memoryStore) InsertUpload(upload UploadRecord) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.insertUpload(upload)
+    return nil
+}
+
+func (s *memoryStore) insertUpload(upload UploadRecord) {
+    if _, ok := s.uploads[upload.Server]; !ok {
+        s.uploads[upload.Server] = make(map[string]UploadRecord)
+    }
+    s.uploads[upload.Server][upload.FileID] = upload
+}
+
+func (s *memoryStore) SelectUploads(server string) ([]UploadRecord, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var uploads []UploadRecord
+    for _, upload := range s.uploads[server] {
+        uploads = append(uploads, upload)
+    }
+
+    sort.Slice(uploads, func(i, j int) bool {
+        if uploads[i].Time != uploads[j].Time {
+            return uploads[i].Time < uploads[j].Time
+        }
+        return uploads[i].FileID < uploads[j].FileID
+    })
+    return uploads, nil
+}
+
+func (s *memoryStore) DeleteUploads(server string, fileID []string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.deleteUploads(server, fileID)
+    return nil
+}
+
+func (s *memoryStore) deleteUploads(server string, fileID []string) {
+    for _, id := range fileID {
+        delete(s.uploads[server], id)
+    }
+
+    if len(s.uploads[server]) == 0 {
+        delete(s.uploads, server)
+    }
+}
+
+func (s *memoryStore) UploadUsage(server string, userID int64) (int64, int64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var serverSize, userSize int64
+    for _, upload := range s.uploads[server] {
+        serverSize += upload.Size
+        if upload.UserID == userID {
+            userSize += upload.Size
+        }
+    }
+
+    return serverSize, userSize, nil
+}
+
+func (s *memoryStore) Close() error {
+    return nil
+}
@@ -0,0 +1,359 @@
+//go:build cgo
+// +build cgo
+
+/**
+ * The store_sqlite file of util current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Memory <memory@cnezsoft.com>
+ * @package     util
+ * @link        http://www.zentao.net
+ */
+package util
+
+import (
+    "database/sql"
+    _ "github.com/mattn/go-sqlite3"
+    "os"
+    "path/filepath"
+)
+
+var _ = RegisterStore("sqlite", func(path string) (Store, error) {
+    return openSQLiteStore(path)
+})
+
+// 数据库结构的版本，序号即版本号，保存在 PRAGMA user_version 中。
+// 只能在末尾追加，旧版本附带的 xxd.db 中已有 offline 和 sendfail 表，版本为0。
+var sqliteMigrations = [][]string{
+    {
+        "CREATE TABLE IF NOT EXISTS offline (server STRING (20), userID INT (9))",
+        "CREATE TABLE IF NOT EXISTS sendfail (server VARCHAR (40), userID INT (9), gid VARCHAR (40))",
+    },
+    {
+        "CREATE INDEX IF NOT EXISTS offline_server_user ON offline (server, userID)",
+        "CREATE INDEX IF NOT EXISTS sendfail_server_user ON sendfail (server, userID)",
+    },
+    {
+        "CREATE TABLE IF NOT EXISTS filesession (server VARCHAR (40), userID INT (9), sessionID VARCHAR (40), PRIMARY KEY (server, userID))",
+    },
+    {
+        "CREATE TABLE IF NOT EXISTS upload (server VARCHAR (40), fileID VARCHAR (40), userID INT (9), storageKey VARCHAR (255), size INTEGER, time INTEGER, PRIMARY KEY (server, fileID))",
+        "CREATE INDEX IF NOT EXISTS upload_server_time ON upload (server, time)",
+    },
+    {
+        // 每个用户可以有多个会话，旧的会话没有过期时间，客户端重新登录时会创建新的会话
+        "DROP TABLE IF EXISTS filesession",
+        "CREATE TABLE filesession (server VARCHAR (40), userID INT (9), sessionID VARCHAR (40), expire INTEGER, PRIMARY KEY (server, userID, sessionID))",
+        "CREATE INDEX IF NOT EXISTS filesession_expire ON filesession (expire)",
+    },
+}
+
+var sqliteStatements = map[string]string{
+    "insertOffline":     "INSERT INTO offline (server, userID) VALUES (?, ?)",
+    "selectOffline":     "SELECT DISTINCT userID FROM offline WHERE server = ?",
+    "deleteOffline":     "DELETE FROM offline WHERE server = ? AND userID = ?",
+    "countOffline":      "SELECT server, COUNT(DISTINCT userID) FROM offline GROUP BY server",
+    "insertSendfail":    "INSERT INTO sendfail (server, userID, gid) VALUES (?, ?, ?)",
+    "selectSendfail":    "SELECT userID, gid FROM sendfail WHERE server = ?",
+    "deleteSendfail":    "DELETE FROM sendfail WHERE server = ? AND userID = ? AND gid = ?",
+    "countSendfail":     "SELECT server, COUNT(*) FROM sendfail GROUP BY server",
+    "setFileSession":    "INSERT OR REPLACE INTO filesession (server, userID, sessionID, expire) VALUES (?, ?, ?, ?)",
+    "getFileSessions":   "SELECT sessionID FROM filesession WHERE server = ? AND userID = ? AND expire > ? ORDER BY sessionID",
+    "deleteFileSession": "DELETE FROM filesession WHERE server = ? AND userID = ? AND sessionID = ?",
+    "deleteExpired":     "DELETE FROM filesession WHERE expire <= ?",
+    "insertUpload":      "INSERT OR REPLACE INTO upload (server, fileID, userID, storageKey, size, time) VALUES (?, ?, ?, ?, ?, ?)",
+    "selectUploads":     "SELECT fileID, userID, storageKey, size, time FROM upload WHERE server = ? ORDER BY time, fileID",
+    "deleteUpload":      "DELETE FROM upload WHERE server = ? AND fileID = ?",
+    "uploadUsage":       "SELECT COALESCE(SUM(size), 0), COALESCE(SUM(CASE WHEN userID = ? THEN size ELSE 0 END), 0) FROM upload WHERE server = ?",
+}
+
+type sqliteStore struct {
+    db   *sql.DB
+    stmt map[string]*sql.Stmt
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return nil, err
+    }
+
+    db, err := sql.Open("sqlite3", path)
+    if err != nil {
+        return nil, err
+    }
+
+    // sqlite 同一时间只允许一个写入，使用一个连接避免 database is locked
+    db.SetMaxOpenConns(1)
+
+    s := &sqliteStore{db: db, stmt: make(map[string]*sql.Stmt)}
+    if err := s.migrate(); err != nil {
+        db.Close()
+        return nil, err
+    }
+
+    for name, query := range sqliteStatements {
+        stmt, err := db.Prepare(query)
+        if err != nil {
+            s.Close()
+            return nil, Errorf("store: prepare %s error, %v", name, err)
+        }
+        s.stmt[name] = stmt
+    }
+
+    return s, nil
+}
+
+//把数据库结构升级到最新版本，每个版本在一个事务中完成
+func (s *sqliteStore) migrate() error {
+    var version int
+    if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+        return err
+    }
+
+    if version > len(sqliteMigrations) {
+        return Errorf("store: database version %d is newer than xxd supports (%d)", version, len(sqliteMigrations))
+    }
+
+    for ; version < len(sqliteMigrations); version++ {
+        err := s.transaction(func(tx *sql.Tx) error {
+            for _, query := range sqliteMigrations[version] {
+                if _, err := tx.Exec(query); err != nil {
+                    return err
+                }
+            }
+
+            // PRAGMA 不支持参数
+            _, err := tx.Exec("PRAGMA user_version = " + Int2String(version+1))
+            return err
+        })
+        if err != nil {
+            return Errorf("store: migrate to version %d error, %v", version+1, err)
+        }
+
+        LogInfo().Printf("Store: sqlite migrated to version %d\n", version+1)
+    }
+
+    return nil
+}
+
+func (s *sqliteStore) transaction(f func(tx *sql.Tx) error) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+
+    if err := f(tx); err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    return tx.Commit()
+}
+
+func (s *sqliteStore) InsertOffline(server string, userID int64) error {
+    _, err := s.stmt["insertOffline"].Exec(server, userID)
+    return err
+}
+
+func (s *sqliteStore) SelectOffline(server string) ([]int, error) {
+    rows, err := s.stmt["selectOffline"].Query(server)
+    if err != nil {
+        return []int{}, err
+    }
+    defer rows.Close()
+
+    var dict []int
+    for rows.Next() {
+        var userID int
+        if err := rows.Scan(&userID); err != nil {
+            return []int{}, err
+        }
+        dict = append(dict, userID)
+    }
+
+    return dict, rows.Err()
+}
+
+func (s *sqliteStore) DeleteOffline(server string, userID []int) error {
+    if len(userID) == 0 {
+        return nil
+    }
+
+    return s.transaction(func(tx *sql.Tx) error {
+        stmt := tx.Stmt(s.stmt["deleteOffline"])
+        for _, id := range userID {
+            if _, err := stmt.Exec(server, id); err != nil {
+                return err
+            }
+        }
+
+        return nil
+    })
+}
+
+func (s *sqliteStore) CountOffline() (map[string]int, error) {
+    return s.countByServer(s.stmt["countOffline"])
+}
+
+func (s *sqliteStore) InsertSendfail(server string, userID int64, gid string) error {
+    _, err := s.stmt["insertSendfail"].Exec(server, userID, gid)
+    return err
+}
+
+func (s *sqliteStore) SelectSendfail(server string) (map[int][]string, error) {
+    rows, err := s.stmt["selectSendfail"].Query(server)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    dict := make(map[int][]string)
+    for rows.Next() {
+        var userID int
+        var gid string
+        if err := rows.Scan(&userID, &gid); err != nil {
+            return nil, err
+        }
+        dict[userID] = append(dict[userID], gid)
+    }
+
+    return dict, rows.Err()
+}
+
+func (s *sqliteStore) DeleteSendfail(server string, gid map[int][]string) error {
+    if len(gid) == 0 {
+        return nil
+    }
+
+    return s.transaction(func(tx *sql.Tx) error {
+        stmt := tx.Stmt(s.stmt["deleteSendfail"])
+        for userID, gids := range gid {
+            for _, id := range gids {
+                if _, err := stmt.Exec(server, userID, id); err != nil {
+                    return err
+                }
+            }
+        }
+
+        return nil
+    })
+}
+
+func (s *sqliteStore) CountSendfail() (map[string]int, error) {
+    return s.countByServer(s.stmt["countSendfail"])
+}
+
+func (s *sqliteStore) countByServer(stmt *sql.Stmt) (map[string]int, error) {
+    rows, err := stmt.Query()
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    count := make(map[string]int)
+    for rows.Next() {
+        var server string
+        var n int
+        if err := rows.Scan(&server, &n); err != nil {
+            return nil, err
+        }
+        count[server] = n
+    }
+
+    return count, rows.Err()
+}
+
+func (s *sqliteStore) SetFileSession(server string, userID int64, sessionID string, expire int64) error {
+    _, err := s.stmt["setFileSession"].Exec(server, userID, sessionID, expire)
+    return err
+}
+
+func (s *sqliteStore) GetFileSessions(server string, userID int64) ([]string, error) {
+    rows, err := s.stmt["getFileSessions"].Query(server, userID, GetUnixTime())
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var sessions []string
+    for rows.Next() {
+        var sessionID string
+        if err := rows.Scan(&sessionID); err != nil {
+            return nil, err
+        }
+        sessions = append(sessions, sessionID)
+    }
+
+    return sessions, rows.Err()
+}
+
+func (s *sqliteStore) DeleteFileSession(server string, userID int64, sessionID string) error {
+    _, err := s.stmt["deleteFileSession"].Exec(server, userID, sessionID)
+    return err
+}
+
+func (s *sqliteStore) DeleteExpiredSessions() (int, error) {
+    result, err := s.stmt["deleteExpired"].Exec(GetUnixTime())
+    if err != nil {
+        return 0, err
+    }
+
+    deleted, err := result.RowsAffected()
+    return int(deleted), err
+}
+
+func (s *sqliteStore) InsertUpload(upload UploadRecord) error {
+    _, err := s.stmt["insertUpload"].Exec(upload.Server, upload.FileID, upload.UserID, upload.Key, upload.Size, upload.Time)
+    return err
+}
+
+func (s *sqliteStore) SelectUploads(server string) ([]UploadRecord, error) {
+    rows, err := s.stmt["selectUploads"].Query(server)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var uploads []UploadRecord
+    for rows.Next() {
+        upload := UploadRecord{Server: server}
+        if err := rows.Scan(&upload.FileID, &upload.UserID, &upload.Key, &upload.Size, &upload.Time); err != nil {
+            return nil, err
+        }
+        uploads = append(uploads, upload)
+    }
+
+    return uploads, rows.Err()
+}
+
+func (s *sqliteStore) DeleteUploads(server string, fileID []string) error {
+    if len(fileID) == 0 {
+        return nil
+    }
+
+    return s.transaction(func(tx *sql.Tx) error {
+        stmt := tx.Stmt(s.stmt["deleteUpload"])
+        for _, id := range fileID {
+            if _, err := stmt.Exec(server, id); err != nil {
+                return err
+            }
+        }
+
+        return nil
+    })
+}
+
+func (s *sqliteStore) UploadUsage(server string, userID int64) (int64, int64, error) {
+    var serverSize, userSize int64
+    err := s.stmt["uploadUsage"].QueryRow(userID, server).Scan(&serverSize, &userSize)
+    return serverSize, userSize, err
+}
+
+func (s *sqliteStore) Close() error {
+    for _, stmt := range s.stmt {
+        stmt.Close()
+    }
+
+    return s.db.Close()
+}
@@ -0,0 +1,97 @@
+//go:build cgo
+// +build cgo
+
+package util
+
+import (
+    "database/sql"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func execTestDB(t *testing.T, path string, queries ...string) {
+    db, err := sql.Open("sqlite3", path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+
+    for _, query := range queries {
+        if _, err := db.Exec(query); err != nil {
+            t.Fatalf("%s: %v", query, err)
+        }
+    }
+}
+
+func TestSQLiteMigrateLegacy(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "xxd.db")
+    execTestDB(t, path,
+        "CREATE TABLE offline (server STRING (20), userID INT (9))",
+        "CREATE TABLE sendfail (server VARCHAR (40), userID INT (9), gid VARCHAR (40))",
+        "INSERT INTO offline VALUES ('xuanxuan', 1)",
+        "INSERT INTO sendfail VALUES ('xuanxuan', 1, 'gid')",
+    )
+
+    store, err := openSQLiteStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+
+    var version int
+    store.db.QueryRow("PRAGMA user_version").Scan(&version)
+    if version != len(sqliteMigrations) {
+        t.Errorf("database version %d, want %d", version, len(sqliteMigrations))
+    }
+
+    var indexes int
+    store.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name IN ('offline_server_user', 'sendfail_server_user')").Scan(&indexes)
+    if indexes != 2 {
+        t.Errorf("%d indexes created, want 2", indexes)
+    }
+
+    if users, _ := store.SelectOffline("xuanxuan"); !reflect.DeepEqual(users, []int{1}) {
+        t.Errorf("legacy offline users %v", users)
+    }
+    if gids, _ := store.SelectSendfail("xuanxuan"); !reflect.DeepEqual(gids, map[int][]string{1: {"gid"}}) {
+        t.Errorf("legacy sendfail %v", gids)
+    }
+}
+
+func TestSQLiteNewerVersion(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "xxd.db")
+    execTestDB(t, path, "PRAGMA user_version = 99")
+
+    if store, err := openSQLiteStore(path); err == nil {
+        store.Close()
+        t.Error("opened a database newer than xxd")
+    }
+}
+
+func TestSQLiteInjection(t *testing.T) {
+    store, err := openSQLiteStore(filepath.Join(t.TempDir(), "xxd.db"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+
+    server := "xuan'xuan"
+    store.InsertOffline(server, 1)
+    store.InsertSendfail(server, 1, "a")
+    store.InsertSendfail(server, 1, "b")
+
+    if users, _ := store.SelectOffline(server); !reflect.DeepEqual(users, []int{1}) {
+        t.Errorf("offline users %v", users)
+    }
+
+    store.DeleteSendfail(server, map[int][]string{1: {"x') OR ('1'='1", "x' OR '1'='1"}})
+    if count, _ := store.CountSendfail(); count[server] != 2 {
+        t.Errorf("crafted gid deleted sendfail rows, %v left", count)
+    }
+
+    store.DeleteOffline("x' OR '1'='1", []int{1})
+    if count, _ := store.CountOffline(); count[server] != 1 {
+        t.Errorf("crafted server deleted offline rows, %v left", count)
+    }
+}
@@ -0,0 +1,184 @@
+package util
+
+import (
+    "path/filepath"
+    "reflect"
+    "sort"
+    "testing"
+)
+
+func openTestStore(t *testing.T, driver, path string) Store {
+    store, err := OpenStore(driver, path)
+    if err != nil {
+        t.Fatalf("open %s: %v", driver, err)
+    }
+
+    return store
+}
+
+func TestStoreDrivers(t *testing.T) {
+    for _, driver := range StoreDrivers() {
+        t.Run(driver, func(t *testing.T) {
+            store := openTestStore(t, driver, filepath.Join(t.TempDir(), "xxd.db"))
+            defer store.Close()
+
+            store.InsertOffline("xuanxuan", 2)
+            store.InsertOffline("xuanxuan", 1)
+            store.InsertOffline("other", 3)
+            if users, err := store.SelectOffline("xuanxuan"); err != nil || len(users) != 2 {
+                t.Errorf("offline users %v, %v", users, err)
+            }
+
+            store.DeleteOffline("xuanxuan", []int{1, 2})
+            if users, _ := store.SelectOffline("xuanxuan"); len(users) != 0 {
+                t.Errorf("offline users %v after delete", users)
+            }
+            if count, _ := store.CountOffline(); !reflect.DeepEqual(count, map[string]int{"other": 1}) {
+                t.Errorf("offline count %v", count)
+            }
+
+            store.InsertSendfail("xuanxuan", 1, "a")
+            store.InsertSendfail("xuanxuan", 1, "b")
+            store.InsertSendfail("xuanxuan", 2, "c")
+            if count, _ := store.CountSendfail(); !reflect.DeepEqual(count, map[string]int{"xuanxuan": 3}) {
+                t.Errorf("sendfail count %v", count)
+            }
+
+            store.DeleteSendfail("xuanxuan", map[int][]string{1: {"a"}, 2: {"c"}})
+            if gids, _ := store.SelectSendfail("xuanxuan"); !reflect.DeepEqual(gids, map[int][]string{1: {"b"}}) {
+                t.Errorf("sendfail %v after delete", gids)
+            }
+
+            if sessions, err := store.GetFileSessions("xuanxuan", 1); len(sessions) != 0 || err != nil {
+                t.Errorf("file sessions %v before login, %v", sessions, err)
+            }
+            // 桌面端和网页端同时登录，另有一个已过期的会话
+            now := GetUnixTime()
+            store.SetFileSession("xuanxuan", 1, "desktop", now+60)
+            store.SetFileSession("xuanxuan", 1, "web", now+60)
+            store.SetFileSession("xuanxuan", 1, "crashed", now-1)
+            store.SetFileSession("xuanxuan", 2, "other", now+60)
+            if sessions, err := store.GetFileSessions("xuanxuan", 1); !reflect.DeepEqual(sessions, []string{"desktop", "web"}) || err != nil {
+                t.Errorf("file sessions %v, %v", sessions, err)
+            }
+
+            store.DeleteFileSession("xuanxuan", 1, "desktop")
+            if sessions, _ := store.GetFileSessions("xuanxuan", 1); !reflect.DeepEqual(sessions, []string{"web"}) {
+                t.Errorf("file sessions %v after logout", sessions)
+            }
+
+            // 已存在的会话更新过期时间
+            store.SetFileSession("xuanxuan", 1, "web", now-1)
+            if deleted, err := store.DeleteExpiredSessions(); deleted != 2 || err != nil {
+                t.Errorf("deleted %d expired file sessions, %v", deleted, err)
+            }
+            if sessions, _ := store.GetFileSessions("xuanxuan", 2); !reflect.DeepEqual(sessions, []string{"other"}) {
+                t.Errorf("file sessions %v of user 2", sessions)
+            }
+
+            store.InsertUpload(UploadRecord{Server: "xuanxuan", FileID: "2", UserID: 1, Key: "b", Size: 20, Time: 200})
+            store.InsertUpload(UploadRecord{Server: "xuanxuan", FileID: "1", UserID: 1, Key: "a", Size: 10, Time: 100})
+            store.InsertUpload(UploadRecord{Server: "xuanxuan", FileID: "3", UserID: 2, Key: "c", Size: 30, Time: 300})
+            store.InsertUpload(UploadRecord{Server: "other", FileID: "1", UserID: 1, Key: "d", Size: 40, Time: 100})
+            if serverSize, userSize, err := store.UploadUsage("xuanxuan", 1); serverSize != 60 || userSize != 30 || err != nil {
+                t.Errorf("upload usage %d %d, %v", serverSize, userSize, err)
+            }
+
+            store.DeleteUploads("xuanxuan", []string{"2"})
+            want := []UploadRecord{
+                {Server: "xuanxuan", FileID: "1", UserID: 1, Key: "a", Size: 10, Time: 100},
+                {Server: "xuanxuan", FileID: "3", UserID: 2, Key: "c", Size: 30, Time: 300},
+            }
+            if uploads, err := store.SelectUploads("xuanxuan"); !reflect.DeepEqual(uploads, want) || err != nil {
+                t.Errorf("uploads %v after delete, %v", uploads, err)
+            }
+        })
+    }
+}
+
+func TestStorePersistence(t *testing.T) {
+    for _, driver := range []string{"sqlite", "file"} {
+        if _, ok := storeDrivers[driver]; !ok {
+            continue
+        }
+
+        t.Run(driver, func(t *testing.T) {
+            path := filepath.Join(t.TempDir(), "config", "xxd.db")
+            store := openTestStore(t, driver, path)
+            store.InsertOffline("xuanxuan", 1)
+            store.InsertOffline("xuanxuan", 2)
+            store.DeleteOffline("xuanxuan", []int{1})
+            store.InsertSendfail("xuanxuan", 1, "a")
+            store.SetFileSession("xuanxuan", 1, "session", GetUnixTime()+60)
+            store.SetFileSession("xuanxuan", 1, "expired", GetUnixTime()-1)
+            store.InsertUpload(UploadRecord{Server: "xuanxuan", FileID: "1", UserID: 1, Key: "a", Size: 10, Time: 100})
+            store.InsertUpload(UploadRecord{Server: "xuanxuan", FileID: "2", UserID: 1, Key: "b", Size: 20, Time: 200})
+            store.DeleteUploads("xuanxuan", []string{"1"})
+            store.Close()
+
+            store = openTestStore(t, driver, path)
+            defer store.Close()
+            if users, _ := store.SelectOffline("xuanxuan"); !reflect.DeepEqual(users, []int{2}) {
+                t.Errorf("offline users %v after reopen", users)
+            }
+            if gids, _ := store.SelectSendfail("xuanxuan"); !reflect.DeepEqual(gids, map[int][]string{1: {"a"}}) {
+                t.Errorf("sendfail %v after reopen", gids)
+            }
+            if sessions, _ := store.GetFileSessions("xuanxuan", 1); !reflect.DeepEqual(sessions, []string{"session"}) {
+                t.Errorf("file sessions %v after reopen", sessions)
+            }
+            if uploads, _ := store.SelectUploads("xuanxuan"); len(uploads) != 1 || uploads[0].Key != "b" {
+                t.Errorf("uploads %v after reopen", uploads)
+            }
+        })
+    }
+}
+
+func TestFileStoreCompact(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "xxd.data")
+    store, err := openFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+
+    for i := 0; i <= fileStoreCompact; i++ {
+        store.InsertOffline("xuanxuan", 1)
+        store.DeleteOffline("xuanxuan", []int{1})
+    }
+
+    if store.records > fileStoreCompact {
+        t.Errorf("file store has %d records, it was not compacted", store.records)
+    }
+}
+
+// 写入失败时不修改内存中的数据，之后的写入不受影响
+func TestFileStoreWriteError(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "xxd.data")
+    store, err := openFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    store.InsertOffline("xuanxuan", 1)
+    store.file.Close()
+    if err := store.InsertOffline("xuanxuan", 2); err == nil {
+        t.Fatal("write to a closed file succeeded")
+    }
+    if users, _ := store.SelectOffline("xuanxuan"); !reflect.DeepEqual(users, []int{1}) {
+        t.Errorf("offline users %v after a failed write", users)
+    }
+
+    if err := store.InsertOffline("xuanxuan", 3); err != nil {
+        t.Fatal(err)
+    }
+    store.Close()
+
+    reopened := openTestStore(t, "file", path)
+    defer reopened.Close()
+    users, _ := reopened.SelectOffline("xuanxuan")
+    sort.Ints(users)
+    if !reflect.DeepEqual(users, []int{1, 3}) {
+        t.Errorf("offline users %v after reopen", users)
+    }
+}
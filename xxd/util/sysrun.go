@@ -10,32 +10,56 @@
 package util
 
 import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
     "flag"
     "os"
     "runtime"
-    "database/sql"
+    "sync"
 )
 
 const Version = "v2.2.0"
 
 var Run bool = true
 var IsTest bool = false
+
+// 迁移上传文件到内容存储后退出
+var MigrateUploads bool = false
+
+// 输出上传文件保留策略会删除的文件后退出，不删除文件
+var RetentionReport bool = false
 var Token []byte
-var DBConn *sql.DB
-var Languages map[string]string
+var DB Store
+var UploadStorage Storage
+var UploadScanner Scanner // 没有配置扫描时为nil
+
+// 客户端使用过的语言，定时任务按语言向后端获取通知
+var languages = make(map[string]string)
+var languagesMu sync.RWMutex
 
 func init() {
+    Token = clientToken(Config.ClusterToken)
 
+    // 设置 cpu 使用
+    runtime.GOMAXPROCS(runtime.NumCPU())
+}
+
+//解析命令行参数，打开存储、上传文件的存储和扫描，main 启动时首先调用。
+//测试程序不调用，由各包测试的 TestMain 设置 DB、UploadStorage 和 UploadScanner
+func Init() {
     isTest := flag.Bool("test", false, "server test model")
+    migrateUploads := flag.Bool("migrateUploads", false, "move uploaded files into the content addressed storage and exit")
+    retentionReport := flag.Bool("retentionReport", false, "print the uploaded files the retention policy would purge and exit")
     flag.Parse()
     IsTest = *isTest
+    MigrateUploads = *migrateUploads
+    RetentionReport = *retentionReport
 
-    DBConn = InitDB()
+    DB = InitDB()
+    UploadStorage = InitStorage()
+    UploadScanner = InitScanner()
 
-    // xxd 启动时根据时间生成token
-    timeStr := Int642String(GetUnixTime())
-    Token = []byte(GetMD5(timeStr))
-    Languages = make(map[string]string)
     if IsTest {
         Printf("Server test model is %t \n", IsTest)
         Printf("Test token: %s \n", string(Token))
@@ -49,9 +73,40 @@ func init() {
     LogInfo().Printf("XXD %s is running \n", Version)
     LogInfo().Printf("ProgramName:%s,System:%s-%s\n", GetProgramName(), runtime.GOOS, runtime.GOARCH)
     LogInfo().Printf("---------------------------------------- \n")
+}
 
-    // 设置 cpu 使用
-    runtime.GOMAXPROCS(runtime.NumCPU())
+//记录客户端使用的语言
+func AddLanguage(lang string) {
+    languagesMu.Lock()
+    defer languagesMu.Unlock()
+
+    languages[lang] = lang
+}
+
+//获取客户端使用过的所有语言
+func GetLanguages() []string {
+    languagesMu.RLock()
+    defer languagesMu.RUnlock()
+
+    list := make([]string, 0, len(languages))
+    for lang := range languages {
+        list = append(list, lang)
+    }
+
+    return list
+}
+
+//所有客户端共用的token。xxd 启动时根据时间生成，集群模式下由集群密钥生成，
+//客户端从任意节点的serverInfo得到的token在其他节点上同样有效
+func clientToken(clusterToken string) []byte {
+    if clusterToken == "" {
+        timeStr := Int642String(GetUnixTime())
+        return []byte(GetMD5(timeStr))
+    }
+
+    mac := hmac.New(sha256.New, []byte(clusterToken))
+    mac.Write([]byte("xxd client token"))
+    return []byte(hex.EncodeToString(mac.Sum(nil))[:32])
 }
 
 func GetNumGoroutine() int {
@@ -60,6 +115,8 @@ func GetNumGoroutine() int {
 
 func Exit(extStr string) {
     Println(extStr)
-    DBConn.Close()
+    if DB != nil {
+        DB.Close()
+    }
     os.Exit(1)
 }
@@ -0,0 +1,17 @@
+package util
+
+import "testing"
+
+func TestClientToken(t *testing.T) {
+    first, second := clientToken("cluster secret"), clientToken("cluster secret")
+    if len(first) != 32 || string(first) != string(second) {
+        t.Errorf("cluster nodes got different tokens %s, %s", first, second)
+    }
+
+    if other := clientToken("other secret"); string(other) == string(first) {
+        t.Error("different cluster secrets got the same token")
+    }
+    if local := clientToken(""); len(local) != 32 || string(local) == string(first) {
+        t.Errorf("token without cluster %s", local)
+    }
+}
@@ -9,68 +9,65 @@
  */
 package util
 
-import (
-    "os"
-    "io/ioutil"
-    "strconv"
-)
-
-//生成唯一ID 作用于文件在websocket和http不同协议中识别用户
+//生成唯一ID 作用于文件在websocket和http不同协议中识别用户，同一用户的每个客户端各自有一个ID
 func CreateUid(serverName string, userID int64, key string) error {
-
-    url := Config.LogPath + serverName + "/"
-
-    if err := Mkdir(url); err != nil {
-        LogError().Println("mkdir error %s\n", err)
+    if err := DB.SetFileSession(serverName, userID, key, GetUnixTime()+Config.FileSessionTTL); err != nil {
+        LogError().Println("Save file session error", serverName, userID, err)
         return err
     }
 
-    fileName := url + Int642String(userID)
+    LogInfo().Println("Session created:", serverName, userID)
+    return nil
+}
 
-    fout,err := os.Create(fileName)
-    defer fout.Close()
-    if err != nil {
-        LogError().Println("Create file error",fileName,err)
+//延长唯一ID的有效时间，客户端连接期间定期调用
+func RenewUid(serverName string, userID int64, key string) error {
+    if err := DB.SetFileSession(serverName, userID, key, GetUnixTime()+Config.FileSessionTTL); err != nil {
+        LogError().Println("Renew file session error", serverName, userID, err)
         return err
     }
 
-    LogInfo().Println("Session file:", fileName)
-    fout.WriteString(key)
-    LogInfo().Println("Session created:", key)
-
     return nil
 }
 
-//获取用户唯一ID
-func GetUid(serverName string, userID string) (string,error) {
-    url := Config.LogPath + serverName + "/" + userID
-
-    _, err := os.Stat(url)
-    if err != nil && os.IsNotExist(err) {
-        userIDint, _ := strconv.ParseInt(userID, 10, 64)
-        CreateUid(serverName, userIDint, GetMD5(serverName + userID))
-    }
-
-    file, err := os.Open(url)
+//获取用户所有未过期的唯一ID，用户没有登录时为空
+func GetUids(serverName string, userID string) ([]string, error) {
+    userIDint, err := String2Int64(userID)
     if err != nil {
-        LogError().Println("Cannot open file",url,err)
-        return "",err
+        return nil, err
     }
-    data, err := ioutil.ReadAll(file)
+
+    sessions, err := DB.GetFileSessions(serverName, userIDint)
     if err != nil {
-        LogError().Println("Cannot read file",url,err)
-        return "",err
+        LogError().Println("Get file session error", serverName, userID, err)
     }
-    return string(data),nil
+
+    return sessions, err
 }
 
-//删除用户唯一ID
-func DelUid(serverName string, userID string) error {
-    url := Config.LogPath + serverName + "/" + userID
-    err := Rm(url)
-    if err != nil {
-        LogError().Println("Cannot delete file",url,err)
+//删除客户端的唯一ID，用户的其他客户端不受影响
+func DelUid(serverName string, userID int64, key string) error {
+    if key == "" {
+        return nil
+    }
+
+    if err := DB.DeleteFileSession(serverName, userID, key); err != nil {
+        LogError().Println("Delete file session error", serverName, userID, err)
         return err
     }
+
     return nil
 }
+
+//删除过期的唯一ID
+func ExpireUids() {
+    deleted, err := DB.DeleteExpiredSessions()
+    if err != nil {
+        LogError().Println("Delete expired file session error", err)
+        return
+    }
+
+    if deleted > 0 {
+        LogInfo().Printf("Expired file sessions deleted: %d\n", deleted)
+    }
+}
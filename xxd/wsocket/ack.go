@@ -0,0 +1,225 @@
+/**
+ * The ack file of wsocket current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     wsocket
+ * @link        http://www.zentao.net
+ */
+package wsocket
+
+import (
+    "bytes"
+    "strconv"
+    "time"
+    "xxd/api"
+    "xxd/util"
+)
+
+// 以下方法除 ack 和 refillAck 外都在hub的goroutine中调用
+
+// 启用消息确认的客户端的未确认消息，每个用户的每种设备一个队列。
+// 同一设备重新连接的客户端接管队列，并收到所有未确认的消息
+type ackQueue struct {
+    stream    string     // 队列标识，重启或队列过期后重新生成，客户端据此判断序号是否连续
+    seq       uint64     // 最后一条消息的序号
+    acked     uint64     // 客户端确认的最大序号
+    frames    []ackFrame // 未确认的消息，按序号递增
+    idleSince time.Time  // 最后一个客户端断开的时间，有客户端在线时为零值
+}
+
+type ackFrame struct {
+    seq     uint64
+    message []byte
+}
+
+//启用确认的客户端注册后接管队列，发送队列信息后重发所有未确认的消息。
+//不支持确认的客户端在同一设备上登录时不再保留该设备的队列
+func (h *Hub) openAckQueue(client *Client) {
+    if !client.ack {
+        h.dropAckQueue(client.serverName, client.userID, client.device)
+        return
+    }
+
+    users, ok := h.acks[client.serverName]
+    if !ok {
+        users = map[int64]map[string]*ackQueue{}
+        h.acks[client.serverName] = users
+    }
+    if _, ok := users[client.userID]; !ok {
+        users[client.userID] = map[string]*ackQueue{}
+    }
+
+    queue, ok := users[client.userID][client.device]
+    if !ok {
+        queue = &ackQueue{stream: strconv.FormatInt(time.Now().UnixNano(), 36)}
+        users[client.userID][client.device] = queue
+    }
+    queue.idleSince = time.Time{}
+
+    if !h.sendToClient(client, api.AckStream(queue.stream, queue.acked)) {
+        return
+    }
+    client.ackSent = queue.acked
+    ackReplayTotal.Add(float64(len(queue.frames)), client.serverName)
+    h.flushAck(client)
+}
+
+//把队列中还没有放入send的消息按序号放入send，最多占用一半的发送缓冲，另一半留给直接发送的消息。
+//没有放完时通知writePump，writePump写出已有的消息后调用 refillAck 继续
+func (h *Hub) flushAck(client *Client) {
+    queue := h.acks[client.serverName][client.userID][client.device]
+    if queue == nil || !client.ack || !h.registered(client) {
+        return
+    }
+
+    limit := cap(client.send) / 2
+    for _, frame := range queue.frames {
+        if frame.seq <= client.ackSent {
+            continue
+        }
+
+        if len(client.send) >= limit {
+            select {
+            case client.refill <- struct{}{}:
+            default:
+            }
+            return
+        }
+
+        // readPump也会直接写入send，缓冲已满时等待下次继续
+        select {
+        case client.send <- withSeq(frame.message, frame.seq):
+            client.ackSent = frame.seq
+        default:
+            select {
+            case client.refill <- struct{}{}:
+            default:
+            }
+            return
+        }
+    }
+}
+
+//hub通知还有消息没有放入send时，继续放入下一批，在writePump中写出send中已有的消息后调用
+func (c *Client) refillAck() {
+    select {
+    case <-c.refill:
+        c.hub.do(func() { c.hub.flushAck(c) })
+    default:
+    }
+}
+
+//客户端离开后，同一设备没有其他启用确认的客户端时开始计算队列的保留时间
+func (h *Hub) releaseAckQueue(client *Client) {
+    queue := h.acks[client.serverName][client.userID][client.device]
+    if !client.ack || queue == nil {
+        return
+    }
+
+    for other := range h.clients[client.serverName][client.userID] {
+        if other.ack && other.device == client.device {
+            return
+        }
+    }
+    queue.idleSince = time.Now()
+}
+
+//把发给用户的消息加入该用户每种设备的队列，包括保留时间内已断开的设备，返回加入了队列的设备。
+//消息不是JSON对象时不加入队列
+func (h *Hub) enqueue(serverName string, userID int64, message []byte) map[string]bool {
+    queues := h.acks[serverName][userID]
+    if len(queues) == 0 || withSeq(message, 0) == nil {
+        return nil
+    }
+
+    devices := make(map[string]bool, len(queues))
+    for device, queue := range queues {
+        if int64(len(queue.frames)) >= util.Config.AckQueueSize {
+            // 队列已满时丢弃最早的消息，按发送失败处理
+            dropped := queue.frames[0]
+            queue.frames = queue.frames[1:]
+            ackDroppedTotal.Inc(serverName)
+            go sendFail(serverName, userID, [][]byte{dropped.message})
+        }
+
+        queue.seq++
+        queue.frames = append(queue.frames, ackFrame{seq: queue.seq, message: message})
+        devices[device] = true
+    }
+
+    return devices
+}
+
+//确认序号不大于seq的消息，可以在任意goroutine中调用
+func (h *Hub) ack(client *Client, seq uint64) {
+    h.do(func() {
+        queue := h.acks[client.serverName][client.userID][client.device]
+        if queue == nil || seq <= queue.acked || seq > queue.seq {
+            return
+        }
+
+        queue.acked = seq
+        i := 0
+        for i < len(queue.frames) && queue.frames[i].seq <= seq {
+            i++
+        }
+        queue.frames = queue.frames[i:]
+    })
+}
+
+//删除断开超过ackWindow的队列，未确认的消息按发送失败处理
+func (h *Hub) expireAckQueues() {
+    window := time.Duration(util.Config.AckWindow) * time.Second
+    for serverName, users := range h.acks {
+        for userID, queues := range users {
+            for device, queue := range queues {
+                if !queue.idleSince.IsZero() && time.Since(queue.idleSince) >= window {
+                    h.dropAckQueue(serverName, userID, device)
+                }
+            }
+        }
+    }
+}
+
+//删除队列，未确认的消息按发送失败处理
+func (h *Hub) dropAckQueue(serverName string, userID int64, device string) {
+    queue := h.acks[serverName][userID][device]
+    if queue == nil {
+        return
+    }
+
+    if len(queue.frames) > 0 {
+        messages := make([][]byte, 0, len(queue.frames))
+        for _, frame := range queue.frames {
+            messages = append(messages, frame.message)
+        }
+        ackDroppedTotal.Add(float64(len(messages)), serverName)
+        go sendFail(serverName, userID, messages)
+    }
+
+    delete(h.acks[serverName][userID], device)
+    if len(h.acks[serverName][userID]) == 0 {
+        delete(h.acks[serverName], userID)
+    }
+}
+
+//消息是否由 withSeq 加入了序号
+func hasSeq(message []byte) bool {
+    return bytes.HasPrefix(message, []byte(`{"seq":`))
+}
+
+//在JSON对象的开头加入序号，message不是JSON对象时返回nil
+func withSeq(message []byte, seq uint64) []byte {
+    body := bytes.TrimSpace(message)
+    if len(body) < 2 || body[0] != '{' || body[len(body)-1] != '}' {
+        return nil
+    }
+
+    framed := []byte(`{"seq":` + strconv.FormatUint(seq, 10))
+    if rest := bytes.TrimSpace(body[1:]); rest[0] != '}' {
+        framed = append(framed, ',')
+    }
+    return append(framed, body[1:]...)
+}
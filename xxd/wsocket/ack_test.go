@@ -0,0 +1,227 @@
+package wsocket
+
+import (
+    "encoding/json"
+    "reflect"
+    "sort"
+    "strconv"
+    "testing"
+    "time"
+    "xxd/util"
+
+    "github.com/gorilla/websocket"
+)
+
+type ackStreamResult struct {
+    Method string `json:"method"`
+    Data   struct {
+        Stream string `json:"stream"`
+        Acked  uint64 `json:"acked"`
+    } `json:"data"`
+}
+
+func setAckConfig(t *testing.T, size, window int64) {
+    oldSize, oldWindow := util.Config.AckQueueSize, util.Config.AckWindow
+    util.Config.AckQueueSize, util.Config.AckWindow = size, window
+    t.Cleanup(func() { util.Config.AckQueueSize, util.Config.AckWindow = oldSize, oldWindow })
+}
+
+func registerAckClient(t *testing.T, hub *Hub, userID int64) (*Client, ackStreamResult) {
+    client := &Client{hub: hub, send: make(chan []byte, 256), refill: make(chan struct{}, 1), serverName: testServerName, userID: userID, device: defaultDevice, ack: true, connectTime: time.Now()}
+    cRegister := &ClientRegister{client: client, retClient: make(chan *Client)}
+    hub.register <- cRegister
+    if <-cRegister.retClient == nil {
+        t.Fatal("register error")
+    }
+
+    var stream ackStreamResult
+    if err := json.Unmarshal([]byte(receive(t, client)), &stream); err != nil || stream.Method != "ack" || stream.Data.Stream == "" {
+        t.Fatalf("ack stream %+v, %v", stream, err)
+    }
+    return client, stream
+}
+
+func chatMessage(gid string) []byte {
+    return []byte(`{"module":"chat","method":"message","data":[{"gid":"` + gid + `"}]}`)
+}
+
+func sendfailGids(t *testing.T, userID int64) []string {
+    sendfail, err := util.DB.SelectSendfail(testServerName)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return sendfail[int(userID)]
+}
+
+func TestWithSeq(t *testing.T) {
+    for message, expected := range map[string]string{
+        `{"module":"chat"}`: `{"seq":7,"module":"chat"}`,
+        ` {"a":1} `:         `{"seq":7,"a":1}`,
+        `{}`:                `{"seq":7}`,
+        `{ }`:               `{"seq":7 }`,
+    } {
+        if framed := string(withSeq([]byte(message), 7)); framed != expected {
+            t.Errorf("%s framed as %s", message, framed)
+        }
+    }
+
+    for _, message := range []string{``, `[1]`, `"text"`} {
+        if framed := withSeq([]byte(message), 7); framed != nil {
+            t.Errorf("%s framed as %s", message, framed)
+        }
+    }
+}
+
+func TestAckRedelivery(t *testing.T) {
+    setAckConfig(t, 100, 300)
+    setLoginPolicy(t, util.LoginPerDevice)
+    hub := newTestHub(testServerName)
+    legacy := &Client{hub: hub, send: make(chan []byte, 256), serverName: testServerName, userID: 41, device: "web"}
+    hub.register <- &ClientRegister{client: legacy, retClient: make(chan *Client, 1)}
+
+    client, stream := registerAckClient(t, hub, 41)
+    for i := 1; i <= 3; i++ {
+        hub.multicast <- SendMsg{serverName: testServerName, usersID: []int64{41}, message: chatMessage("g" + strconv.Itoa(i))}
+        if message := receive(t, client); message != `{"seq":`+strconv.Itoa(i)+`,"module":"chat","method":"message","data":[{"gid":"g`+strconv.Itoa(i)+`"}]}` {
+            t.Errorf("ack client got %s", message)
+        }
+        if message := receive(t, legacy); message != string(chatMessage("g"+strconv.Itoa(i))) {
+            t.Errorf("legacy client got %s", message)
+        }
+    }
+
+    if err := switchMethod(map[string]interface{}{"module": "chat", "method": "ack", "params": []interface{}{float64(2)}}, client); err != nil {
+        t.Fatal(err)
+    }
+
+    // 断开期间发给用户的消息也保留在队列中
+    hub.unregister <- client
+    hub.multicast <- SendMsg{serverName: testServerName, usersID: []int64{41}, message: chatMessage("g4")}
+
+    reconnected, resumed := registerAckClient(t, hub, 41)
+    if resumed.Data.Stream != stream.Data.Stream || resumed.Data.Acked != 2 {
+        t.Errorf("resumed stream %+v, was %+v", resumed, stream)
+    }
+    for _, expected := range []string{`{"seq":3,`, `{"seq":4,`} {
+        if message := receive(t, reconnected); message[:len(expected)] != expected {
+            t.Errorf("replayed %s, expected %s", message, expected)
+        }
+    }
+
+    // 确认不存在的序号时忽略
+    hub.ack(reconnected, 9)
+    hub.ack(reconnected, 4)
+    hub.do(func() {
+        if queue := hub.acks[testServerName][41][defaultDevice]; len(queue.frames) != 0 || queue.acked != 4 {
+            t.Errorf("queue after ack %+v", queue)
+        }
+    })
+}
+
+func TestAckQueueLimit(t *testing.T) {
+    setAckConfig(t, 2, 0)
+    hub := newTestHub(testServerName)
+    client, stream := registerAckClient(t, hub, 42)
+    hub.unregister <- client
+
+    for i := 1; i <= 3; i++ {
+        hub.multicast <- SendMsg{serverName: testServerName, usersID: []int64{42}, message: chatMessage("limit" + strconv.Itoa(i))}
+    }
+
+    // 队列已满时最早的消息记录为发送失败
+    eventually(t, "dropped message was not recorded", func() bool {
+        gids := sendfailGids(t, 42)
+        return len(gids) == 1 && gids[0] == "limit1"
+    })
+
+    reconnected, _ := registerAckClient(t, hub, 42)
+    for _, expected := range []string{`{"seq":2,`, `{"seq":3,`} {
+        if message := receive(t, reconnected); message[:len(expected)] != expected {
+            t.Errorf("replayed %s, expected %s", message, expected)
+        }
+    }
+
+    // 超过保留时间后队列被删除，未确认的消息记录为发送失败，重新连接时使用新的队列
+    hub.unregister <- reconnected
+    hub.do(hub.expireAckQueues)
+    eventually(t, "expired messages were not recorded", func() bool {
+        return len(sendfailGids(t, 42)) == 3
+    })
+
+    if _, resumed := registerAckClient(t, hub, 42); resumed.Data.Stream == stream.Data.Stream || resumed.Data.Acked != 0 {
+        t.Errorf("expired queue was resumed %+v", resumed)
+    }
+    util.DB.DeleteSendfail(testServerName, map[int][]string{42: sendfailGids(t, 42)})
+}
+
+func TestAckBroadcastWhileDisconnected(t *testing.T) {
+    setAckConfig(t, 100, 300)
+    hub := newTestHub(testServerName)
+    client, _ := registerAckClient(t, hub, 43)
+    hub.unregister <- client
+
+    hub.broadcast <- SendMsg{serverName: testServerName, message: chatMessage("broadcast")}
+
+    reconnected, _ := registerAckClient(t, hub, 43)
+    if message := receive(t, reconnected); message != `{"seq":1,"module":"chat","method":"message","data":[{"gid":"broadcast"}]}` {
+        t.Errorf("replayed %s", message)
+    }
+}
+
+// 启用确认的客户端写入失败时，带序号的消息留在队列中，没有序号的消息记录为发送失败
+func TestAckWriteFail(t *testing.T) {
+    setAckConfig(t, 100, 300)
+    hub := newTestHub(testServerName)
+    client, _ := registerAckClient(t, hub, 44)
+
+    hub.multicast <- SendMsg{serverName: testServerName, usersID: []int64{44}, message: chatMessage("queued")}
+    hub.do(func() {})
+    client.send <- chatMessage("direct")
+    client.writeFail(chatMessage("login"), websocket.ErrCloseSent)
+
+    eventually(t, "unsequenced messages were not recorded", func() bool {
+        return len(sendfailGids(t, 44)) == 2
+    })
+    gids := sendfailGids(t, 44)
+    sort.Strings(gids)
+    if !reflect.DeepEqual(gids, []string{"direct", "login"}) {
+        t.Errorf("sendfail %v", gids)
+    }
+    util.DB.DeleteSendfail(testServerName, map[int][]string{44: gids})
+}
+
+// 重发的消息超过发送缓冲时分批放入send，客户端不会因为缓冲已满被断开
+func TestAckReplayLargeQueue(t *testing.T) {
+    setAckConfig(t, 1000, 300)
+    hub := newTestHub(testServerName)
+    client, _ := registerAckClient(t, hub, 45)
+    hub.unregister <- client
+
+    total := 2*cap(client.send) + 10
+    for i := 1; i <= total; i++ {
+        hub.multicast <- SendMsg{serverName: testServerName, usersID: []int64{45}, message: chatMessage("busy" + strconv.Itoa(i))}
+    }
+
+    reconnected, _ := registerAckClient(t, hub, 45)
+    // 断开期间的消息都发完前，新消息排在它们后面
+    hub.multicast <- SendMsg{serverName: testServerName, usersID: []int64{45}, message: chatMessage("live")}
+
+    for i := 1; i <= total+1; i++ {
+        // 模拟 writePump，写出send中已有的消息后继续放入下一批
+        if len(reconnected.send) == 0 {
+            reconnected.refillAck()
+        }
+
+        expected := `{"seq":` + strconv.Itoa(i) + `,`
+        if message := receive(t, reconnected); message[:len(expected)] != expected {
+            t.Fatalf("replayed %s, expected %s", message, expected)
+        }
+    }
+
+    hub.do(func() {
+        if !hub.registered(reconnected) {
+            t.Error("client was dropped while replaying")
+        }
+    })
+}
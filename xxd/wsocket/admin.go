@@ -0,0 +1,211 @@
+/**
+ * The admin file of wsocket current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     wsocket
+ * @link        http://www.zentao.net
+ */
+package wsocket
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+    "xxd/api"
+    "xxd/cluster"
+    "xxd/hyperttp/server"
+    "xxd/util"
+)
+
+// 管理接口路由，注册在通用端口上
+const (
+    adminClients = "/admin/clients"
+    adminKick    = "/admin/kick"
+    adminNotice  = "/admin/notice"
+)
+
+// 管理接口返回的在线客户端信息
+type clientInfo struct {
+    UserID      int64     `json:"userID"`
+    Device      string    `json:"device"`
+    RemoteAddr  string    `json:"remoteAddr"`
+    CVer        string    `json:"cVer"`
+    Lang        string    `json:"lang"`
+    ConnectTime time.Time `json:"connectTime"`
+    SendQueue   int       `json:"sendQueue"`
+}
+
+type adminResult struct {
+    Result  string      `json:"result"`
+    Message string      `json:"message,omitempty"`
+    Data    interface{} `json:"data,omitempty"`
+}
+
+func initAdmin(hub *Hub) {
+    server.HandleFunc(adminClients, adminAuth(func(w http.ResponseWriter, r *http.Request) {
+        listClients(hub, w, r)
+    }))
+    server.HandleFunc(adminKick, adminAuth(func(w http.ResponseWriter, r *http.Request) {
+        kickClient(hub, w, r)
+    }))
+    server.HandleFunc(adminNotice, adminAuth(func(w http.ResponseWriter, r *http.Request) {
+        sendNotice(hub, w, r)
+    }))
+}
+
+//没有配置adminToken时管理接口不存在，token错误返回401
+func adminAuth(handler http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if util.Config.AdminToken == "" {
+            http.NotFound(w, r)
+            return
+        }
+
+        if !server.VerifyBearer(r, util.Config.AdminToken) {
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+
+        handler(w, r)
+    }
+}
+
+//在线客户端列表，按服务器分组，server参数为空时返回所有服务器
+func listClients(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        writeAdminResult(w, http.StatusMethodNotAllowed, adminResult{Result: "fail", Message: "not supported request"})
+        return
+    }
+
+    serverName := r.FormValue("server")
+    list := make(map[string][]clientInfo)
+    found := false
+
+    ok := hub.do(func() {
+        for name, clients := range hub.clients {
+            if serverName != "" && name != serverName {
+                continue
+            }
+
+            found = true
+            infos := make([]clientInfo, 0, len(clients))
+            for _, devices := range clients {
+                for client := range devices {
+                    infos = append(infos, clientInfo{
+                        UserID:      client.userID,
+                        Device:      client.device,
+                        RemoteAddr:  client.conn.RemoteAddr().String(),
+                        CVer:        client.cVer,
+                        Lang:        client.lang,
+                        ConnectTime: client.connectTime,
+                        SendQueue:   len(client.send)})
+                }
+            }
+            list[name] = infos
+        }
+    })
+
+    if !ok {
+        writeAdminResult(w, http.StatusServiceUnavailable, adminResult{Result: "fail", Message: "hub not running"})
+        return
+    }
+
+    if serverName != "" && !found {
+        writeAdminResult(w, http.StatusNotFound, adminResult{Result: "fail", Message: "no ranzhi server name"})
+        return
+    }
+
+    writeAdminResult(w, http.StatusOK, adminResult{Result: "success", Data: list})
+}
+
+//强制用户下线，参数server、userID、reason
+func kickClient(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        writeAdminResult(w, http.StatusMethodNotAllowed, adminResult{Result: "fail", Message: "not supported request"})
+        return
+    }
+
+    serverName := r.FormValue("server")
+    if serverName == "" {
+        serverName = util.GetDefaultServer()
+    }
+
+    userID, err := util.String2Int64(r.FormValue("userID"))
+    if err != nil {
+        writeAdminResult(w, http.StatusBadRequest, adminResult{Result: "fail", Message: "invalid userID"})
+        return
+    }
+
+    message := api.AdminKickoff(r.FormValue("reason"))
+    kicked := false
+    if !hub.do(func() { kicked = hub.kickoffCluster(serverName, userID, message) }) {
+        writeAdminResult(w, http.StatusServiceUnavailable, adminResult{Result: "fail", Message: "hub not running"})
+        return
+    }
+
+    if !kicked {
+        writeAdminResult(w, http.StatusNotFound, adminResult{Result: "fail", Message: "user not online"})
+        return
+    }
+
+    util.LogInfo().Printf("admin kickoff server:%s user:%d remote:%s\n", serverName, userID, r.RemoteAddr)
+    writeAdminResult(w, http.StatusOK, adminResult{Result: "success"})
+}
+
+//发送系统通知，参数message，server为空时发送到所有服务器，返回本节点收到通知的用户数
+func sendNotice(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        writeAdminResult(w, http.StatusMethodNotAllowed, adminResult{Result: "fail", Message: "not supported request"})
+        return
+    }
+
+    notice := r.FormValue("message")
+    if notice == "" {
+        writeAdminResult(w, http.StatusBadRequest, adminResult{Result: "fail", Message: "message is empty"})
+        return
+    }
+
+    serverName := r.FormValue("server")
+    message := api.SystemNotice(notice)
+    recipients := make(map[string]int)
+    found := false
+
+    ok := hub.do(func() {
+        for name := range hub.clients {
+            if serverName != "" && name != serverName {
+                continue
+            }
+
+            found = true
+            recipients[name] = hub.sendAll(SendMsg{serverName: name, message: message})
+            hub.publish(&cluster.Message{Type: cluster.TypeBroadcast, Server: name, Payload: message})
+        }
+    })
+
+    if !ok {
+        writeAdminResult(w, http.StatusServiceUnavailable, adminResult{Result: "fail", Message: "hub not running"})
+        return
+    }
+
+    if serverName != "" && !found {
+        writeAdminResult(w, http.StatusNotFound, adminResult{Result: "fail", Message: "no ranzhi server name"})
+        return
+    }
+
+    writeAdminResult(w, http.StatusOK, adminResult{Result: "success", Data: recipients})
+}
+
+func writeAdminResult(w http.ResponseWriter, status int, result adminResult) {
+    jsonData, err := json.Marshal(result)
+    if err != nil {
+        util.LogError().Println("json unmarshal error:", err)
+        w.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    w.Write(jsonData)
+}
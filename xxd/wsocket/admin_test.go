@@ -0,0 +1,115 @@
+package wsocket
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+    "xxd/util"
+)
+
+func newTestHub(serverName string, userIDs ...int64) *Hub {
+    hub := newHub()
+    hub.clients = map[string]map[int64]clientSet{serverName: {}}
+
+    for _, userID := range userIDs {
+        client := &Client{hub: hub, send: make(chan []byte, 256), serverName: serverName, userID: userID, device: defaultDevice}
+        hub.clients[serverName][userID] = clientSet{client: true}
+    }
+
+    go hub.run()
+    return hub
+}
+
+// newTestHub 创建的用户的客户端，在hub处理其他客户端之前调用
+func userClient(hub *Hub, serverName string, userID int64) *Client {
+    for client := range hub.clients[serverName][userID] {
+        return client
+    }
+
+    return nil
+}
+
+func adminRequest(t *testing.T, handler http.HandlerFunc, token string, form url.Values) (int, adminResult) {
+    r := httptest.NewRequest("POST", "/admin", strings.NewReader(form.Encode()))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    if token != "" {
+        r.Header.Set("Authorization", "Bearer "+token)
+    }
+
+    w := httptest.NewRecorder()
+    adminAuth(handler)(w, r)
+
+    var result adminResult
+    if w.Code != http.StatusUnauthorized && w.Code != http.StatusNotFound {
+        if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+            t.Fatalf("bad admin response %q: %v", w.Body.String(), err)
+        }
+    }
+
+    return w.Code, result
+}
+
+func TestAdminAuth(t *testing.T) {
+    hub := newTestHub("xuanxuan", 1)
+    notice := func(w http.ResponseWriter, r *http.Request) { sendNotice(hub, w, r) }
+    form := url.Values{"message": {"hello"}}
+
+    defer func(token string) { util.Config.AdminToken = token }(util.Config.AdminToken)
+
+    util.Config.AdminToken = ""
+    if code, _ := adminRequest(t, notice, "secret", form); code != http.StatusNotFound {
+        t.Errorf("admin api without adminToken returned %d", code)
+    }
+
+    util.Config.AdminToken = "secret"
+    if code, _ := adminRequest(t, notice, "wrong", form); code != http.StatusUnauthorized {
+        t.Errorf("wrong admin token returned %d", code)
+    }
+
+    if code, _ := adminRequest(t, notice, "secret", form); code != http.StatusOK {
+        t.Errorf("admin notice returned %d", code)
+    }
+}
+
+func TestAdminKickAndNotice(t *testing.T) {
+    hub := newTestHub("xuanxuan", 1, 2)
+    kicked := userClient(hub, "xuanxuan", 1)
+    kick := func(w http.ResponseWriter, r *http.Request) { kickClient(hub, w, r) }
+    notice := func(w http.ResponseWriter, r *http.Request) { sendNotice(hub, w, r) }
+
+    defer func(token string) { util.Config.AdminToken = token }(util.Config.AdminToken)
+    util.Config.AdminToken = "secret"
+
+    code, _ := adminRequest(t, kick, "secret", url.Values{"server": {"xuanxuan"}, "userID": {"1"}, "reason": {"bye"}})
+    if code != http.StatusOK {
+        t.Fatalf("kick returned %d", code)
+    }
+
+    if message := <-kicked.send; !strings.Contains(string(message), `"bye"`) {
+        t.Errorf("kicked client got %s", message)
+    }
+
+    if _, ok := <-kicked.send; ok {
+        t.Error("kicked client send channel is still open")
+    }
+
+    if code, _ := adminRequest(t, kick, "secret", url.Values{"server": {"xuanxuan"}, "userID": {"1"}}); code != http.StatusNotFound {
+        t.Errorf("kicking an offline user returned %d", code)
+    }
+
+    code, result := adminRequest(t, notice, "secret", url.Values{"message": {"maintenance"}})
+    if code != http.StatusOK {
+        t.Fatalf("notice returned %d", code)
+    }
+
+    if recipients := result.Data.(map[string]interface{})["xuanxuan"]; recipients != float64(1) {
+        t.Errorf("notice recipients %v, want 1", recipients)
+    }
+
+    if code, _ := adminRequest(t, notice, "secret", url.Values{"server": {"nosuch"}, "message": {"x"}}); code != http.StatusNotFound {
+        t.Errorf("notice to unknown backend returned %d", code)
+    }
+}
@@ -11,6 +11,9 @@ package wsocket
 
 import (
     "net/http"
+    "strconv"
+    "strings"
+    "sync"
     "time"
 
     "github.com/gorilla/websocket"
@@ -30,6 +33,9 @@ const (
 
     // Maximum message size allowed from peer.
     maxMessageSize = 20480
+
+    // Device type of clients without the xxd-device header.
+    defaultDevice = "desktop"
 )
 
 var (
@@ -47,11 +53,32 @@ type Client struct {
     hub         *Hub
     conn        *websocket.Conn // The websocket connection.
     send        chan []byte     // Buffered channel of outbound messages.
+    quit        chan struct{}   // Closed by the hub on shutdown while the client has not logged in.
     serverName  string          // User server
     userID      int64           // Send to user id
     repeatLogin bool
     cVer        string //client version
     lang        string
+    crypto      string // Negotiated crypto protocol, cbc or gcm
+    keyID       string // Session key id, empty when the client uses util.Token
+    device      string // Device type from the xxd-device header, desktop, web or mobile
+    ack         bool   // Client acknowledges messages by sequence, from the xxd-ack header
+    ackSent     uint64 // Last sequence number put into send, only used by the hub.
+    refill      chan struct{} // Signalled by the hub when queued messages are waiting for room in send.
+    fileSession string // File session id for legacy download links, revoked on logout
+    renewAt     time.Time // Time to renew the file session, only used by readPump.
+    keys        clientKeys
+    connectTime time.Time // Time the websocket connection was established.
+
+    closeMessage []byte // Payload of the close frame, set by the hub before closing send.
+}
+
+// Session keys of a client. writePump rotates the key, readPump also accepts the
+// previous key until the client sends a message with the new one.
+type clientKeys struct {
+    mu       sync.RWMutex
+    current  []byte
+    previous []byte
 }
 
 type ClientRegister struct {
@@ -68,22 +95,22 @@ type SendMsg struct {
 
 //解析数据.
 func dataProcessing(message []byte, client *Client) error {
-    parseData, err := api.ApiParse(message, util.Token)
-	parseData["client"] = client.conn.RemoteAddr()
+    parseData, err := client.parse(message)
     if err != nil {
         util.LogError().Println("receive client message error")
         return err
     }
+    parseData["client"] = client.conn.RemoteAddr()
 
     if util.IsTest && parseData.Test() {
-        return testSwitchMethod(message, parseData, client)
+        return testSwitchMethod(parseData, client)
     }
 
-    return switchMethod(api.ApiUnparse(parseData, util.Token), parseData, client)
+    return switchMethod(parseData, client)
 }
 
 //根据不同的消息体选择对应的处理方法
-func switchMethod(message []byte, parseData api.ParseData, client *Client) error {
+func switchMethod(parseData api.ParseData, client *Client) error {
 
     switch parseData.Module() + "." + parseData.Method() {
     case "chat.login":
@@ -94,6 +121,22 @@ func switchMethod(message []byte, parseData api.ParseData, client *Client) error
 
         break
 
+    case "chat.downloadUrl":
+
+        if err := chatDownloadURL(parseData, client); err != nil {
+            return err
+        }
+
+        break
+
+    case "chat.ack":
+
+        if err := chatAck(parseData, client); err != nil {
+            return err
+        }
+
+        break
+
     case "chat.logout":
         client.conn.Close()
         /*
@@ -104,7 +147,7 @@ func switchMethod(message []byte, parseData api.ParseData, client *Client) error
         break
 
     default:
-        err := transitData(message, parseData.UserID(), client)
+        err := transitData(parseData, client)
         if err != nil {
             util.LogError().Println(err)
         }
@@ -116,13 +159,18 @@ func switchMethod(message []byte, parseData api.ParseData, client *Client) error
 
 //用户登录
 func chatLogin(parseData api.ParseData, client *Client) error {
+    // 注册后hub会读取serverName和userID，同一个连接不能再次登录
+    if client.userID != 0 {
+        return util.Errorf("%s", "chat login repeated on the same connection")
+    }
+
     client.serverName = parseData.ServerName()
     if client.serverName == "" {
-        client.serverName = util.Config.DefaultServer
+        client.serverName = util.GetDefaultServer()
     }
 
     if(util.Config.MaxOnlineUser > 0) {
-        onlineUser := len(client.hub.clients[client.serverName])
+        onlineUser := client.hub.clusterOnlineCount(client.serverName)
         if(int64(onlineUser) >= util.Config.MaxOnlineUser) {
             client.send <- api.BlockLogin()
             return util.Errorf("Exceeded the maximum limit.")
@@ -130,9 +178,7 @@ func chatLogin(parseData api.ParseData, client *Client) error {
     }
 
     client.lang = parseData.Lang()
-    if _, ok := util.Languages[client.lang]; ok == false {
-        util.Languages[client.lang] = client.lang
-    }
+    util.AddLanguage(client.lang)
 
     loginData, userID, ok := api.ChatLogin(parseData)
     if userID == -1 {
@@ -149,16 +195,23 @@ func chatLogin(parseData api.ParseData, client *Client) error {
     client.send <- loginData
 
     client.userID = userID
+    if client.keyID != "" {
+        api.BindSessionKey(client.keyID, client.serverName, client.userID)
+    }
 
-    // 生成并存储文件会员
-    userFileSessionID, err := api.UserFileSessionID(client.serverName, client.userID, client.lang)
-    if err != nil {
-        util.LogError().Println("chat user create file session error:", err)
-        //返回给客户端登录失败的错误信息
-        return err
+    // 生成并存储文件会员，只用于旧的下载链接
+    if util.Config.LegacyDownload {
+        userFileSessionID, sessionID, err := api.UserFileSessionID(client.serverName, client.userID, client.lang)
+        if err != nil {
+            util.LogError().Println("chat user create file session error:", err)
+            //返回给客户端登录失败的错误信息
+            return err
+        }
+        client.fileSession = sessionID
+        client.renewAt = time.Now().Add(time.Duration(util.Config.FileSessionTTL) * time.Second / 2)
+        // 成功后返回userFileSessionID数据给客户端
+        client.send <- userFileSessionID
     }
-    // 成功后返回userFileSessionID数据给客户端
-    client.send <- userFileSessionID
 
     // 获取所有用户列表
     getList, err := api.UserGetlist(client.serverName, client.userID, client.lang)
@@ -203,14 +256,39 @@ func chatLogin(parseData api.ParseData, client *Client) error {
     cRegister := &ClientRegister{client: client, retClient: make(chan *Client)}
     defer close(cRegister.retClient)
 
-    // 以上成功后把socket加入到管理
+    // 以上成功后把socket加入到管理，重复登录时hub会通知旧的客户端
     client.hub.register <- cRegister
-    if retClient := <-cRegister.retClient; retClient.repeatLogin {
-        //客户端收到信息后需要关闭socket连接，否则连接不会断开
-        retClient.send <- api.RepeatLogin()
+    if retClient := <-cRegister.retClient; retClient == nil {
+        return util.Errorf("%s", "chat login register error")
+    }
+
+    return nil
+}
+
+//签发文件下载链接，只能为当前连接登录的用户签发
+func chatDownloadURL(parseData api.ParseData, client *Client) error {
+    if client.userID == 0 || client.userID != parseData.UserID() {
+        return util.Errorf("%s", "user id err")
+    }
+
+    // 客户端可能已被挤下线，不能直接写入send
+    client.hub.sendClient(client, api.DownloadURL(parseData, client.serverName, client.userID))
+    return nil
+}
+
+//客户端确认收到的消息，确认序号不大于params[0]的所有消息
+func chatAck(parseData api.ParseData, client *Client) error {
+    if client.userID == 0 {
+        return util.Errorf("%s", "chat ack before login")
+    }
+
+    seq, err := strconv.ParseUint(parseData.Param(0), 10, 64)
+    if err != nil || !client.ack {
+        util.LogError().Println("chat ack ignored:", parseData.Param(0))
         return nil
     }
 
+    client.hub.ack(client, seq)
     return nil
 }
 
@@ -219,24 +297,29 @@ func chatLogout(userID int64, client *Client) error {
     if client.userID != userID {
         return util.Errorf("%s", "user id error.")
     }
-    if client.repeatLogin {
+
+    // 只删除本客户端的文件会话，重复登录被挤下线时也要删除
+    util.DelUid(client.serverName, client.userID, client.fileSession)
+    client.fileSession = ""
+
+    // 被挤下线或用户还有其他客户端在线时不通知后端服务器
+    if client.hub.replacedOrOnline(client) {
         return nil
     }
     x2cMessage, sendUsers, err := api.ChatLogout(client.serverName, client.userID, client.lang)
     if err != nil {
         return err
     }
-    util.DelUid(client.serverName, util.Int642String(client.userID))
     return X2cSend(client.serverName, sendUsers, x2cMessage, client)
 }
 
 //交换数据
-func transitData(message []byte, userID int64, client *Client) error {
-    if client.userID != userID {
+func transitData(parseData api.ParseData, client *Client) error {
+    if client.userID != parseData.UserID() {
         return util.Errorf("%s", "user id err")
     }
 
-    x2cMessage, sendUsers, err := api.TransitData(message, client.serverName)
+    x2cMessage, sendUsers, err := api.TransitData(parseData, client.serverName)
     if err != nil {
         // 与然之服务器交互失败后，生成error并返回到客户端
         errMsg, retErr := api.RetErrorMsg("0", "time out")
@@ -244,7 +327,7 @@ func transitData(message []byte, userID int64, client *Client) error {
             return retErr
         }
 
-        client.send <- errMsg
+        client.hub.sendClient(client, errMsg)
         return err
     }
 
@@ -254,13 +337,18 @@ func transitData(message []byte, userID int64, client *Client) error {
 //Send the message from XXD to XXC.
 //If the user is empty, broadcast messages.
 func X2cSend(serverName string, sendUsers []int64, message []byte, client *Client) error {
+    client.hub.fanOut(serverName, sendUsers, message)
+    return nil
+}
+
+//发送后端服务器返回的消息，用户为空时广播
+func (h *Hub) fanOut(serverName string, sendUsers []int64, message []byte) {
     if len(sendUsers) == 0 {
-        client.hub.broadcast <- SendMsg{serverName: serverName, message: message}
-        return nil
+        h.broadcast <- SendMsg{serverName: serverName, message: message}
+        return
     }
 
-    client.hub.multicast <- SendMsg{serverName: serverName, usersID: sendUsers, message: message}
-    return nil
+    h.multicast <- SendMsg{serverName: serverName, usersID: sendUsers, message: message}
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -273,11 +361,18 @@ func (c *Client) readPump() {
         c.hub.unregister <- c
         c.conn.Close()
         chatLogout(c.userID, c) // user logout
+        if c.keyID != "" {
+            api.ReleaseSessionKey(c.keyID)
+        }
     }()
 
     c.conn.SetReadLimit(maxMessageSize)
     c.conn.SetReadDeadline(time.Now().Add(pongWait))
-    c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+    c.conn.SetPongHandler(func(string) error {
+        c.conn.SetReadDeadline(time.Now().Add(pongWait))
+        c.renewFileSession()
+        return nil
+    })
 
     for util.Run {
         _, message, err := c.conn.ReadMessage()
@@ -298,6 +393,17 @@ func (c *Client) readPump() {
     }
 }
 
+//连接期间文件会话过半有效期时延长，pong在readPump中处理，与登录和退出在同一个goroutine
+func (c *Client) renewFileSession() {
+    if c.fileSession == "" || time.Now().Before(c.renewAt) {
+        return
+    }
+
+    if util.RenewUid(c.serverName, c.userID, c.fileSession) == nil {
+        c.renewAt = time.Now().Add(time.Duration(util.Config.FileSessionTTL) * time.Second / 2)
+    }
+}
+
 // writePump pumps messages from the hub to the websocket connection.
 //
 // A goroutine running writePump is started for each connection. The
@@ -305,9 +411,19 @@ func (c *Client) readPump() {
 // executing all writes from this goroutine.
 func (c *Client) writePump() {
     ticker := time.NewTicker(pingPeriod)
+
+    // 使用会话密钥的客户端定期轮换密钥
+    var rotate <-chan time.Time
+    if c.keyID != "" && util.Config.SessionKeyRotate > 0 {
+        rotateTicker := time.NewTicker(time.Duration(util.Config.SessionKeyRotate) * time.Second)
+        defer rotateTicker.Stop()
+        rotate = rotateTicker.C
+    }
+
     defer func() {
         ticker.Stop()
         c.conn.Close()
+        c.hub.pumps.Done()
     }()
 
     for util.Run {
@@ -316,46 +432,152 @@ func (c *Client) writePump() {
             c.conn.SetWriteDeadline(time.Now().Add(writeWait))
             if !ok {
                 // The hub closed the channel.
-                c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+                c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage)
                 util.LogError().Println("The hub closed the channel")
                 return
             }
-            if err := c.conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
-                go sendFail(message, c)
-                util.LogError().Println("write message error", err)
+            if err := c.writeMessage(message); err != nil {
+                c.writeFail(message, err)
                 return
             }
 
             n := len(c.send)
             for i := 0; i < n; i++ {
-                if err := c.conn.WriteMessage(websocket.BinaryMessage, <-c.send); err != nil {
-                    util.LogError().Println("write message error", err)
+                message := <-c.send
+                if err := c.writeMessage(message); err != nil {
+                    c.writeFail(message, err)
                     return
                 }
             }
+            c.refillAck()
+        case <-c.quit:
+            c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+            c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage)
+            return
+
         case <-ticker.C:
             c.conn.SetWriteDeadline(time.Now().Add(writeWait))
             if err := c.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
                 util.LogError().Println("write ping message error:", err)
                 return
             }
+
+        case <-rotate:
+            c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+            if err := c.rotateKey(); err != nil {
+                util.LogError().Println("rotate session key error:", err)
+                return
+            }
         }
     }
 }
 
-func sendFail(message []byte, c *Client) {
-    parseData, err := api.ApiParse(message, util.Token)
+//按客户端协商的协议和会话密钥加密后写入连接
+func (c *Client) writeMessage(message []byte) error {
+    c.keys.mu.RLock()
+    key := c.keys.current
+    c.keys.mu.RUnlock()
+
+    crypted, err := api.Encrypt(message, key, c.crypto)
     if err != nil {
-        util.LogError().Println("receive client message error")
-        return
+        return util.Errorf("encrypt message error: %v", err)
     }
 
-    if parseData.Module()+"."+parseData.Method() == "chat.message" {
+    return c.conn.WriteMessage(websocket.BinaryMessage, crypted)
+}
+
+//用当前密钥解密，失败时尝试轮换前的密钥
+func (c *Client) parse(message []byte) (api.ParseData, error) {
+    c.keys.mu.RLock()
+    current, previous := c.keys.current, c.keys.previous
+    c.keys.mu.RUnlock()
+
+    jsonData, err := api.Decrypt(message, current, c.crypto)
+    if err == nil && previous != nil {
+        // 客户端已经使用新的密钥，旧密钥不再有效
+        c.keys.mu.Lock()
+        c.keys.previous = nil
+        c.keys.mu.Unlock()
+    }
+
+    if err != nil && previous != nil {
+        jsonData, err = api.Decrypt(message, previous, c.crypto)
+    }
+
+    if err != nil {
+        return nil, err
+    }
+
+    return api.JsonParse(jsonData)
+}
+
+//用旧密钥把新密钥发送给客户端，之后的消息使用新密钥加密
+func (c *Client) rotateKey() error {
+    key, err := api.RotateSessionKey(c.keyID)
+    if err != nil {
+        return err
+    }
+
+    if err := c.writeMessage(api.SessionKeyMessage(c.keyID, key)); err != nil {
+        return err
+    }
+
+    c.keys.mu.Lock()
+    c.keys.previous = c.keys.current
+    c.keys.current = key
+    c.keys.mu.Unlock()
+
+    return nil
+}
+
+//写入失败时记录发送失败的消息，包括发送队列中还没有写入的消息。
+//启用确认的客户端带序号的消息在确认队列中，重新连接后重发，只记录没有序号的消息，如登录时直接发送的消息
+func (c *Client) writeFail(message []byte, err error) {
+    util.LogError().Println("write message error", err)
+
+    messages := [][]byte{message}
+    for n := len(c.send); n > 0; n-- {
+        message, ok := <-c.send
+        if !ok {
+            break
+        }
+        messages = append(messages, message)
+    }
+
+    if c.ack {
+        unsequenced := messages[:0]
+        for _, message := range messages {
+            if !hasSeq(message) {
+                unsequenced = append(unsequenced, message)
+            }
+        }
+        messages = unsequenced
+    }
+
+    go sendFail(c.serverName, c.userID, messages)
+}
+
+//记录发送失败的chat.message消息的会话，上报后端服务器
+func sendFail(serverName string, userID int64, messages [][]byte) {
+    for _, message := range messages {
+        parseData, err := api.JsonParse(message)
+        if err != nil {
+            util.LogError().Println("receive client message error")
+            continue
+        }
+
+        if parseData.Module()+"."+parseData.Method() != "chat.message" {
+            continue
+        }
+
         if data, ok := parseData["data"].([]interface{}); ok {
             for _, item := range data {
-                dataMap := item.(map[string]interface{})
+                dataMap, ok := item.(map[string]interface{})
+                if !ok {
+                    continue
+                }
                 if gid, ok := dataMap["gid"].(string); ok {
-                    util.DBInsertSendfail(c.serverName, c.userID, gid)
+                    util.DBInsertSendfail(serverName, userID, gid)
                 }
             }
         }
@@ -367,18 +589,85 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
     // Delete origin header @see https://www.iphpt.com/detail/86/
     r.Header.Del("Origin")
 
-    //将xxd版本信息通过header返回给客户端
-    header := http.Header{"User-Agent": {"easysoft/xuan.im"}, "xxd-version": {util.Version}}
+    crypto, ok := negotiateCrypto(r.Header.Get("xxd-crypto"))
+    if !ok {
+        util.LogError().Println("serve ws crypto not supported:", r.Header.Get("xxd-crypto"))
+        http.Error(w, "crypto not supported", http.StatusBadRequest)
+        return
+    }
+
+    keyID := r.Header.Get("xxd-key-id")
+    key, ok := clientKey(keyID)
+    if !ok {
+        util.LogError().Println("serve ws session key invalid:", keyID)
+        http.Error(w, "session key invalid", http.StatusUnauthorized)
+        return
+    }
+
+    //将xxd版本信息和加密协议通过header返回给客户端
+    header := http.Header{"User-Agent": {"easysoft/xuan.im"}, "xxd-version": {util.Version}, "xxd-crypto": {crypto}}
+
+    // 客户端通过xxd-ack请求头启用消息确认，xxd同意时返回该请求头
+    ack := r.Header.Get("xxd-ack") == "1" && util.Config.AckQueueSize > 0
+    if ack {
+        header["xxd-ack"] = []string{"1"}
+    }
 
     conn, err := upgrader.Upgrade(w, r, header)
     if err != nil {
         util.LogError().Println("serve ws upgrader error:", err)
+        if keyID != "" {
+            api.ReleaseSessionKey(keyID)
+        }
         return
     }
 
-    client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), repeatLogin: false, cVer: r.Header.Get("version")}
+    client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), quit: make(chan struct{}), refill: make(chan struct{}, 1), repeatLogin: false, cVer: r.Header.Get("version"), crypto: crypto, keyID: keyID, device: deviceType(r.Header.Get("xxd-device")), ack: ack, connectTime: time.Now()}
+    client.keys.current = key
 
     util.LogInfo().Println("client ip:", conn.RemoteAddr())
+    if !hub.connect(client) {
+        conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"))
+        conn.Close()
+        if keyID != "" {
+            api.ReleaseSessionKey(keyID)
+        }
+        return
+    }
     go client.writePump()
     client.readPump()
 }
+
+//根据客户端请求头中的xxd-crypto选择加密协议，没有该请求头的旧版本客户端使用cbc
+func negotiateCrypto(crypto string) (string, bool) {
+    switch crypto {
+    case util.CryptoGCM:
+        return util.CryptoGCM, true
+    case util.CryptoCBC, "":
+        return util.CryptoCBC, util.Config.LegacyCrypto
+    }
+
+    return "", false
+}
+
+//客户端请求头中的设备类型，没有该请求头的旧版本客户端作为桌面端
+func deviceType(device string) string {
+    device = strings.ToLower(strings.TrimSpace(device))
+    if device == "" {
+        return defaultDevice
+    }
+    if len(device) > 20 {
+        device = device[:20]
+    }
+
+    return device
+}
+
+//领取serverInfo签发的会话密钥，没有xxd-key-id请求头的旧版本客户端使用util.Token
+func clientKey(keyID string) ([]byte, bool) {
+    if keyID == "" {
+        return util.Token, util.Config.LegacyToken
+    }
+
+    return api.ClaimSessionKey(keyID)
+}
@@ -18,7 +18,7 @@ import (
 var mu sync.RWMutex
 var clientTestCount int64 = 0
 
-func testSwitchMethod(message []byte, parseData api.ParseData, client *Client) error {
+func testSwitchMethod(parseData api.ParseData, client *Client) error {
     switch parseData.Module() + "." + parseData.Method() {
     case "chat.login":
         if err := chatTestLogin(parseData, client); err != nil {
@@ -38,19 +38,21 @@ func testSwitchMethod(message []byte, parseData api.ParseData, client *Client) e
 }
 
 func chatTestLogin(parseData api.ParseData, client *Client) error {
+    if client.userID != 0 {
+        return util.Errorf("%s\n", "chat test login repeated")
+    }
+
     client.userID = autoNumber()
     client.serverName = parseData.ServerName()
     if client.serverName == "" {
-        client.serverName = util.Config.DefaultServer
+        client.serverName = util.GetDefaultServer()
     }
 
     cRegister := &ClientRegister{client: client, retClient: make(chan *Client)}
     defer close(cRegister.retClient)
 
     client.hub.register <- cRegister
-    if retClient := <-cRegister.retClient; retClient.repeatLogin {
-        retClient.send <- api.RepeatLogin()
-
+    if retClient := <-cRegister.retClient; retClient == nil || retClient.repeatLogin {
         util.Println("chat test login error")
         return util.Errorf("%s\n", "chat test login error")
     }
@@ -61,15 +63,15 @@ func chatTestLogin(parseData api.ParseData, client *Client) error {
 }
 
 func chatTestMessage(parseData api.ParseData, client *Client) error {
-    message := api.ApiUnparse(parseData, util.Token)
+    message := api.JsonUnparse(parseData)
     client.hub.broadcast <- SendMsg{serverName: client.serverName, message: message}
 
     return nil
 }
 
 func autoNumber() int64 {
-    mu.RLock()
-    defer mu.RUnlock()
+    mu.Lock()
+    defer mu.Unlock()
 
     clientTestCount++
     return clientTestCount
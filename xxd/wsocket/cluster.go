@@ -0,0 +1,230 @@
+/**
+ * The cluster file of wsocket current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     wsocket
+ * @link        http://www.zentao.net
+ */
+package wsocket
+
+import (
+    "time"
+    "xxd/api"
+    "xxd/cluster"
+    "xxd/util"
+)
+
+// 以下方法除 receive 外都在hub的goroutine中调用
+
+//消息总线收到的消息交给hub处理，hub没有运行时等待queryWait后丢弃
+func (h *Hub) receive(msg *cluster.Message) {
+    select {
+    case h.remote <- msg:
+    case <-time.After(queryWait):
+        util.LogError().Println("cluster message dropped, hub not running:", msg.Type)
+    }
+}
+
+//发布集群消息，没有开启集群模式时忽略
+func (h *Hub) publish(msg *cluster.Message) {
+    if h.bus == nil {
+        return
+    }
+
+    if err := h.bus.Publish(msg); err != nil {
+        util.LogError().Println("cluster publish error:", err)
+    }
+}
+
+//把不在本节点的用户的消息转发给其他节点
+func (h *Hub) forward(serverName string, usersID []int64, message []byte) {
+    if len(usersID) == 0 {
+        return
+    }
+
+    h.publish(&cluster.Message{Type: cluster.TypeMulticast, Server: serverName, Users: usersID, Payload: message})
+}
+
+//用户在本节点登录，其他节点按登录策略挤掉同一用户的客户端
+func (h *Hub) publishLogin(client *Client) {
+    h.publish(&cluster.Message{Type: cluster.TypeLogin, Server: client.serverName, Users: []int64{client.userID}, Device: client.device, Time: client.connectTime.UnixNano()})
+}
+
+//客户端离开本节点，用户在本节点的最后一个客户端离开时通知其他节点并返回true
+func (h *Hub) remove(client *Client) bool {
+    clients := h.clients[client.serverName][client.userID]
+    if !clients[client] {
+        return false
+    }
+
+    delete(clients, client)
+    h.releaseAckQueue(client)
+    if len(clients) > 0 {
+        return false
+    }
+
+    delete(h.clients[client.serverName], client.userID)
+    h.publish(&cluster.Message{Type: cluster.TypeLogout, Server: client.serverName, Users: []int64{client.userID}})
+    return true
+}
+
+//用户是否在其他节点上有客户端
+func (h *Hub) remoteOnline(serverName string, userID int64) bool {
+    return len(h.presence[serverName][userID]) > 0
+}
+
+//用户是否在集群内的任何节点上有客户端，可以在任意goroutine中调用
+func (h *Hub) userOnline(serverName string, userID int64) bool {
+    online := false
+    h.do(func() {
+        online = len(h.clients[serverName][userID]) > 0 || h.remoteOnline(serverName, userID)
+    })
+
+    return online
+}
+
+//客户端是否已被其他登录替换，或者用户在集群内还有其他客户端，可以在任意goroutine中调用。
+//repeatLogin由hub设置，只能在hub的goroutine中读取
+func (h *Hub) replacedOrOnline(client *Client) bool {
+    result := false
+    h.do(func() {
+        result = client.repeatLogin || len(h.clients[client.serverName][client.userID]) > 0 || h.remoteOnline(client.serverName, client.userID)
+    })
+
+    return result
+}
+
+//强制下线，用户在其他节点上有客户端时同时通知其他节点
+func (h *Hub) kickoffCluster(serverName string, userID int64, message []byte) bool {
+    kicked := h.kickoff(serverName, userID, message)
+    if !h.remoteOnline(serverName, userID) {
+        return kicked
+    }
+
+    h.publish(&cluster.Message{Type: cluster.TypeKickoff, Server: serverName, Users: []int64{userID}, Payload: message})
+    return true
+}
+
+//集群内的在线人数，同一用户在多个节点上只计算一次
+func (h *Hub) clusterOnlineCount(serverName string) int {
+    count := 0
+    h.do(func() {
+        count = len(h.clients[serverName])
+        for userID := range h.presence[serverName] {
+            if _, ok := h.clients[serverName][userID]; !ok {
+                count++
+            }
+        }
+    })
+
+    return count
+}
+
+//处理其他节点的消息，只发送给本节点的用户，不再转发
+func (h *Hub) handleRemote(msg *cluster.Message) {
+    switch msg.Type {
+    case cluster.TypeBroadcast:
+        h.sendAll(SendMsg{serverName: msg.Server, message: msg.Payload})
+
+    case cluster.TypeMulticast:
+        for _, userID := range msg.Users {
+            h.sendTo(msg.Server, userID, msg.Payload)
+        }
+
+    case cluster.TypeLogin:
+        for _, userID := range msg.Users {
+            h.remoteLogin(msg.Server, userID, msg.Node, msg.Device, msg.Time)
+        }
+
+    case cluster.TypeLogout:
+        for _, userID := range msg.Users {
+            h.removePresence(msg.Server, userID, msg.Node)
+        }
+
+    case cluster.TypeKickoff:
+        for _, userID := range msg.Users {
+            h.kickoff(msg.Server, userID, msg.Payload)
+        }
+
+    case cluster.TypePresence:
+        h.removeNode(msg.Node)
+        for serverName, usersID := range msg.Presence {
+            for _, userID := range usersID {
+                h.setPresence(serverName, userID, msg.Node)
+            }
+        }
+
+        if msg.Sync {
+            h.publishPresence(false)
+        }
+
+    case cluster.TypeJoin:
+        // 新连接的节点可能不知道本节点的在线用户，同时请求其他节点的在线用户
+        h.publishPresence(true)
+
+    case cluster.TypeLeave:
+        h.removeNode(msg.Node)
+    }
+}
+
+//其他节点上的登录，按登录策略挤掉本节点较早登录的同一用户的客户端
+func (h *Hub) remoteLogin(serverName string, userID int64, node, device string, loginTime int64) {
+    for client := range h.clients[serverName][userID] {
+        // 本节点的登录较晚时由对方节点处理
+        if client.connectTime.UnixNano() > loginTime || !replacesDevice(serverName, device, client.device) {
+            continue
+        }
+
+        client.repeatLogin = true
+        select {
+        case client.send <- api.RepeatLogin():
+        default:
+        }
+        h.remove(client)
+    }
+
+    h.setPresence(serverName, userID, node)
+}
+
+func (h *Hub) setPresence(serverName string, userID int64, node string) {
+    if _, ok := h.clients[serverName]; !ok {
+        return
+    }
+
+    if _, ok := h.presence[serverName]; !ok {
+        h.presence[serverName] = map[int64]map[string]bool{}
+    }
+    if _, ok := h.presence[serverName][userID]; !ok {
+        h.presence[serverName][userID] = map[string]bool{}
+    }
+    h.presence[serverName][userID][node] = true
+}
+
+func (h *Hub) removePresence(serverName string, userID int64, node string) {
+    delete(h.presence[serverName][userID], node)
+    if len(h.presence[serverName][userID]) == 0 {
+        delete(h.presence[serverName], userID)
+    }
+}
+
+func (h *Hub) removeNode(node string) {
+    for serverName, users := range h.presence {
+        for userID := range users {
+            h.removePresence(serverName, userID, node)
+        }
+    }
+}
+
+//发布本节点的所有在线用户
+func (h *Hub) publishPresence(sync bool) {
+    presence := make(map[string][]int64)
+    for serverName, clients := range h.clients {
+        for userID := range clients {
+            presence[serverName] = append(presence[serverName], userID)
+        }
+    }
+
+    h.publish(&cluster.Message{Type: cluster.TypePresence, Presence: presence, Sync: sync})
+}
@@ -0,0 +1,187 @@
+package wsocket
+
+import (
+    "net"
+    "testing"
+    "time"
+    "xxd/api"
+    "xxd/cluster"
+    "xxd/util"
+)
+
+// 两个通过TCP总线连接的hub
+func startClusterHubs(t *testing.T) (*Hub, *Hub) {
+    listeners := make([]net.Listener, 2)
+    for i := range listeners {
+        listener, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        listeners[i] = listener
+    }
+
+    hubs := make([]*Hub, 2)
+    for i, listener := range listeners {
+        peer := listeners[1-i].Addr().String()
+        hub := newHub()
+        hub.clients = map[string]map[int64]clientSet{testServerName: {}}
+        hub.bus = cluster.NewTCPBus(listener.Addr().String(), "secret", listener, []string{peer})
+        go hub.run()
+        hub.bus.Start(hub.receive)
+        hubs[i] = hub
+    }
+
+    t.Cleanup(func() {
+        for _, hub := range hubs {
+            hub.bus.Close()
+        }
+    })
+
+    return hubs[0], hubs[1]
+}
+
+func registerTestClient(t *testing.T, hub *Hub, userID int64) *Client {
+    client := &Client{hub: hub, send: make(chan []byte, 256), serverName: testServerName, userID: userID, connectTime: time.Now()}
+    cRegister := &ClientRegister{client: client, retClient: make(chan *Client)}
+    hub.register <- cRegister
+    if <-cRegister.retClient == nil {
+        t.Fatal("register error")
+    }
+
+    return client
+}
+
+func eventually(t *testing.T, what string, ok func() bool) {
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        if ok() {
+            return
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    t.Fatal(what)
+}
+
+func receive(t *testing.T, client *Client) string {
+    select {
+    case message := <-client.send:
+        return string(message)
+    case <-time.After(5 * time.Second):
+        t.Fatalf("user %d received nothing", client.userID)
+        return ""
+    }
+}
+
+func TestClusterFanOut(t *testing.T) {
+    hubA, hubB := startClusterHubs(t)
+    userA := registerTestClient(t, hubA, 1)
+    userB := registerTestClient(t, hubB, 2)
+
+    eventually(t, "presence was not shared", func() bool {
+        return hubA.clusterOnlineCount(testServerName) == 2 && hubB.clusterOnlineCount(testServerName) == 2
+    })
+
+    hubA.multicast <- SendMsg{serverName: testServerName, usersID: []int64{1, 2}, message: []byte(`{"method":"message"}`)}
+    if message := receive(t, userA); message != `{"method":"message"}` {
+        t.Errorf("local user got %s", message)
+    }
+    if message := receive(t, userB); message != `{"method":"message"}` {
+        t.Errorf("remote user got %s", message)
+    }
+
+    hubB.broadcast <- SendMsg{serverName: testServerName, message: []byte(`{"method":"broadcast"}`)}
+    if message := receive(t, userA); message != `{"method":"broadcast"}` {
+        t.Errorf("remote broadcast got %s", message)
+    }
+    if message := receive(t, userB); message != `{"method":"broadcast"}` {
+        t.Errorf("local broadcast got %s", message)
+    }
+
+    hubB.unregister <- userB
+    eventually(t, "logout was not shared", func() bool {
+        return hubA.clusterOnlineCount(testServerName) == 1
+    })
+}
+
+func TestClusterRepeatLogin(t *testing.T) {
+    hubA, hubB := startClusterHubs(t)
+    old := registerTestClient(t, hubA, 1)
+    eventually(t, "presence was not shared", func() bool {
+        return hubB.clusterOnlineCount(testServerName) == 1
+    })
+
+    registerTestClient(t, hubB, 1)
+    if message := receive(t, old); message != string(api.RepeatLogin()) {
+        t.Errorf("old client got %s", message)
+    }
+
+    eventually(t, "old client was not replaced", func() bool {
+        local := 0
+        hubA.do(func() { local = len(hubA.clients[testServerName]) })
+        return local == 0 && hubA.clusterOnlineCount(testServerName) == 1
+    })
+
+    hubB.bus.Close()
+    eventually(t, "presence of the closed node was not removed", func() bool {
+        return hubA.clusterOnlineCount(testServerName) == 0
+    })
+}
+
+func TestClusterKickoff(t *testing.T) {
+    hubA, hubB := startClusterHubs(t)
+    remote := registerTestClient(t, hubB, 3)
+    eventually(t, "presence was not shared", func() bool {
+        return hubA.clusterOnlineCount(testServerName) == 1
+    })
+
+    kicked := false
+    hubA.do(func() { kicked = hubA.kickoffCluster(testServerName, 3, api.AdminKickoff("bye")) })
+    if !kicked {
+        t.Fatal("remote user was not found")
+    }
+
+    if message := receive(t, remote); message != string(api.AdminKickoff("bye")) {
+        t.Errorf("remote user got %s", message)
+    }
+}
+
+func TestClusterPerDeviceLogin(t *testing.T) {
+    setLoginPolicy(t, util.LoginPerDevice)
+    hubA, hubB := startClusterHubs(t)
+
+    desktop, _ := registerDevice(t, hubA, 1, "desktop")
+    oldWeb, _ := registerDevice(t, hubA, 1, "web")
+    eventually(t, "presence was not shared", func() bool {
+        return hubB.clusterOnlineCount(testServerName) == 1
+    })
+
+    // 其他节点上的网页端登录只挤掉本节点的网页端
+    web, _ := registerDevice(t, hubB, 1, "web")
+    if message := receive(t, oldWeb); message != string(api.RepeatLogin()) {
+        t.Errorf("old web client got %s", message)
+    }
+
+    eventually(t, "user was not online on both nodes", func() bool {
+        return hubA.userOnline(testServerName, 1) && hubB.userOnline(testServerName, 1) && hubA.clusterOnlineCount(testServerName) == 1
+    })
+
+    hubB.multicast <- SendMsg{serverName: testServerName, usersID: []int64{1}, message: []byte(`{"method":"message"}`)}
+    if message := receive(t, web); message != `{"method":"message"}` {
+        t.Errorf("local device got %s", message)
+    }
+    if message := receive(t, desktop); message != `{"method":"message"}` {
+        t.Errorf("remote device got %s", message)
+    }
+
+    // 桌面端断开后用户仍然在网页端在线
+    hubA.unregister <- desktop
+    eventually(t, "logout of the last device on node A was not shared", func() bool {
+        online := true
+        hubB.do(func() { online = hubB.remoteOnline(testServerName, 1) })
+        return !online
+    })
+    if !hubA.userOnline(testServerName, 1) {
+        t.Error("user is offline while the web client is connected")
+    }
+}
@@ -0,0 +1,132 @@
+package wsocket
+
+import (
+    "encoding/json"
+    "net/url"
+    "strings"
+    "testing"
+    "xxd/api"
+    "xxd/api/apitest"
+    "xxd/util"
+)
+
+// 模拟后端服务器，只有用户1可以访问会话chat-gid中的文件7
+func startTestFileAccess(t *testing.T) {
+    xxb := apitest.NewBackend(t, testBackendToken, func(request api.ParseData) api.ParseData {
+        if request.Method() != "checkFileAccess" {
+            return nil
+        }
+
+        result := "fail"
+        if request.UserID() == 1 && request.Param(0) == "chat-gid" && request.Param(1) == "7" {
+            result = "success"
+        }
+        return api.ParseData{"module": "chat", "method": "checkFileAccess", "result": result}
+    })
+
+    setTestRanzhi(t, xxb.URL)
+}
+
+type downloadURLResult struct {
+    Method  string `json:"method"`
+    Result  string `json:"result"`
+    Message string `json:"message"`
+    Data    struct {
+        ID      string `json:"id"`
+        URL     string `json:"url"`
+        Expires int64  `json:"expires"`
+    } `json:"data"`
+}
+
+func requestDownloadURL(t *testing.T, client *Client, userID int64, params ...interface{}) downloadURLResult {
+    request := api.ParseData{"module": "chat", "method": "downloadUrl", "userID": float64(userID), "params": params}
+    if err := switchMethod(request, client); err != nil {
+        t.Fatal(err)
+    }
+
+    var result downloadURLResult
+    if err := json.Unmarshal([]byte(receive(t, client)), &result); err != nil {
+        t.Fatal(err)
+    }
+    return result
+}
+
+func TestDownloadURL(t *testing.T) {
+    startTestFileAccess(t)
+    hub := newTestHub(testServerName, 1, 2)
+    user1, user2 := userClient(hub, testServerName, 1), userClient(hub, testServerName, 2)
+
+    result := requestDownloadURL(t, user1, 1, "chat-gid", "7", "notes.txt", float64(1500000000))
+    if result.Method != "downloadUrl" || result.Result != "success" || result.Data.ID != "7" {
+        t.Fatalf("download url %+v", result)
+    }
+    if expires := util.GetUnixTime() + util.Config.DownloadTTL; result.Data.Expires < expires-5 || result.Data.Expires > expires {
+        t.Errorf("download url expires %d", result.Data.Expires)
+    }
+
+    query, _ := url.ParseQuery(strings.TrimPrefix(result.Data.URL, "/download?"))
+    link := util.DownloadLink{Server: testServerName, FileID: "7", FileName: "notes.txt", Time: "1500000000", UserID: 1, Expires: result.Data.Expires}
+    if !strings.HasPrefix(result.Data.URL, "/download?") || query.Get("user") != "1" || !link.Verify(query.Get("sig")) {
+        t.Errorf("download url %s", result.Data.URL)
+    }
+
+    // 不是会话成员、文件不属于会话时不签发
+    if result := requestDownloadURL(t, user2, 2, "chat-gid", "7", "notes.txt", "1500000000"); result.Result != "fail" || result.Data.URL != "" {
+        t.Errorf("user 2 got download url %+v", result)
+    }
+    if result := requestDownloadURL(t, user1, 1, "chat-gid", "8", "notes.txt", "1500000000"); result.Result != "fail" {
+        t.Errorf("file 8 got download url %+v", result)
+    }
+    if result := requestDownloadURL(t, user1, 1, "chat-gid", "7"); result.Result != "fail" || result.Message != "invalid params" {
+        t.Errorf("missing params returned %+v", result)
+    }
+
+    // 只能为当前连接登录的用户签发
+    request := api.ParseData{"module": "chat", "method": "downloadUrl", "userID": float64(1), "params": []interface{}{"chat-gid", "7", "notes.txt", "1500000000"}}
+    if err := switchMethod(request, user2); err == nil {
+        t.Error("user 2 requested a download url as user 1")
+    }
+}
+
+// 被踢下线的客户端的send已关闭，请求下载地址时丢弃结果
+func TestDownloadURLAfterKick(t *testing.T) {
+    startTestFileAccess(t)
+    hub := newTestHub(testServerName, 1)
+    kicked := userClient(hub, testServerName, 1)
+
+    hub.do(func() { hub.kickoff(testServerName, 1, []byte("bye")) })
+    for range kicked.send {
+    }
+
+    request := api.ParseData{"module": "chat", "method": "downloadUrl", "userID": float64(1), "params": []interface{}{"chat-gid", "7", "notes.txt", "1500000000"}}
+    if err := switchMethod(request, kicked); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestLogoutRevokesFileSession(t *testing.T) {
+    hub := newTestHub(testServerName, 1)
+    desktop := userClient(hub, testServerName, 1)
+    web := &Client{hub: hub, send: make(chan []byte, 256), serverName: testServerName, userID: 1}
+
+    for _, client := range []*Client{desktop, web} {
+        _, sessionID, err := api.UserFileSessionID(testServerName, 1, "zh-cn")
+        if err != nil {
+            t.Fatal(err)
+        }
+        client.fileSession = sessionID
+    }
+    defer util.DelUid(testServerName, 1, web.fileSession)
+
+    // 被挤下线的客户端不通知后端服务器，但仍然删除自己的会话
+    desktop.repeatLogin = true
+    desktopSession := desktop.fileSession
+    if err := chatLogout(1, desktop); err != nil {
+        t.Fatal(err)
+    }
+
+    sessions, _ := util.GetUids(testServerName, "1")
+    if len(sessions) != 1 || sessions[0] != web.fileSession || sessions[0] == desktopSession {
+        t.Errorf("file sessions %v after logout", sessions)
+    }
+}
@@ -9,12 +9,20 @@
  */
 package wsocket
 
-import "xxd/util"
+import (
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "xxd/api"
+    "xxd/cluster"
+    "xxd/util"
+)
 
 // hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
-    clients map[string]map[int64]*Client // Registered clients. map[ranzhiName][clientID]*Client
+    clients map[string]map[int64]clientSet // Registered clients. map[ranzhiName][userID], one client per device of the user
 
     // Inbound messages from the clients.
     multicast chan SendMsg
@@ -22,19 +30,44 @@ type Hub struct {
 
     register   chan *ClientRegister // Register requests from the clients.
     unregister chan *Client         // Unregister requests from clients.
+
+    query    chan func()             // Run a function on the hub goroutine to read or change its state.
+    reload   chan util.BackendChange // Add or remove backends after the config is reloaded.
+    shutdown chan struct{}           // Close all clients and refuse new registrations.
+    closing  bool                    // Set by run once shutdown has been received.
+    pumps    sync.WaitGroup          // Running writePump goroutines.
+    pending  map[*Client]bool        // Connections that have not logged in yet, closed on shutdown.
+
+    bus      cluster.Bus                   // Peer nodes, nil when cluster mode is off.
+    remote   chan *cluster.Message         // Messages from peer nodes.
+    presence map[string]map[int64]map[string]bool // Users connected to peer nodes. map[ranzhiName][userID][node]
+
+    acks map[string]map[int64]map[string]*ackQueue // Unacknowledged messages. map[ranzhiName][userID][device]
 }
 
+// 同一用户同时在线的客户端
+type clientSet map[*Client]bool
+
+const queryWait = time.Second
+
 func newHub() *Hub {
     hub := &Hub{
         multicast:  make(chan SendMsg),
         broadcast:  make(chan SendMsg),
         register:   make(chan *ClientRegister),
         unregister: make(chan *Client),
-        clients:    make(map[string]map[int64]*Client),
+        query:      make(chan func()),
+        reload:     make(chan util.BackendChange),
+        shutdown:   make(chan struct{}),
+        clients:    make(map[string]map[int64]clientSet),
+        pending:    make(map[*Client]bool),
+        remote:     make(chan *cluster.Message),
+        presence:   make(map[string]map[int64]map[string]bool),
+        acks:       make(map[string]map[int64]map[string]*ackQueue),
     }
 
-    for ranzhiName := range util.Config.RanzhiServer {
-        hub.clients[ranzhiName] = map[int64]*Client{}
+    for _, ranzhiName := range util.GetRanzhiServerNames() {
+        hub.clients[ranzhiName] = map[int64]clientSet{}
     }
 
     return hub
@@ -45,69 +78,305 @@ func (h *Hub) run() {
         select {
         case cRegister := <-h.register:
 
-            // 根据传入的client对指定服务器的userid进行socket注册
-            if _, ok := h.clients[cRegister.client.serverName]; !ok {
-                cRegister.retClient <- cRegister.client
-                close(cRegister.client.send)
+            // 根据传入的client对指定服务器的userid进行socket注册，无法注册时返回nil
+            client := cRegister.client
+            delete(h.pending, client)
+            if _, ok := h.clients[client.serverName]; !ok || h.closing {
+                cRegister.retClient <- nil
+                close(client.send)
                 continue
             }
-            go util.DBUserLogin(cRegister.client.serverName, cRegister.client.userID)
-            // 判断用户是否已经存在
-            if client, ok := h.clients[cRegister.client.serverName][cRegister.client.userID]; ok {
-                //重复登录,返回旧的client
-                client.repeatLogin = true
-                cRegister.retClient <- client
-
-                //用新的客户端覆盖旧的客户端
-                h.clients[cRegister.client.serverName][cRegister.client.userID] = cRegister.client
-                continue
+            go util.DBUserLogin(client.serverName, client.userID)
+
+            // 按后端服务器的多端登录策略判断是否重复登录，通知被替换的客户端后返回该客户端，
+            // 客户端收到信息后需要关闭socket连接，否则连接不会断开
+            retClient := client
+            if replaced := h.replaced(client); replaced != nil {
+                replaced.repeatLogin = true
+                select {
+                case replaced.send <- api.RepeatLogin():
+                default:
+                }
+                delete(h.clients[client.serverName][client.userID], replaced)
+                retClient = replaced
             }
 
-            h.clients[cRegister.client.serverName][cRegister.client.userID] = cRegister.client
-            cRegister.retClient <- cRegister.client
+            if _, ok := h.clients[client.serverName][client.userID]; !ok {
+                h.clients[client.serverName][client.userID] = clientSet{}
+            }
+            h.clients[client.serverName][client.userID][client] = true
+            registerTotal.Inc(client.serverName)
+            h.publishLogin(client)
+            h.openAckQueue(client)
+            cRegister.retClient <- retClient
 
         case client := <-h.unregister:
 
+            // 没有登录就断开的连接
+            delete(h.pending, client)
+
             if client.repeatLogin {
                 close(client.send)
                 continue
             }
 
-            // 收到失败的socket就进行注销
-            if _, ok := h.clients[client.serverName][client.userID]; ok {
+            // 收到失败的socket就进行注销，已被强制下线或重新登录的客户端不再注销。
+            // 用户的最后一个客户端断开时才记录为离线
+            if h.registered(client) {
                 close(client.send)
-                delete(h.clients[client.serverName], client.userID)
-                util.DBInsertOffline(client.serverName, client.userID)
+                unregisterTotal.Inc(client.serverName)
+                if h.remove(client) {
+                    util.DBInsertOffline(client.serverName, client.userID)
+                }
             }
 
         case sendMsg := <-h.multicast:
-            // 对指定的用户群发送消息
+            // 对指定的用户群发送消息，用户的每个客户端都会收到，在其他节点上的用户转发给其他节点
+            multicastTotal.Inc(sendMsg.serverName)
+            var remoteUsers []int64
             for _, userID := range sendMsg.usersID {
-                client, ok := h.clients[sendMsg.serverName][userID]
-                if !ok {
-                    continue
+                if h.remoteOnline(sendMsg.serverName, userID) {
+                    remoteUsers = append(remoteUsers, userID)
                 }
 
-                select {
-                case client.send <- sendMsg.message:
-                default:
-                    close(client.send)
-                    delete(h.clients[client.serverName], client.userID)
+                if h.sendTo(sendMsg.serverName, userID, sendMsg.message) {
+                    multicastRecipients.Inc(sendMsg.serverName)
                 }
             }
+            h.forward(sendMsg.serverName, remoteUsers, sendMsg.message)
 
         case sendMsg := <-h.broadcast:
-            // 对所有的在线用户发送消息
-            for userID := range h.clients[sendMsg.serverName] {
+            h.sendAll(sendMsg)
+            h.publish(&cluster.Message{Type: cluster.TypeBroadcast, Server: sendMsg.serverName, Payload: sendMsg.message})
 
-                client := h.clients[sendMsg.serverName][userID]
-                select {
-                case client.send <- sendMsg.message:
-                default:
-                    close(client.send)
-                    delete(h.clients[client.serverName], client.userID)
+        case msg := <-h.remote:
+            h.handleRemote(msg)
+
+        case f := <-h.query:
+            f()
+
+        case change := <-h.reload:
+            // 新增的服务器开始接受登录，已删除服务器的用户收到通知后断开，其他服务器的用户不受影响
+            for _, serverName := range change.Added {
+                if _, ok := h.clients[serverName]; !ok {
+                    h.clients[serverName] = map[int64]clientSet{}
+                }
+            }
+
+            for _, serverName := range change.Removed {
+                message := api.BackendRemoved()
+                for userID, clients := range h.clients[serverName] {
+                    for client := range clients {
+                        select {
+                        case client.send <- message:
+                        default:
+                        }
+                        close(client.send)
+                    }
+                    delete(h.clients[serverName], userID)
+                    util.DBInsertOffline(serverName, userID)
+                }
+                delete(h.clients, serverName)
+                delete(h.presence, serverName)
+                delete(h.acks, serverName)
+            }
+
+        case <-h.shutdown:
+            // 关闭所有连接，writePump 会先发送完缓冲区中的消息再发送 close frame
+            h.closing = true
+            closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown")
+            for serverName, users := range h.clients {
+                for userID, clients := range users {
+                    for client := range clients {
+                        client.closeMessage = closeMessage
+                        close(client.send)
+                    }
+                    delete(users, userID)
+                    util.DBInsertOffline(serverName, userID)
                 }
             }
+
+            // 还没有登录的连接没有注册到hub，通过quit结束writePump，不关闭正在登录时写入的send
+            for client := range h.pending {
+                client.closeMessage = closeMessage
+                close(client.quit)
+                delete(h.pending, client)
+            }
         } // run select
     } // run for
 }
+
+//在hub的goroutine中执行f，hub没有运行时等待queryWait后放弃
+func (h *Hub) do(f func()) bool {
+    done := make(chan struct{})
+    select {
+    case h.query <- func() { f(); close(done) }:
+    case <-time.After(queryWait):
+        return false
+    }
+
+    <-done
+    return true
+}
+
+//记录新建立的连接并启动writePump，关闭过程中返回false，可以在任意goroutine中调用
+func (h *Hub) connect(client *Client) bool {
+    connected := false
+    h.do(func() {
+        if h.closing {
+            return
+        }
+
+        h.pending[client] = true
+        h.pumps.Add(1)
+        connected = true
+    })
+
+    return connected
+}
+
+//每个后端服务器的在线客户端数，同一用户的多个客户端分别计算
+func (h *Hub) onlineCount() map[string]int {
+    count := make(map[string]int)
+    h.do(func() {
+        for serverName, users := range h.clients {
+            count[serverName] = 0
+            for _, clients := range users {
+                count[serverName] += len(clients)
+            }
+        }
+    })
+
+    return count
+}
+
+//向指定服务器的用户分别发送消息，在其他节点上的用户转发给其他节点，可以在任意goroutine中调用
+func (h *Hub) deliver(serverName string, messages map[int64][]byte) bool {
+    return h.do(func() {
+        for userID, message := range messages {
+            if h.remoteOnline(serverName, userID) {
+                h.forward(serverName, []int64{userID}, message)
+            }
+
+            h.sendTo(serverName, userID, message)
+        }
+    })
+}
+
+//向已注册的客户端发送消息，客户端已注销或被其他登录替换时丢弃，可以在任意goroutine中调用
+func (h *Hub) sendClient(client *Client, message []byte) bool {
+    sent := false
+    h.do(func() {
+        if h.registered(client) {
+            sent = h.sendToClient(client, message)
+        }
+    })
+
+    return sent
+}
+
+//客户端是否仍然注册在hub中，在hub的goroutine中调用
+func (h *Hub) registered(client *Client) bool {
+    return h.clients[client.serverName][client.userID][client]
+}
+
+//按后端服务器的多端登录策略，找出新登录的客户端替换的同一用户的客户端，没有时返回nil
+func (h *Hub) replaced(client *Client) *Client {
+    for registered := range h.clients[client.serverName][client.userID] {
+        if replacesDevice(client.serverName, client.device, registered.device) {
+            return registered
+        }
+    }
+
+    return nil
+}
+
+//在device上的登录是否替换同一用户在registered上已登录的客户端
+func replacesDevice(serverName, device, registered string) bool {
+    ranzhiServer, _ := util.GetRanzhiServer(serverName)
+    switch ranzhiServer.LoginPolicy {
+    case util.LoginUnlimited:
+        return false
+    case util.LoginPerDevice:
+        return device == registered
+    }
+
+    return true
+}
+
+//向指定用户的所有客户端发送消息，启用确认的客户端收到带序号的消息，有客户端收到时返回true，在hub的goroutine中调用
+func (h *Hub) sendTo(serverName string, userID int64, message []byte) bool {
+    sent := false
+    queued := h.enqueue(serverName, userID, message)
+    for client := range h.clients[serverName][userID] {
+        // 启用确认的客户端从队列中按序号接收，发送缓冲中的消息较多时留在队列中稍后发送
+        if client.ack && queued[client.device] {
+            h.flushAck(client)
+            sent = true
+            continue
+        }
+
+        if h.sendToClient(client, message) {
+            sent = true
+        }
+    }
+
+    return sent
+}
+
+//向客户端发送消息，发送队列已满时断开该客户端，在hub的goroutine中调用
+func (h *Hub) sendToClient(client *Client, message []byte) bool {
+    select {
+    case client.send <- message:
+        return true
+    default:
+        close(client.send)
+        h.remove(client)
+        droppedTotal.Inc(client.serverName)
+        return false
+    }
+}
+
+//对指定服务器的所有在线用户发送消息，并加入已断开用户保留的确认队列，返回收到消息的用户数，在hub的goroutine中调用
+func (h *Hub) sendAll(sendMsg SendMsg) int {
+    broadcastTotal.Inc(sendMsg.serverName)
+
+    // 先处理没有在线客户端的用户，在线用户的消息由 sendTo 加入队列
+    for userID := range h.acks[sendMsg.serverName] {
+        if _, online := h.clients[sendMsg.serverName][userID]; !online {
+            h.enqueue(sendMsg.serverName, userID, sendMsg.message)
+        }
+    }
+
+    recipients := 0
+    for userID := range h.clients[sendMsg.serverName] {
+        if h.sendTo(sendMsg.serverName, userID, sendMsg.message) {
+            broadcastRecipients.Inc(sendMsg.serverName)
+            recipients++
+        }
+    }
+
+    return recipients
+}
+
+//强制用户的所有客户端下线，通知客户端后关闭连接，在hub的goroutine中调用
+func (h *Hub) kickoff(serverName string, userID int64, message []byte) bool {
+    clients, ok := h.clients[serverName][userID]
+    if !ok {
+        return false
+    }
+
+    for client := range clients {
+        select {
+        case client.send <- message:
+        default:
+        }
+
+        client.closeMessage = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "kicked by administrator")
+        close(client.send)
+        h.remove(client)
+        unregisterTotal.Inc(serverName)
+    }
+    util.DBInsertOffline(serverName, userID)
+    return true
+}
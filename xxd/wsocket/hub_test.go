@@ -0,0 +1,378 @@
+package wsocket
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "xxd/api"
+    "xxd/util"
+)
+
+// go test -race xxd/wsocket
+
+const testServerName = "xuanxuan"
+
+// 测试程序不调用 util.Init，使用内存存储和本地文件存储
+func TestMain(m *testing.M) {
+    util.DB, _ = util.OpenStore("memory", "")
+    util.UploadStorage, _ = util.OpenStorage(util.StorageConfig{Driver: "local"})
+    os.Exit(m.Run())
+}
+
+// 测试模式的客户端，登录后 userID 由 autoNumber 分配
+type testClient struct {
+    conn *websocket.Conn
+}
+
+func startTestServer(t *testing.T, hub *Hub) *httptest.Server {
+    isTest, legacyToken := util.IsTest, util.Config.LegacyToken
+    util.IsTest, util.Config.LegacyToken = true, true
+
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        serveWs(hub, w, r)
+    }))
+
+    t.Cleanup(func() {
+        server.Close()
+        util.IsTest, util.Config.LegacyToken = isTest, legacyToken
+    })
+
+    return server
+}
+
+//连接后丢弃收到的消息，直到连接断开
+func dialTestClient(t *testing.T, server *httptest.Server) *testClient {
+    header := http.Header{"xxd-crypto": {util.CryptoGCM}}
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    go func() {
+        for {
+            if _, _, err := conn.ReadMessage(); err != nil {
+                return
+            }
+        }
+    }()
+
+    return &testClient{conn: conn}
+}
+
+func (c *testClient) sendJSON(t *testing.T, jsonData string) {
+    message, err := api.Encrypt([]byte(jsonData), util.Token, util.CryptoGCM)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if err := c.conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+        t.Error(err)
+    }
+}
+
+func waitOnline(t *testing.T, hub *Hub, want int) {
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        if hub.onlineCount()[testServerName] == want {
+            return
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    t.Fatalf("online clients %d, want %d", hub.onlineCount()[testServerName], want)
+}
+
+func TestHubConcurrentClients(t *testing.T) {
+    const clientCount = 50
+    const messageCount = 5
+
+    hub := newTestHub(testServerName)
+    server := startTestServer(t, hub)
+
+    clients := make([]*testClient, clientCount)
+    for i := range clients {
+        clients[i] = dialTestClient(t, server)
+        clients[i].sendJSON(t, `{"module":"chat","method":"login","test":true,"params":["xuanxuan"]}`)
+    }
+    waitOnline(t, hub, clientCount)
+
+    var wg sync.WaitGroup
+
+    // 客户端之间互相广播
+    for _, client := range clients {
+        wg.Add(1)
+        go func(client *testClient) {
+            defer wg.Done()
+            for i := 0; i < messageCount; i++ {
+                client.sendJSON(t, `{"module":"chat","method":"message","test":true,"params":["xuanxuan"]}`)
+            }
+        }(client)
+    }
+
+    // 定时任务、管理接口与登录检查同时读写hub
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            messages := make(map[int64][]byte)
+            for userID := int64(0); userID < clientCount*2; userID++ {
+                messages[userID] = []byte(`{"module":"chat","method":"notify","data":[]}`)
+            }
+            hub.deliver(testServerName, messages)
+            hub.onlineCount()
+            hub.do(func() { hub.sendAll(SendMsg{serverName: testServerName, message: []byte(`{"module":"chat","method":"usergetlist"}`)}) })
+        }()
+    }
+
+    wg.Wait()
+
+    for _, client := range clients {
+        client.conn.Close()
+    }
+    waitOnline(t, hub, 0)
+}
+
+func TestHubSendAfterClose(t *testing.T) {
+    hub := newTestHub(testServerName)
+    server := startTestServer(t, hub)
+
+    clients := make([]*testClient, 20)
+    for i := range clients {
+        clients[i] = dialTestClient(t, server)
+        clients[i].sendJSON(t, `{"module":"chat","method":"login","test":true,"params":["xuanxuan"]}`)
+    }
+    waitOnline(t, hub, len(clients))
+
+    var registered []*Client
+    hub.do(func() {
+        for _, clients := range hub.clients[testServerName] {
+            for client := range clients {
+                registered = append(registered, client)
+            }
+        }
+    })
+
+    // 断开、强制下线与发送同时进行，已关闭的发送队列不能再写入
+    var wg sync.WaitGroup
+    for i, client := range registered {
+        wg.Add(2)
+        go func(client *Client) {
+            defer wg.Done()
+            for j := 0; j < 20; j++ {
+                hub.sendClient(client, []byte(`{"module":"chat","method":"error"}`))
+                hub.deliver(testServerName, map[int64][]byte{client.userID: []byte(`{"module":"chat","method":"notify"}`)})
+            }
+        }(client)
+
+        go func(i int, client *Client) {
+            defer wg.Done()
+            if i%2 == 0 {
+                hub.do(func() { hub.kickoff(testServerName, client.userID, api.AdminKickoff("")) })
+                return
+            }
+            client.conn.Close()
+        }(i, client)
+    }
+    wg.Wait()
+
+    waitOnline(t, hub, 0)
+
+    if hub.sendClient(registered[0], []byte(`{}`)) {
+        t.Error("message was sent to an unregistered client")
+    }
+}
+
+// 被替换的客户端在readPump中退出，与hub替换它同时进行，用 go test -race 检查
+func TestLogoutReplacedClientRace(t *testing.T) {
+    hub := newTestHub(testServerName)
+    old := &Client{hub: hub, send: make(chan []byte, 256), serverName: testServerName, userID: 1}
+    hub.do(func() { hub.clients[testServerName][1] = clientSet{old: true} })
+
+    client := &Client{hub: hub, send: make(chan []byte, 256), serverName: testServerName, userID: 1}
+    cRegister := &ClientRegister{client: client, retClient: make(chan *Client, 1)}
+    go func() { hub.register <- cRegister }()
+
+    // 等待hub替换旧客户端，期间不与hub同步
+    time.Sleep(10 * time.Millisecond)
+    if err := chatLogout(1, old); err != nil {
+        t.Fatal(err)
+    }
+    <-cRegister.retClient
+    if !hub.replacedOrOnline(old) {
+        t.Error("replaced client was not reported")
+    }
+}
+
+func TestHubRepeatLogin(t *testing.T) {
+    hub := newTestHub(testServerName)
+    old := &Client{hub: hub, send: make(chan []byte, 256), serverName: testServerName, userID: 1}
+    hub.do(func() { hub.clients[testServerName][1] = clientSet{old: true} })
+
+    client := &Client{hub: hub, send: make(chan []byte, 256), serverName: testServerName, userID: 1}
+    cRegister := &ClientRegister{client: client, retClient: make(chan *Client)}
+    hub.register <- cRegister
+    if retClient := <-cRegister.retClient; retClient != old || !retClient.repeatLogin {
+        t.Fatal("repeat login did not return the old client")
+    }
+
+    if message := <-old.send; string(message) != string(api.RepeatLogin()) {
+        t.Errorf("old client got %s", message)
+    }
+
+    // 旧的连接断开时不能注销新的客户端
+    hub.unregister <- old
+    if !hub.sendClient(client, []byte(`{}`)) {
+        t.Error("new client was unregistered by the old connection")
+    }
+}
+
+func setLoginPolicy(t *testing.T, policy string) {
+    old, oldDefault := util.Config.RanzhiServer, util.GetDefaultServer()
+    util.SetRanzhi(map[string]util.RanzhiServer{testServerName: {LoginPolicy: policy}}, testServerName)
+    t.Cleanup(func() { util.SetRanzhi(old, oldDefault) })
+}
+
+func registerDevice(t *testing.T, hub *Hub, userID int64, device string) (*Client, *Client) {
+    client := &Client{hub: hub, send: make(chan []byte, 256), serverName: testServerName, userID: userID, device: device, connectTime: time.Now()}
+    cRegister := &ClientRegister{client: client, retClient: make(chan *Client)}
+    hub.register <- cRegister
+    return client, <-cRegister.retClient
+}
+
+func TestHubLoginPolicy(t *testing.T) {
+    for _, test := range []struct {
+        policy   string
+        replaced []bool // 依次登录 desktop、web、web 时是否替换已登录的客户端
+    }{
+        {util.LoginSingle, []bool{false, true, true}},
+        {util.LoginPerDevice, []bool{false, false, true}},
+        {util.LoginUnlimited, []bool{false, false, false}},
+    } {
+        t.Run(test.policy, func(t *testing.T) {
+            setLoginPolicy(t, test.policy)
+            hub := newTestHub(testServerName)
+
+            var online []*Client
+            for i, device := range []string{"desktop", "web", "web"} {
+                client, retClient := registerDevice(t, hub, 1, device)
+                if replaced := retClient != client; replaced != test.replaced[i] {
+                    t.Fatalf("login %d on %s replaced=%v", i, device, replaced)
+                }
+                if retClient != client {
+                    if !retClient.repeatLogin || string(<-retClient.send) != string(api.RepeatLogin()) {
+                        t.Errorf("replaced client was not notified")
+                    }
+                    for j, c := range online {
+                        if c == retClient {
+                            online = append(online[:j], online[j+1:]...)
+                        }
+                    }
+                }
+                online = append(online, client)
+            }
+
+            // 在线数按客户端计算
+            if count := hub.onlineCount()[testServerName]; count != len(online) {
+                t.Errorf("online count %d, want %d", count, len(online))
+            }
+
+            // 用户的每个客户端都收到消息
+            hub.multicast <- SendMsg{serverName: testServerName, usersID: []int64{1}, message: []byte(`{"method":"message"}`)}
+            hub.broadcast <- SendMsg{serverName: testServerName, message: []byte(`{"method":"broadcast"}`)}
+            for _, client := range online {
+                if message := receive(t, client); message != `{"method":"message"}` {
+                    t.Errorf("%s client got %s", client.device, message)
+                }
+                if message := receive(t, client); message != `{"method":"broadcast"}` {
+                    t.Errorf("%s client got %s", client.device, message)
+                }
+            }
+
+            // 最后一个客户端断开时才离线
+            util.DB.DeleteOffline(testServerName, []int{1})
+            for i, client := range online {
+                hub.unregister <- client
+                userOnline := hub.userOnline(testServerName, 1)
+                offline, _ := util.DB.SelectOffline(testServerName)
+                marked := false
+                for _, userID := range offline {
+                    marked = marked || userID == 1
+                }
+                last := i == len(online)-1
+                if userOnline == last || marked != last {
+                    t.Errorf("online %v, offline %v after %d of %d clients left", userOnline, marked, i+1, len(online))
+                }
+            }
+        })
+    }
+}
+
+func TestHubShutdownBeforeLogin(t *testing.T) {
+    hub := newTestHub(testServerName)
+    server := startTestServer(t, hub)
+
+    header := http.Header{"xxd-crypto": {util.CryptoGCM}}
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    eventually(t, "connection was not tracked", func() bool {
+        pending := 0
+        hub.do(func() { pending = len(hub.pending) })
+        return pending == 1
+    })
+
+    // 没有登录的连接也要在关闭时结束writePump
+    hub.shutdown <- struct{}{}
+    done := make(chan struct{})
+    go func() {
+        hub.pumps.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("writePump of the connection without login is still running")
+    }
+
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+        t.Errorf("connection closed with %v", err)
+    }
+}
+
+func TestHubReloadRemoved(t *testing.T) {
+    hub := newTestHub("removed", 51)
+    client := userClient(hub, "removed", 51)
+    defer util.DB.DeleteOffline("removed", []int{51})
+
+    hub.reload <- util.BackendChange{Removed: []string{"removed"}}
+    if message := receive(t, client); message != string(api.BackendRemoved()) {
+        t.Errorf("client got %s", message)
+    }
+
+    // 被删除的服务器上的用户与关闭时一样记录为离线
+    hub.do(func() {})
+    offline, _ := util.DB.SelectOffline("removed")
+    if len(offline) != 1 || offline[0] != 51 {
+        t.Errorf("offline users %v after the backend was removed", offline)
+    }
+}
+
+func TestWriteMessageEncryptError(t *testing.T) {
+    client := &Client{crypto: util.CryptoGCM}
+    client.keys.current = []byte("short")
+
+    // 加密失败时返回错误，由writeFail记录发送失败的消息
+    if err := client.writeMessage([]byte(`{"module":"chat","method":"message"}`)); err == nil {
+        t.Error("encrypt error was dropped")
+    }
+}
@@ -0,0 +1,39 @@
+/**
+ * The metrics file of wsocket current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     wsocket
+ * @link        http://www.zentao.net
+ */
+package wsocket
+
+import "xxd/metrics"
+
+var (
+    registerTotal   = metrics.NewCounter("xxd_client_register_total", "Clients registered to the hub after login.", "backend")
+    unregisterTotal = metrics.NewCounter("xxd_client_unregister_total", "Clients removed from the hub after disconnect.", "backend")
+    droppedTotal    = metrics.NewCounter("xxd_client_dropped_total", "Clients dropped because their send buffer was full.", "backend")
+
+    broadcastTotal      = metrics.NewCounter("xxd_broadcast_total", "Broadcast messages sent by the hub.", "backend")
+    broadcastRecipients = metrics.NewCounter("xxd_broadcast_recipients_total", "Clients a broadcast message was queued for.", "backend")
+    multicastTotal      = metrics.NewCounter("xxd_multicast_total", "Multicast messages sent by the hub.", "backend")
+    multicastRecipients = metrics.NewCounter("xxd_multicast_recipients_total", "Clients a multicast message was queued for.", "backend")
+
+    ackReplayTotal  = metrics.NewCounter("xxd_ack_replay_total", "Unacknowledged messages replayed to reconnected clients.", "backend")
+    ackDroppedTotal = metrics.NewCounter("xxd_ack_dropped_total", "Unacknowledged messages dropped because the queue was full or expired.", "backend")
+
+    pushTotal    = metrics.NewCounter("xxd_backend_push_total", "Messages pushed by the backend to /backend/push.", "backend", "method")
+    webhookTotal = metrics.NewCounter("xxd_webhook_total", "Messages posted to /webhook by result.", "webhook", "result")
+)
+
+func init() {
+    metrics.NewGaugeFunc("xxd_online_clients", "Clients online per backend.", []string{"backend"}, func() []metrics.Sample {
+        var samples []metrics.Sample
+        for serverName, count := range chatHub.onlineCount() {
+            samples = append(samples, metrics.Sample{Labels: []string{serverName}, Value: float64(count)})
+        }
+        return samples
+    })
+}
@@ -0,0 +1,124 @@
+/**
+ * The push file of wsocket current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     wsocket
+ * @link        http://www.zentao.net
+ */
+package wsocket
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "sync"
+    "time"
+    "xxd/api"
+    "xxd/hyperttp/server"
+    "xxd/util"
+)
+
+// 后端服务器推送消息的路由，注册在通用端口上，server参数为后端服务器名称
+const backendPush = "/backend/push"
+
+const maxPushSize = 8 << 20
+
+// 后端服务器在该时间内推送过消息时，定时任务不再轮询通知和用户变化。
+// 后端服务器没有消息时可以推送ping保持。
+const pushFallback = 5 * time.Minute
+
+var (
+    pushTimes   = make(map[string]time.Time)
+    pushTimesMu sync.Mutex
+)
+
+func initPush(hub *Hub) {
+    server.HandleFunc(backendPush, func(w http.ResponseWriter, r *http.Request) {
+        receivePush(hub, w, r)
+    })
+}
+
+//接收后端服务器推送的消息，method为:
+//  notify:          data为 {userID: messages}，按用户发送chat.notify
+//  message:         把data发送给users中的用户，users为空时发送给所有用户
+//  checkUserChange: 用户列表有变化，重新获取并发送给所有用户
+//  ping:            只记录推送时间
+func receivePush(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        writeAdminResult(w, http.StatusMethodNotAllowed, adminResult{Result: "fail", Message: "not supported request"})
+        return
+    }
+
+    serverName := r.URL.Query().Get("server")
+    if serverName == "" {
+        serverName = util.GetDefaultServer()
+    }
+
+    body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPushSize))
+    if err != nil {
+        writeAdminResult(w, http.StatusBadRequest, adminResult{Result: "fail", Message: "read body error"})
+        return
+    }
+
+    // 解密失败、服务器不存在和时间不对都返回401，不区分原因
+    pushData, err := api.ParsePush(serverName, body)
+    if err != nil {
+        util.LogError().Println("backend push error:", err)
+        w.WriteHeader(http.StatusUnauthorized)
+        return
+    }
+
+    method := pushData.Method()
+    switch method {
+    case "notify":
+        hub.deliver(serverName, api.NotifyMessages(pushData["data"]))
+
+    case "message":
+        message, err := json.Marshal(pushData["data"])
+        if err != nil || pushData["data"] == nil {
+            writeAdminResult(w, http.StatusBadRequest, adminResult{Result: "fail", Message: "data is required"})
+            return
+        }
+
+        if users := pushData.SendUsers(); len(users) > 0 {
+            hub.multicast <- SendMsg{serverName: serverName, usersID: users, message: message}
+        } else {
+            hub.broadcast <- SendMsg{serverName: serverName, message: message}
+        }
+
+    case "checkUserChange":
+        for _, language := range util.GetLanguages() {
+            getList, err := api.UserGetlist(serverName, 0, language)
+            if err == nil && getList != nil {
+                hub.broadcast <- SendMsg{serverName: serverName, message: getList}
+            }
+        }
+
+    case "ping":
+
+    default:
+        writeAdminResult(w, http.StatusBadRequest, adminResult{Result: "fail", Message: "unknown method " + method})
+        return
+    }
+
+    pushTotal.Inc(serverName, method)
+    setPushed(serverName)
+    writeAdminResult(w, http.StatusOK, adminResult{Result: "success"})
+}
+
+func setPushed(serverName string) {
+    pushTimesMu.Lock()
+    defer pushTimesMu.Unlock()
+
+    pushTimes[serverName] = time.Now()
+}
+
+//后端服务器最近是否推送过消息
+func pushedRecently(serverName string) bool {
+    pushTimesMu.Lock()
+    defer pushTimesMu.Unlock()
+
+    return time.Since(pushTimes[serverName]) < pushFallback
+}
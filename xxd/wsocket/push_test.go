@@ -0,0 +1,126 @@
+package wsocket
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+    "xxd/api"
+    "xxd/util"
+)
+
+const testBackendToken = "88888888888888888888888888888888"
+
+func setTestRanzhi(t *testing.T, addr string) {
+    old, oldDefault := util.Config.RanzhiServer, util.GetDefaultServer()
+    util.SetRanzhi(map[string]util.RanzhiServer{
+        testServerName: {RanzhiAddr: addr, RanzhiToken: []byte(testBackendToken), RanzhiCrypto: util.CryptoGCM},
+    }, testServerName)
+    t.Cleanup(func() { util.SetRanzhi(old, oldDefault) })
+}
+
+func pushBody(t *testing.T, token string, data map[string]interface{}) []byte {
+    jsonData, _ := json.Marshal(data)
+    body, err := api.Encrypt(jsonData, []byte(token), util.CryptoGCM)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return body
+}
+
+func pushRequest(t *testing.T, hub *Hub, token string, data map[string]interface{}) int {
+    return postPush(hub, pushBody(t, token, data))
+}
+
+func postPush(hub *Hub, body []byte) int {
+    r := httptest.NewRequest("POST", backendPush+"?server="+testServerName, bytes.NewReader(body))
+    w := httptest.NewRecorder()
+    receivePush(hub, w, r)
+    return w.Code
+}
+
+func TestBackendPush(t *testing.T) {
+    setTestRanzhi(t, "http://127.0.0.1/xuanxuan.php")
+    hub := newTestHub(testServerName, 1, 2)
+    user1, user2 := userClient(hub, testServerName, 1), userClient(hub, testServerName, 2)
+    now := util.GetUnixTime()
+
+    code := pushRequest(t, hub, testBackendToken, map[string]interface{}{
+        "module": "chat", "method": "notify", "time": now,
+        "data": map[string]interface{}{"1": []string{"hello"}},
+    })
+    if code != http.StatusOK {
+        t.Fatalf("notify push returned %d", code)
+    }
+    if message := receive(t, user1); message != `{"data":["hello"],"method":"notify","module":"chat"}` {
+        t.Errorf("user 1 got %s", message)
+    }
+
+    code = pushRequest(t, hub, testBackendToken, map[string]interface{}{
+        "module": "chat", "method": "message", "time": now, "users": []int64{2},
+        "data": map[string]interface{}{"module": "chat", "method": "message"},
+    })
+    if code != http.StatusOK {
+        t.Fatalf("message push returned %d", code)
+    }
+    if message := receive(t, user2); message != `{"method":"message","module":"chat"}` {
+        t.Errorf("user 2 got %s", message)
+    }
+
+    if !pushedRecently(testServerName) {
+        t.Error("push time was not recorded")
+    }
+
+    select {
+    case message := <-user1.send:
+        t.Errorf("user 1 got an unexpected message %s", message)
+    case <-time.After(50 * time.Millisecond):
+    }
+}
+
+func TestBackendPushRejected(t *testing.T) {
+    setTestRanzhi(t, "http://127.0.0.1/xuanxuan.php")
+    hub := newTestHub(testServerName, 1)
+    now := util.GetUnixTime()
+
+    tests := map[string]struct {
+        token string
+        data  map[string]interface{}
+    }{
+        "wrong token":  {"99999999999999999999999999999999", map[string]interface{}{"method": "ping", "time": now}},
+        "without time": {testBackendToken, map[string]interface{}{"method": "ping"}},
+        "expired":      {testBackendToken, map[string]interface{}{"method": "ping", "time": now - 3600}},
+    }
+
+    for name, test := range tests {
+        if code := pushRequest(t, hub, test.token, test.data); code != http.StatusUnauthorized {
+            t.Errorf("%s push returned %d", name, code)
+        }
+    }
+
+    if code := pushRequest(t, hub, testBackendToken, map[string]interface{}{"method": "nosuch", "time": now}); code != http.StatusBadRequest {
+        t.Errorf("unknown method returned %d", code)
+    }
+}
+
+func TestBackendPushReplay(t *testing.T) {
+    setTestRanzhi(t, "http://127.0.0.1/xuanxuan.php")
+    hub := newTestHub(testServerName, 1)
+    data := map[string]interface{}{"module": "chat", "method": "ping", "time": util.GetUnixTime()}
+
+    body := pushBody(t, testBackendToken, data)
+    if code := postPush(hub, body); code != http.StatusOK {
+        t.Fatalf("push returned %d", code)
+    }
+    if code := postPush(hub, body); code != http.StatusUnauthorized {
+        t.Errorf("replayed push returned %d", code)
+    }
+
+    // 内容相同但重新加密的请求不是重放
+    if code := pushRequest(t, hub, testBackendToken, data); code != http.StatusOK {
+        t.Errorf("new push with the same content returned %d", code)
+    }
+}
@@ -10,18 +10,39 @@
 package wsocket
 
 import (
+    "context"
     "net/http"
     "time"
     "xxd/api"
+    "xxd/cluster"
     "xxd/hyperttp/server"
     "xxd/util"
 )
 
 const webSocket = "/ws"
 
+var chatHub = newHub()
+var wsServer = &http.Server{}
+
 func InitWs() {
-    hub := newHub()
+    hub := chatHub
+
+    // 集群模式下与其他节点连接
+    bus, err := cluster.New()
+    if err != nil {
+        util.LogError().Println("cluster start error:", err)
+        util.Exit("cluster start error")
+    }
+    hub.bus = bus
+
     go hub.run()
+    initAdmin(hub)
+    initPush(hub)
+    initWebhook(hub)
+
+    if bus != nil {
+        bus.Start(hub.receive)
+    }
 
     // 初始化路由
     http.HandleFunc(webSocket, func(w http.ResponseWriter, r *http.Request) {
@@ -29,14 +50,15 @@ func InitWs() {
     })
 
     addr := util.Config.Ip + ":" + util.Config.ChatPort
+    wsServer.Addr = addr
     util.LogInfo().Println("websocket start,listen addr:", addr, webSocket)
 
     go cronReport(hub)
 
     // 创建服务器
     if util.Config.IsHttps != "1" {
-        err := http.ListenAndServe(addr, nil)
-        if err != nil {
+        err := wsServer.ListenAndServe()
+        if err != nil && err != http.ErrServerClosed {
             util.LogError().Println("websocket server listen err:", err)
             util.Exit("websocket server listen err")
         }
@@ -47,14 +69,51 @@ func InitWs() {
             util.Exit("wss ssl create file err")
         }
 
-        err := http.ListenAndServeTLS(addr, crt, key, nil)
-        if err != nil {
+        err := wsServer.ListenAndServeTLS(crt, key)
+        if err != nil && err != http.ErrServerClosed {
             util.LogError().Println("wss websocket server listen err:", err)
             util.Exit("wss websocket server listen err")
         }
     }
 }
 
+//Stop accepting websocket connections, close every client with a close frame
+//after its send buffer is flushed and wait for the writers until ctx is done.
+func Shutdown(ctx context.Context) error {
+    if err := wsServer.Shutdown(ctx); err != nil {
+        return err
+    }
+
+    select {
+    case chatHub.shutdown <- struct{}{}:
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+
+    // 其他节点收到 leave 后移除本节点的在线用户
+    if chatHub.bus != nil {
+        chatHub.bus.Close()
+    }
+
+    done := make(chan struct{})
+    go func() {
+        chatHub.pumps.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+//Apply a reloaded backend list to the hub.
+func Reload(change util.BackendChange) {
+    chatHub.reload <- change
+}
+
 //Report offline user id and send fail message id
 //Get notify send to client
 func cronReport(hub *Hub) {
@@ -70,27 +129,35 @@ func cronReport(hub *Hub) {
         for util.Run {
             select {
             case <-reportTicker.C:
-                for language := range util.Languages {
-                    for server := range util.Config.RanzhiServer {
+                // 过期的确认队列中未确认的消息记录为发送失败，和其他发送失败的消息一样上报
+                hub.do(hub.expireAckQueues)
+
+                // 推送的后端服务器只需要上报离线用户和发送失败的消息
+                offline, _ := util.DBCountOffline()
+                sendfail, _ := util.DBCountSendfail()
+                for _, language := range util.GetLanguages() {
+                    for _, server := range util.GetRanzhiServerNames() {
+                        if pushedRecently(server) && offline[server] == 0 && sendfail[server] == 0 {
+                            continue
+                        }
+
                         messages, err := api.ReportAndGetNotify(server, language)
                         if messages != nil && err == nil {
-                            for userID, message := range messages {
-                                if client, ok := hub.clients[server][userID]; ok {
-                                    client.send <- message
-                                }
-                            }
+                            hub.deliver(server, messages)
                         }
                     }
                 }
 
             case <-changeTicker.C:
-                for language := range util.Languages {
-                    for server := range util.Config.RanzhiServer {
+                for _, language := range util.GetLanguages() {
+                    for _, server := range util.GetRanzhiServerNames() {
+                        if pushedRecently(server) {
+                            continue
+                        }
+
                         getList, err := api.CheckUserChange(server, language)
                         if getList != nil && err == nil {
-                            for _, client := range hub.clients[server] {
-                                client.send <- getList;
-                            }
+                            hub.do(func() { hub.sendAll(SendMsg{serverName: server, message: getList}) })
                         }
                     }
                 }
@@ -0,0 +1,182 @@
+/**
+ * The webhook file of wsocket current module of xxd.
+ *
+ * @copyright   Copyright 2009-2017 青岛易软天创网络科技有限公司(QingDao Nature Easy Soft Network Technology Co,LTD, www.cnezsoft.com)
+ * @license     ZPL (http://zpl.pub/page/zplv12.html)
+ * @author      Archer Peng <pengjiangxiu@cnezsoft.com>
+ * @package     wsocket
+ * @link        http://www.zentao.net
+ */
+package wsocket
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "sync"
+    "time"
+    "xxd/api"
+    "xxd/hyperttp/server"
+    "xxd/util"
+)
+
+// 第三方系统发送消息的路由，注册在通用端口上
+const webhookPath = "/webhook"
+
+const maxWebhookSize = 1 << 20
+
+// 请求头中的时间与xxd的时间相差超过该时间时拒绝，该时间内同一签名只能使用一次
+const webhookMaxSkew = 5 * time.Minute
+
+// 第三方系统提交的消息
+type webhookMessage struct {
+    Server      string `json:"server"`
+    Gid         string `json:"gid"` // 会话gid
+    Content     string `json:"content"`
+    ContentType string `json:"contentType"`
+}
+
+// 已使用过的签名，防止重放
+var (
+    webhookSeen   = make(map[string]time.Time)
+    webhookSeenMu sync.Mutex
+)
+
+func initWebhook(hub *Hub) {
+    server.HandleFunc(webhookPath, func(w http.ResponseWriter, r *http.Request) {
+        receiveWebhook(hub, w, r)
+    })
+}
+
+//接收第三方系统的消息，以集成配置的用户身份发送给后端服务器，再把结果发送给会话中的在线用户
+func receiveWebhook(hub *Hub, w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        writeAdminResult(w, http.StatusMethodNotAllowed, adminResult{Result: "fail", Message: "not supported request"})
+        return
+    }
+
+    body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookSize))
+    if err != nil {
+        writeAdminResult(w, http.StatusBadRequest, adminResult{Result: "fail", Message: "read body error"})
+        return
+    }
+
+    name := r.Header.Get("X-Xxd-Webhook")
+    webhook, ok := util.Config.Webhooks[name]
+    if !ok || !verifyWebhook(webhook.Secret, r.Header.Get("X-Xxd-Timestamp"), r.Header.Get("X-Xxd-Signature"), body) {
+        webhookTotal.Inc(name, "denied")
+        w.WriteHeader(http.StatusUnauthorized)
+        return
+    }
+
+    var message webhookMessage
+    if err := json.Unmarshal(body, &message); err != nil || message.Gid == "" || message.Content == "" {
+        webhookTotal.Inc(name, "invalid")
+        writeAdminResult(w, http.StatusBadRequest, adminResult{Result: "fail", Message: "gid and content are required"})
+        return
+    }
+
+    if message.Server == "" {
+        message.Server = webhook.Server
+    }
+    if message.Server == "" {
+        message.Server = util.GetDefaultServer()
+    }
+    if webhook.Server != "" && message.Server != webhook.Server {
+        webhookTotal.Inc(name, "denied")
+        writeAdminResult(w, http.StatusForbidden, adminResult{Result: "fail", Message: "backend not allowed"})
+        return
+    }
+    if _, ok := util.GetRanzhiServer(message.Server); !ok {
+        webhookTotal.Inc(name, "invalid")
+        writeAdminResult(w, http.StatusNotFound, adminResult{Result: "fail", Message: "backend not found"})
+        return
+    }
+
+    if message.ContentType == "" {
+        message.ContentType = "text"
+    }
+
+    x2cMessage, sendUsers, err := api.TransitData(webhookRequest(webhook.UserID, message), message.Server)
+    if err != nil {
+        util.LogError().Printf("webhook %s transit data error:%v", name, err)
+        webhookTotal.Inc(name, "error")
+        writeAdminResult(w, http.StatusBadGateway, adminResult{Result: "fail", Message: "backend request error"})
+        return
+    }
+
+    hub.fanOut(message.Server, sendUsers, x2cMessage)
+    webhookTotal.Inc(name, "success")
+    writeAdminResult(w, http.StatusOK, adminResult{Result: "success"})
+}
+
+//校验签名 sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+func verifyWebhook(secret, timestamp, signature string, body []byte) bool {
+    unixTime, err := util.String2Int64(timestamp)
+    if err != nil {
+        return false
+    }
+
+    now := time.Now()
+    sent := time.Unix(unixTime, 0)
+    if sent.Before(now.Add(-webhookMaxSkew)) || sent.After(now.Add(webhookMaxSkew)) {
+        return false
+    }
+
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(timestamp + "."))
+    mac.Write(body)
+    expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+    if !hmac.Equal([]byte(signature), []byte(expected)) {
+        return false
+    }
+
+    webhookSeenMu.Lock()
+    defer webhookSeenMu.Unlock()
+
+    for seen, at := range webhookSeen {
+        if now.Sub(at) > 2*webhookMaxSkew {
+            delete(webhookSeen, seen)
+        }
+    }
+
+    if _, ok := webhookSeen[signature]; ok {
+        return false
+    }
+    webhookSeen[signature] = now
+    return true
+}
+
+//转换为客户端发送消息的格式 chat.message
+func webhookRequest(userID int64, message webhookMessage) api.ParseData {
+    chatMessage := map[string]interface{}{
+        "gid":         newGid(),
+        "cgid":        message.Gid,
+        "user":        userID,
+        "type":        "normal",
+        "contentType": message.ContentType,
+        "content":     message.Content,
+    }
+
+    return api.ParseData{
+        "userID": userID,
+        "module": "chat",
+        "method": "message",
+        "params": map[string]interface{}{"messages": []interface{}{chatMessage}},
+    }
+}
+
+//生成消息的gid，格式与客户端相同(uuid v4)
+func newGid() string {
+    b := make([]byte, 16)
+    rand.Read(b)
+    b[6] = b[6]&0x0f | 0x40
+    b[8] = b[8]&0x3f | 0x80
+
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,107 @@
+package wsocket
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "xxd/api"
+    "xxd/api/apitest"
+    "xxd/util"
+)
+
+const testWebhookSecret = "0123456789abcdef"
+
+// 模拟后端服务器，把收到的 chat.message 请求发给用户1
+func startTestXXB(t *testing.T) chan api.ParseData {
+    requests := make(chan api.ParseData, 1)
+    xxb := apitest.NewBackend(t, testBackendToken, func(request api.ParseData) api.ParseData {
+        requests <- request
+        return api.ParseData{"module": "chat", "method": "message", "result": "success", "users": []int64{1}, "data": request["params"]}
+    })
+
+    setTestRanzhi(t, xxb.URL)
+
+    oldWebhooks := util.Config.Webhooks
+    util.Config.Webhooks = map[string]util.Webhook{
+        "ci":    {Secret: testWebhookSecret, UserID: 9},
+        "other": {Secret: testWebhookSecret, UserID: 9, Server: "other"},
+    }
+    t.Cleanup(func() { util.Config.Webhooks = oldWebhooks })
+
+    return requests
+}
+
+func signWebhook(secret, timestamp, body string) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(timestamp + "." + body))
+    return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(t *testing.T, hub *Hub, name, timestamp, signature, body string) int {
+    r := httptest.NewRequest("POST", webhookPath, bytes.NewReader([]byte(body)))
+    r.Header.Set("X-Xxd-Webhook", name)
+    r.Header.Set("X-Xxd-Timestamp", timestamp)
+    r.Header.Set("X-Xxd-Signature", signature)
+
+    w := httptest.NewRecorder()
+    receiveWebhook(hub, w, r)
+    return w.Code
+}
+
+func TestWebhook(t *testing.T) {
+    requests := startTestXXB(t)
+    hub := newTestHub(testServerName, 1)
+    user := userClient(hub, testServerName, 1)
+
+    body := `{"gid":"chat-gid","content":"build passed"}`
+    now := util.Int642String(util.GetUnixTime())
+    if code := postWebhook(t, hub, "ci", now, signWebhook(testWebhookSecret, now, body), body); code != http.StatusOK {
+        t.Fatalf("webhook returned %d", code)
+    }
+
+    request := <-requests
+    if request.Method() != "message" || request.UserID() != 9 {
+        t.Errorf("backend got %v", request)
+    }
+
+    if message := receive(t, user); !strings.Contains(message, `"content":"build passed"`) || !strings.Contains(message, `"cgid":"chat-gid"`) {
+        t.Errorf("chat member got %s", message)
+    }
+}
+
+func TestWebhookRejected(t *testing.T) {
+    startTestXXB(t)
+    hub := newTestHub(testServerName, 1)
+    body := `{"gid":"chat-gid","content":"x"}`
+    now := util.Int642String(util.GetUnixTime())
+    old := util.Int642String(util.GetUnixTime() - 3600)
+
+    if code := postWebhook(t, hub, "nosuch", now, signWebhook(testWebhookSecret, now, body), body); code != http.StatusUnauthorized {
+        t.Errorf("unknown webhook returned %d", code)
+    }
+    if code := postWebhook(t, hub, "ci", now, signWebhook("wrong secret 1234", now, body), body); code != http.StatusUnauthorized {
+        t.Errorf("wrong signature returned %d", code)
+    }
+    if code := postWebhook(t, hub, "ci", old, signWebhook(testWebhookSecret, old, body), body); code != http.StatusUnauthorized {
+        t.Errorf("expired timestamp returned %d", code)
+    }
+
+    empty := `{"gid":"chat-gid"}`
+    signature := signWebhook(testWebhookSecret, now, empty)
+    if code := postWebhook(t, hub, "ci", now, signature, empty); code != http.StatusBadRequest {
+        t.Errorf("message without content returned %d", code)
+    }
+    if code := postWebhook(t, hub, "ci", now, signature, empty); code != http.StatusUnauthorized {
+        t.Errorf("replayed signature returned %d", code)
+    }
+
+    body = `{"server":"xuanxuan","gid":"chat-gid","content":"x"}`
+    if code := postWebhook(t, hub, "other", now, signWebhook(testWebhookSecret, now, body), body); code != http.StatusForbidden {
+        t.Errorf("webhook limited to another backend returned %d", code)
+    }
+}